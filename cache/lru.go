@@ -0,0 +1,157 @@
+package cache
+
+import (
+	"container/list"
+	"hash/maphash"
+	"sync"
+	"time"
+)
+
+// versionSlots is the number of invalidation counters keys are hashed to,
+// see Version.
+const versionSlots = 256
+
+// LRU is a concurrency-safe least-recently-used cache of string values. A nil
+// *LRU is a valid, always empty cache.
+type LRU struct {
+	mu         sync.Mutex
+	maxEntries int
+	ttl        time.Duration
+	ll         *list.List
+	items      map[string]*list.Element
+	hits       uint64
+	misses     uint64
+	now        func() time.Time
+
+	seed     maphash.Seed
+	versions [versionSlots]uint64
+}
+
+type item struct {
+	key     string
+	value   string
+	expires time.Time
+}
+
+type Stats struct {
+	Entries int    `json:"entries"`
+	Hits    uint64 `json:"hits"`
+	Misses  uint64 `json:"misses"`
+}
+
+// New creates a cache holding up to maxEntries values, each for at most ttl.
+// A zero ttl keeps values until they are evicted or invalidated.
+func New(maxEntries int, ttl time.Duration) *LRU {
+	return &LRU{
+		maxEntries: maxEntries,
+		ttl:        ttl,
+		ll:         list.New(),
+		items:      make(map[string]*list.Element),
+		now:        time.Now,
+		seed:       maphash.MakeSeed(),
+	}
+}
+
+func (c *LRU) Get(key string) (string, bool) {
+	if c == nil {
+		return "", false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	el, ok := c.items[key]
+	if ok && c.ttl > 0 && c.now().After(el.Value.(*item).expires) {
+		c.removeElement(el)
+		ok = false
+	}
+	if !ok {
+		c.misses++
+		return "", false
+	}
+	c.hits++
+	c.ll.MoveToFront(el)
+	return el.Value.(*item).value, true
+}
+
+func (c *LRU) Set(key, value string) {
+	if c == nil || c.maxEntries <= 0 {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.set(key, value)
+}
+
+func (c *LRU) set(key, value string) {
+	expires := c.now().Add(c.ttl)
+	if el, ok := c.items[key]; ok {
+		it := el.Value.(*item)
+		it.value, it.expires = value, expires
+		c.ll.MoveToFront(el)
+		return
+	}
+	c.items[key] = c.ll.PushFront(&item{key: key, value: value, expires: expires})
+	if c.ll.Len() > c.maxEntries {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+// Version returns the invalidation version of key, to be taken before its
+// value is read from the backing store and passed to SetIfCurrent.
+func (c *LRU) Version(key string) uint64 {
+	if c == nil {
+		return 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.versions[c.slot(key)]
+}
+
+// SetIfCurrent caches value unless key was invalidated by Delete since
+// version was taken, in which case value may predate a write and is dropped.
+// It reports whether value was cached.
+func (c *LRU) SetIfCurrent(key, value string, version uint64) bool {
+	if c == nil || c.maxEntries <= 0 {
+		return false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if c.versions[c.slot(key)] != version {
+		return false
+	}
+	c.set(key, value)
+	return true
+}
+
+// Delete invalidates key, so the next Get goes to the backing store.
+func (c *LRU) Delete(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.versions[c.slot(key)]++
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+func (c *LRU) Stats() Stats {
+	if c == nil {
+		return Stats{}
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return Stats{Entries: c.ll.Len(), Hits: c.hits, Misses: c.misses}
+}
+
+// slot returns the version counter of key. Keys sharing a counter also
+// invalidate each other's pending SetIfCurrent.
+func (c *LRU) slot(key string) int {
+	return int(maphash.String(c.seed, key) % versionSlots)
+}
+
+func (c *LRU) removeElement(el *list.Element) {
+	c.ll.Remove(el)
+	delete(c.items, el.Value.(*item).key)
+}
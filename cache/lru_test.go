@@ -0,0 +1,120 @@
+package cache
+
+import (
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestLRU_Eviction(t *testing.T) {
+	c := New(2, 0)
+	c.Set("a", "1")
+	c.Set("b", "2")
+	if _, ok := c.Get("a"); !ok {
+		t.Fatal("expected a to be cached")
+	}
+	c.Set("c", "3")
+
+	if _, ok := c.Get("b"); ok {
+		t.Error("expected least recently used key b to be evicted")
+	}
+	for _, k := range []string{"a", "c"} {
+		if _, ok := c.Get(k); !ok {
+			t.Errorf("expected %s to be cached", k)
+		}
+	}
+	if st := c.Stats(); st.Entries != 2 || st.Hits != 3 || st.Misses != 1 {
+		t.Errorf("unexpected stats %+v", st)
+	}
+}
+
+func TestLRU_Invalidation(t *testing.T) {
+	c := New(10, 0)
+	c.Set("a", "1")
+	c.Set("a", "2")
+	if v, _ := c.Get("a"); v != "2" {
+		t.Errorf("expected updated value, got %q", v)
+	}
+	c.Delete("a")
+	if _, ok := c.Get("a"); ok {
+		t.Error("expected deleted key to miss")
+	}
+}
+
+func TestLRU_SetIfCurrent(t *testing.T) {
+	c := New(10, 0)
+	version := c.Version("a")
+	if !c.SetIfCurrent("a", "1", version) {
+		t.Error("expected a value read without invalidation to be cached")
+	}
+
+	version = c.Version("a")
+	c.Delete("a")
+	if c.SetIfCurrent("a", "stale", version) {
+		t.Error("expected a value read before Delete to be refused")
+	}
+	if _, ok := c.Get("a"); ok {
+		t.Error("expected refused value not to be cached")
+	}
+	if !c.SetIfCurrent("a", "2", c.Version("a")) {
+		t.Error("expected a value read after Delete to be cached")
+	}
+
+	var nilCache *LRU
+	if nilCache.SetIfCurrent("a", "1", nilCache.Version("a")) {
+		t.Error("nil cache must not cache values")
+	}
+}
+
+func TestLRU_TTL(t *testing.T) {
+	now := time.Unix(0, 0)
+	c := New(10, time.Minute)
+	c.now = func() time.Time { return now }
+
+	c.Set("a", "1")
+	now = now.Add(30 * time.Second)
+	if _, ok := c.Get("a"); !ok {
+		t.Error("expected value to be fresh")
+	}
+	now = now.Add(time.Minute)
+	if _, ok := c.Get("a"); ok {
+		t.Error("expected value to expire")
+	}
+	if st := c.Stats(); st.Entries != 0 {
+		t.Errorf("expired value was not removed: %+v", st)
+	}
+}
+
+func TestLRU_Nil(t *testing.T) {
+	var c *LRU
+	c.Set("a", "1")
+	c.Delete("a")
+	if _, ok := c.Get("a"); ok {
+		t.Error("nil cache must always miss")
+	}
+}
+
+func TestLRU_Concurrent(t *testing.T) {
+	c := New(50, time.Minute)
+	var wg sync.WaitGroup
+	for w := 0; w < 8; w++ {
+		wg.Add(1)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < 1000; i++ {
+				key := fmt.Sprintf("key-%d", (w+i)%100)
+				if _, ok := c.Get(key); !ok {
+					c.Set(key, key)
+				}
+				if i%10 == 0 {
+					c.Delete(key)
+				}
+			}
+		}(w)
+	}
+	wg.Wait()
+	if st := c.Stats(); st.Entries > 50 {
+		t.Errorf("cache grew beyond its limit: %+v", st)
+	}
+}
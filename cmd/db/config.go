@@ -0,0 +1,51 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+// openStore makes sure dir exists and is writable before opening the
+// datastore in it.
+func openStore(dir string, opts ...datastore.Option) (*datastore.Db, error) {
+	if err := os.MkdirAll(dir, 0o755); err != nil {
+		return nil, fmt.Errorf("create storage dir: %w", err)
+	}
+	probe, err := os.CreateTemp(dir, ".probe-")
+	if err != nil {
+		return nil, fmt.Errorf("storage dir %s is not writable: %w", dir, err)
+	}
+	_ = probe.Close()
+	_ = os.Remove(probe.Name())
+
+	return datastore.Open(dir, opts...)
+}
+
+// fileModesOption parses the octal modes of the -file-mode and -dir-mode
+// flags. It returns nil when neither is set, leaving the datastore
+// defaults.
+func fileModesOption(file, dir string) (datastore.Option, error) {
+	if file == "" && dir == "" {
+		return nil, nil
+	}
+	modes := [2]os.FileMode{0o600, 0o755}
+	for i, s := range []string{file, dir} {
+		if s == "" {
+			continue
+		}
+		m, err := strconv.ParseUint(s, 8, 32)
+		if err != nil || m > 0o777 {
+			return nil, fmt.Errorf("invalid mode %q: want octal permission bits such as 640", s)
+		}
+		modes[i] = os.FileMode(m)
+	}
+	return datastore.WithFileModes(modes[0], modes[1]), nil
+}
+
+func defaultDir() string {
+	return filepath.Join(os.TempDir(), "db-data")
+}
@@ -0,0 +1,45 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestOpenStore(t *testing.T) {
+	for _, dir := range []string{t.TempDir(), filepath.Join(t.TempDir(), "nested", "data")} {
+		store, err := openStore(dir)
+		if err != nil {
+			t.Fatalf("openStore(%s) failed: %v", dir, err)
+		}
+		if err := store.Put("k", "v"); err != nil {
+			t.Errorf("Put into %s failed: %v", dir, err)
+		}
+		_ = store.Close()
+	}
+
+	file := filepath.Join(t.TempDir(), "file")
+	if err := os.WriteFile(file, nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	if store, err := openStore(filepath.Join(file, "data")); err == nil {
+		_ = store.Close()
+		t.Error("Expected openStore to fail for a path under a regular file")
+	}
+}
+
+func TestFileModesOption(t *testing.T) {
+	if opt, err := fileModesOption("", ""); opt != nil || err != nil {
+		t.Errorf("fileModesOption() without modes = %v, %v", opt, err)
+	}
+	for _, mode := range []string{"640", "0750"} {
+		if opt, err := fileModesOption(mode, ""); opt == nil || err != nil {
+			t.Errorf("fileModesOption(%s) = %v, %v", mode, opt, err)
+		}
+	}
+	for _, mode := range []string{"rw-r-----", "9", "1777"} {
+		if _, err := fileModesOption("", mode); err == nil {
+			t.Errorf("fileModesOption() accepted %q", mode)
+		}
+	}
+}
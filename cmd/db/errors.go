@@ -0,0 +1,32 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+)
+
+// Error codes of the JSON error bodies.
+const (
+	codeNotFound         = "not_found"
+	codeCorrupted        = "corrupted"
+	codeBadRequest       = "bad_request"
+	codeTooLarge         = "too_large"
+	codeInternal         = "internal"
+	codeMethodNotAllowed = "method_not_allowed"
+	codeConflict         = "conflict"
+	codeReadOnly         = "read_only"
+)
+
+type errorResponse struct {
+	Error string `json:"error"`
+	Code  string `json:"code"`
+}
+
+// writeJSONError replies with status and a body of the form
+// {"error": msg, "code": code}.
+func writeJSONError(w http.ResponseWriter, status int, code, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("X-Content-Type-Options", "nosniff")
+	w.WriteHeader(status)
+	_ = json.NewEncoder(w).Encode(errorResponse{Error: msg, Code: code})
+}
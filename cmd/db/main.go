@@ -1,89 +1,524 @@
 package main
 
 import (
+	"context"
+	"encoding/hex"
 	"encoding/json"
 	"errors"
-	"log"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
 	"net/http"
 	"os"
-	"path/filepath"
+	"sort"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+	"github.com/roman-mazur/architecture-practice-4-template/env"
+	"github.com/roman-mazur/architecture-practice-4-template/httptools"
+	"github.com/roman-mazur/architecture-practice-4-template/signal"
 )
 
-var db *datastore.Db
+const (
+	maxBatchBodyBytes = 1 << 20
+	maxBatchKeys      = 1000
+	defaultKeysLimit  = 100
+	maxKeysLimit      = 1000
+	shutdownTimeout   = 10 * time.Second
+)
+
+var (
+	port = flag.Int("port", env.Int("DB_PORT", 8079), "db server port (env DB_PORT)")
+	dir  = flag.String("dir", env.String("DB_DIR", defaultDir()), "storage directory (env DB_DIR)")
+
+	debugEndpoints = flag.Bool("debug-endpoints", env.String("DB_DEBUG_ENDPOINTS", "") == "true", "serve debugging endpoints such as /segments (env DB_DEBUG_ENDPOINTS)")
+
+	fileMode = flag.String("file-mode", env.String("DB_FILE_MODE", ""), "octal permissions of the files the store creates, 600 by default (env DB_FILE_MODE)")
+	dirMode  = flag.String("dir-mode", env.String("DB_DIR_MODE", ""), "octal permissions of the directories the store creates, 755 by default (env DB_DIR_MODE)")
+
+	maxBodyBytes = flag.Int("max-body-bytes", env.Int("DB_MAX_BODY_BYTES", 16<<20), "largest accepted POST body (env DB_MAX_BODY_BYTES)")
+
+	logRequests = flag.Bool("log-requests", false, "log every handled request")
+	httpMetrics = flag.Bool("http-metrics", false, "add request counts by method and status class and latency percentiles to /metrics")
+	logFormat   = flag.String("log-format", httptools.LogFormatText, "log format: text or json")
+	logLevel    = flag.String("log-level", "info", "lowest logged level: debug, info, warn or error")
+
+	corsOrigins = flag.String("cors-origins", "", "comma separated origins allowed to call the server from a browser, * for any; empty disables CORS")
+	corsMethods = flag.String("cors-methods", "", "comma separated methods allowed for cross-origin requests")
+	corsHeaders = flag.String("cors-headers", "", "comma separated request headers allowed for cross-origin requests")
+)
+
+var (
+	db        *datastore.Db
+	dbMetrics = newMetrics()
+
+	// shuttingDown is closed when the server shuts down, ending the
+	// /subscribe streams that would otherwise hold the shutdown up.
+	shuttingDown = make(chan struct{})
+)
 
 func main() {
-	var err error
-	storagePath := filepath.Join(os.TempDir(), "db-data")
-	err = os.MkdirAll(storagePath, 0o755)
+	flag.Parse()
+
+	logger, err := httptools.NewLogger(os.Stderr, *logLevel, *logFormat)
 	if err != nil {
-		log.Fatalf("failed to create db storage dir: %v", err)
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
 	}
+	slog.SetDefault(logger)
+	ctx, stop := signal.NotifyContext()
+	defer stop()
 
-	db, err = datastore.Open(storagePath)
+	opts := []datastore.Option{datastore.WithMetrics(dbMetrics), datastore.WithLogger(logger)}
+	modes, err := fileModesOption(*fileMode, *dirMode)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	if modes != nil {
+		opts = append(opts, modes)
+	}
+	db, err = openStore(*dir, opts...)
 	if err != nil {
-		log.Fatalf("failed to open db: %v", err)
+		logger.Error("failed to open db", "dir", *dir, "err", err)
+		os.Exit(1)
 	}
-	defer db.Close()
 
-	http.HandleFunc("/db/", dbHandler)
+	handler := httptools.CORS(newHandler(), httptools.CORSConfig{
+		Origins: httptools.SplitList(*corsOrigins),
+		Methods: httptools.SplitList(*corsMethods),
+		Headers: httptools.SplitList(*corsHeaders),
+	})
+	if *logRequests {
+		handler = httptools.LogRequests(handler, logger)
+	}
+	if *httpMetrics {
+		dbMetrics.http = httptools.NewHTTPMetrics()
+		handler = dbMetrics.http.Wrap(handler)
+	}
+	server := &http.Server{
+		Addr:    fmt.Sprintf(":%d", *port),
+		Handler: handler,
+	}
+	server.RegisterOnShutdown(func() { close(shuttingDown) })
+	// Binding first makes a port in use fail the start.
+	ln, err := net.Listen("tcp", server.Addr)
+	if err != nil {
+		logger.Error("failed to start the DB HTTP server", "addr", server.Addr, "err", err)
+		_ = db.Close()
+		os.Exit(1)
+	}
+	go func() {
+		logger.Info("DB HTTP server listening", "addr", server.Addr, "dir", *dir)
+		if err := server.Serve(ln); !errors.Is(err, http.ErrServerClosed) {
+			logger.Error("DB HTTP server finished", "err", err)
+			os.Exit(1)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	logger.Info("shutting down")
+	if err := shutdown(server, db, shutdownTimeout); err != nil {
+		logger.Error("DB shutdown failed", "err", err)
+	}
+}
+
+func newHandler() http.Handler {
+	h := http.NewServeMux()
+	h.HandleFunc("/db/", dbHandler)
+	h.HandleFunc("/db-batch", batchHandler)
+	h.HandleFunc("/stats", statsHandler)
+	h.HandleFunc("/keys", keysHandler)
+	h.HandleFunc("/compact", compactHandler)
+	h.HandleFunc("/subscribe", subscribeHandler)
+	h.Handle("/metrics", dbMetrics)
+	if *debugEndpoints {
+		h.HandleFunc("/segments", segmentsHandler)
+	}
+	return h
+}
 
-	port := "8079"
-	log.Printf("DB HTTP server listening on :%s", port)
-	log.Fatal(http.ListenAndServe(":"+port, nil))
+// shutdown stops accepting connections, waits for in-flight requests and only
+// then closes the store, so every acknowledged write reaches the segment.
+func shutdown(server *http.Server, store *datastore.Db, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(context.Background(), timeout)
+	defer cancel()
+	err := server.Shutdown(ctx)
+	if cerr := store.Close(); err == nil {
+		err = cerr
+	}
+	return err
 }
 
 func dbHandler(w http.ResponseWriter, r *http.Request) {
 	key := strings.TrimPrefix(r.URL.Path, "/db/")
 	if key == "" {
-		http.Error(w, "missing key", http.StatusBadRequest)
+		writeJSONError(w, http.StatusBadRequest, codeBadRequest, "missing key")
 		return
 	}
 
 	switch r.Method {
 	case http.MethodGet:
-		handleGet(key, w)
+		handleGet(key, w, r)
+	case http.MethodHead:
+		handleHead(key, w)
 	case http.MethodPost:
 		handlePost(key, w, r)
+	case http.MethodDelete:
+		handleDelete(key, w)
 	default:
-		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		writeJSONError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
 	}
 }
 
-func handleGet(key string, w http.ResponseWriter) {
-	val, err := db.Get(key)
+func handleGet(key string, w http.ResponseWriter, r *http.Request) {
+	val, meta, err := db.GetWithMetadata(key)
 	if err != nil {
-		if errors.Is(err, datastore.ErrNotFound) || errors.Is(err, datastore.ErrCorrupted) {
-			http.NotFound(w, nil)
+		if errors.Is(err, datastore.ErrNotFound) {
+			writeJSONError(w, http.StatusNotFound, codeNotFound, "key not found")
+			return
+		}
+		if errors.Is(err, datastore.ErrCorrupted) {
+			slog.Error("stored value is corrupted", "key", key, "err", err)
+			writeJSONError(w, http.StatusUnprocessableEntity, codeCorrupted, "stored value is corrupted")
 			return
 		}
-		http.Error(w, "internal error", http.StatusInternalServerError)
+		if errors.Is(err, datastore.ErrSegmentMissing) {
+			slog.Warn("get failed", "key", key, "err", err)
+			writeJSONError(w, http.StatusNotFound, codeNotFound, "key not found")
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, codeInternal, "internal error")
 		return
 	}
 
+	// The stored checksum changes whenever the record does, so it serves as
+	// the entity tag, with a suffix telling the two representations apart.
+	plain := wantsPlainText(r)
+	tag := hex.EncodeToString(meta.Checksum)
+	if plain {
+		tag += "-txt"
+	}
+	etag := `"` + tag + `"`
+	w.Header().Set("Vary", "Accept")
+	w.Header().Set("ETag", etag)
+	if !meta.Modified.IsZero() {
+		w.Header().Set("Last-Modified", meta.Modified.UTC().Format(http.TimeFormat))
+	}
+	if etagMatches(r.Header.Get("If-None-Match"), etag) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+
+	if plain {
+		w.Header().Set("Content-Type", "text/plain; charset=utf-8")
+		_, _ = io.WriteString(w, val)
+		return
+	}
 	resp := map[string]string{
 		"key":   key,
 		"value": val,
 	}
+	if !meta.Modified.IsZero() {
+		resp["modified"] = meta.Modified.UTC().Format(time.RFC3339Nano)
+	}
 	w.Header().Set("Content-Type", "application/json")
 	_ = json.NewEncoder(w).Encode(resp)
 }
 
+func etagMatches(ifNoneMatch, etag string) bool {
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		candidate = strings.TrimPrefix(strings.TrimSpace(candidate), "W/")
+		if candidate == "*" || candidate == etag {
+			return true
+		}
+	}
+	return false
+}
+
+// wantsPlainText reports whether the Accept header of r lists text/plain
+// before any JSON type. Without an Accept header values are sent as JSON.
+func wantsPlainText(r *http.Request) bool {
+	for _, accept := range r.Header.Values("Accept") {
+		for _, part := range strings.Split(accept, ",") {
+			mediaType, _, _ := strings.Cut(part, ";")
+			switch strings.ToLower(strings.TrimSpace(mediaType)) {
+			case "text/plain", "text/*":
+				return true
+			case "application/json", "application/*", "*/*":
+				return false
+			}
+		}
+	}
+	return false
+}
+
+func handleHead(key string, w http.ResponseWriter) {
+	ok, size, err := db.Exists(key)
+	if err != nil {
+		w.WriteHeader(http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		w.WriteHeader(http.StatusNotFound)
+		return
+	}
+
+	w.Header().Set("Content-Length", strconv.Itoa(size))
+	w.WriteHeader(http.StatusOK)
+}
+
 func handlePost(key string, w http.ResponseWriter, r *http.Request) {
+	// A missing value is rejected rather than stored as "", which is a
+	// legitimate value of its own.
 	var body struct {
-		Value string `json:"value"`
+		Value *string `json:"value"`
 	}
-	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
-		http.Error(w, "bad request", http.StatusBadRequest)
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, int64(*maxBodyBytes))).Decode(&body); err != nil || body.Value == nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, codeTooLarge, "value too large")
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, codeBadRequest, "bad request")
 		return
 	}
 
-	if err := db.Put(key, body.Value); err != nil {
-		http.Error(w, "failed to store value", http.StatusInternalServerError)
+	if err := db.Put(key, *body.Value); err != nil {
+		if errors.Is(err, datastore.ErrValueTooLarge) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, codeTooLarge, "value too large")
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, codeInternal, "failed to store value")
 		return
 	}
 
 	w.WriteHeader(http.StatusCreated)
 }
+
+func handleDelete(key string, w http.ResponseWriter) {
+	if err := db.Delete(key); err != nil {
+		if errors.Is(err, datastore.ErrNotFound) {
+			writeJSONError(w, http.StatusNotFound, codeNotFound, "key not found")
+			return
+		}
+		writeJSONError(w, http.StatusInternalServerError, codeInternal, "failed to delete value")
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func batchHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	var keys []string
+	if err := json.NewDecoder(http.MaxBytesReader(w, r.Body, maxBatchBodyBytes)).Decode(&keys); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			writeJSONError(w, http.StatusRequestEntityTooLarge, codeTooLarge, "request too large")
+			return
+		}
+		writeJSONError(w, http.StatusBadRequest, codeBadRequest, "bad request")
+		return
+	}
+	if len(keys) > maxBatchKeys {
+		writeJSONError(w, http.StatusRequestEntityTooLarge, codeTooLarge, "too many keys")
+		return
+	}
+
+	values, err := db.GetMany(keys)
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, codeInternal, "internal error")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(values)
+}
+
+func statsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	st, err := db.Stats()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, codeInternal, "failed to collect stats")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(st)
+}
+
+type changeEvent struct {
+	Key  string `json:"key"`
+	Type string `json:"type"`
+}
+
+// subscribeHandler streams the changes made to the store as Server-Sent
+// Events until the client disconnects. A client too slow to keep up misses
+// events, see datastore.Db.Subscribe.
+func subscribeHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	events, unsubscribe := db.Subscribe()
+	defer unsubscribe()
+	rc := http.NewResponseController(w)
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	if err := rc.Flush(); err != nil {
+		return
+	}
+	for {
+		select {
+		case ev, ok := <-events:
+			if !ok {
+				return
+			}
+			data, err := json.Marshal(changeEvent{Key: ev.Key, Type: ev.Type.String()})
+			if err != nil {
+				return
+			}
+			if _, err := fmt.Fprintf(w, "data: %s\n\n", data); err != nil {
+				return
+			}
+			if err := rc.Flush(); err != nil {
+				return
+			}
+		case <-r.Context().Done():
+			return
+		case <-shuttingDown:
+			return
+		}
+	}
+}
+
+// compactHandler runs a compaction and reports how much the segment files
+// shrank. Writes made while it runs count against the reclaimed bytes.
+func compactHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		writeJSONError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	before, err := db.Stats()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, codeInternal, "failed to collect stats")
+		return
+	}
+	if err := db.Compact(); err != nil {
+		switch {
+		case errors.Is(err, datastore.ErrCompacting):
+			writeJSONError(w, http.StatusConflict, codeConflict, "compaction already in progress")
+		case errors.Is(err, datastore.ErrReadOnly):
+			writeJSONError(w, http.StatusForbidden, codeReadOnly, "store is read-only")
+		default:
+			slog.Error("compaction failed", "err", err)
+			writeJSONError(w, http.StatusInternalServerError, codeInternal, "compaction failed")
+		}
+		return
+	}
+	after, err := db.Stats()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, codeInternal, "failed to collect stats")
+		return
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(map[string]int64{
+		"reclaimed_bytes": max(before.DiskBytes-after.DiskBytes, 0),
+		"segments":        int64(after.Segments),
+		"disk_bytes":      after.DiskBytes,
+	})
+}
+
+type segmentResponse struct {
+	ID      int       `json:"id"`
+	Size    int64     `json:"size"`
+	Records int       `json:"records"`
+	ModTime time.Time `json:"mod_time"`
+	Current bool      `json:"current"`
+}
+
+// segmentsHandler lists the segment files, oldest first.
+func segmentsHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	segments, err := db.Segments()
+	if err != nil {
+		writeJSONError(w, http.StatusInternalServerError, codeInternal, "failed to list segments")
+		return
+	}
+	resp := struct {
+		Segments []segmentResponse `json:"segments"`
+	}{Segments: make([]segmentResponse, 0, len(segments))}
+	for _, s := range segments {
+		resp.Segments = append(resp.Segments, segmentResponse{
+			ID:      s.ID,
+			Size:    s.Size,
+			Records: s.Records,
+			ModTime: s.ModTime,
+			Current: s.Current,
+		})
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(resp)
+}
+
+// keysHandler lists keys in sorted order. Pages are requested with limit and
+// continued by passing the last returned key as after.
+func keysHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+
+	query := r.URL.Query()
+	limit := defaultKeysLimit
+	if l := query.Get("limit"); l != "" {
+		var err error
+		if limit, err = strconv.Atoi(l); err != nil || limit <= 0 || limit > maxKeysLimit {
+			writeJSONError(w, http.StatusBadRequest, codeBadRequest, "invalid limit")
+			return
+		}
+	}
+	after := query.Get("after")
+	prefix := query.Get("prefix")
+
+	pairs, err := db.ScanSorted(prefix)
+	if err != nil {
+		slog.Error("listing keys failed", "prefix", prefix, "err", err)
+		writeJSONError(w, http.StatusInternalServerError, codeInternal, "internal error")
+		return
+	}
+	start := sort.Search(len(pairs), func(i int) bool { return pairs[i].Key > after })
+	keys := make([]string, 0, min(limit, len(pairs)-start))
+	for _, kv := range pairs[start:] {
+		if len(keys) == limit {
+			break
+		}
+		keys = append(keys, kv.Key)
+	}
+
+	w.Header().Set("Content-Type", "application/json")
+	_ = json.NewEncoder(w).Encode(keys)
+}
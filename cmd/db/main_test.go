@@ -0,0 +1,689 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+func startTestServer(t *testing.T) *httptest.Server {
+	t.Helper()
+	var err error
+	dbMetrics = newMetrics()
+	db, err = datastore.Open(t.TempDir(), datastore.WithMetrics(dbMetrics))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(newHandler())
+	t.Cleanup(func() {
+		srv.Close()
+		_ = db.Close()
+	})
+	return srv
+}
+
+func doRequest(t *testing.T, method, url, body string) *http.Response {
+	t.Helper()
+	req, err := http.NewRequest(method, url, strings.NewReader(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp, err := http.DefaultClient.Do(req)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	return resp
+}
+
+func TestDbHandler_Delete(t *testing.T) {
+	srv := startTestServer(t)
+	url := srv.URL + "/db/some-key"
+
+	if resp := doRequest(t, http.MethodPost, url, `{"value":"v"}`); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST returned %d", resp.StatusCode)
+	}
+	if resp := doRequest(t, http.MethodDelete, url, ""); resp.StatusCode != http.StatusNoContent {
+		t.Errorf("DELETE returned %d", resp.StatusCode)
+	}
+	if resp := doRequest(t, http.MethodGet, url, ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET after DELETE returned %d", resp.StatusCode)
+	}
+	if resp := doRequest(t, http.MethodDelete, url, ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("second DELETE returned %d", resp.StatusCode)
+	}
+	if resp := doRequest(t, http.MethodPatch, url, ""); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("PATCH returned %d", resp.StatusCode)
+	}
+}
+
+func TestDbHandler_Head(t *testing.T) {
+	srv := startTestServer(t)
+	if resp := doRequest(t, http.MethodPost, srv.URL+"/db/present", `{"value":"12345"}`); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST returned %d", resp.StatusCode)
+	}
+
+	resp := doRequest(t, http.MethodHead, srv.URL+"/db/present", "")
+	if resp.StatusCode != http.StatusOK || resp.ContentLength != 5 {
+		t.Errorf("HEAD present returned %d with length %d", resp.StatusCode, resp.ContentLength)
+	}
+	if resp := doRequest(t, http.MethodHead, srv.URL+"/db/absent", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("HEAD absent returned %d", resp.StatusCode)
+	}
+}
+
+func TestBatchHandler(t *testing.T) {
+	srv := startTestServer(t)
+	for _, k := range []string{"a", "b"} {
+		if resp := doRequest(t, http.MethodPost, srv.URL+"/db/"+k, `{"value":"value-`+k+`"}`); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("POST returned %d", resp.StatusCode)
+		}
+	}
+
+	resp, err := http.Post(srv.URL+"/db-batch", "application/json", strings.NewReader(`["a","missing","b"]`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		t.Fatalf("batch returned %d", resp.StatusCode)
+	}
+	var values map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&values); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(values, map[string]string{"a": "value-a", "b": "value-b"}) {
+		t.Errorf("Unexpected batch response %v", values)
+	}
+
+	tooMany, _ := json.Marshal(make([]string, maxBatchKeys+1))
+	if resp := doRequest(t, http.MethodPost, srv.URL+"/db-batch", string(tooMany)); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("oversized batch returned %d", resp.StatusCode)
+	}
+	if resp := doRequest(t, http.MethodPost, srv.URL+"/db-batch", "not json"); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("malformed batch returned %d", resp.StatusCode)
+	}
+}
+
+func TestShutdown_DrainsInFlightRequests(t *testing.T) {
+	tmp := t.TempDir()
+	var err error
+	db, err = datastore.Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	started := make(chan struct{})
+	handler := newHandler()
+	server := &http.Server{Handler: http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		close(started)
+		time.Sleep(100 * time.Millisecond)
+		handler.ServeHTTP(rw, r)
+	})}
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		_ = server.Serve(ln)
+	}()
+
+	status := make(chan int, 1)
+	go func() {
+		resp, err := http.Post("http://"+ln.Addr().String()+"/db/inflight", "application/json", strings.NewReader(`{"value":"v"}`))
+		if err != nil {
+			status <- 0
+			return
+		}
+		_ = resp.Body.Close()
+		status <- resp.StatusCode
+	}()
+
+	<-started
+	if err := shutdown(server, db, time.Second); err != nil {
+		t.Fatalf("shutdown failed: %v", err)
+	}
+	if code := <-status; code != http.StatusCreated {
+		t.Errorf("In-flight request finished with %d", code)
+	}
+
+	store, err := datastore.Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	if got, err := store.Get("inflight"); err != nil || got != "v" {
+		t.Errorf("In-flight write was lost: %q, %v", got, err)
+	}
+}
+
+func TestStatsHandler(t *testing.T) {
+	srv := startTestServer(t)
+	for _, k := range []string{"a", "b", "a", "c"} {
+		doRequest(t, http.MethodPost, srv.URL+"/db/"+k, `{"value":"v"}`)
+	}
+	doRequest(t, http.MethodDelete, srv.URL+"/db/c", "")
+
+	resp, err := http.Get(srv.URL + "/stats")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+		t.Errorf("Unexpected content type %q", ct)
+	}
+
+	var st map[string]any
+	if err := json.NewDecoder(resp.Body).Decode(&st); err != nil {
+		t.Fatal(err)
+	}
+	for field, want := range map[string]float64{"keys": 2, "segments": 1, "dead_records": 3, "tombstones": 1} {
+		if st[field] != want {
+			t.Errorf("Expected %s=%v, got %v", field, want, st[field])
+		}
+	}
+	if size, _ := st["disk_bytes"].(float64); size <= 0 {
+		t.Errorf("Expected positive disk_bytes, got %v", st["disk_bytes"])
+	}
+}
+
+func TestKeysHandler(t *testing.T) {
+	srv := startTestServer(t)
+	for _, k := range []string{"user:3", "user:1", "other:1", "user:2", "user:4", "user:5"} {
+		doRequest(t, http.MethodPost, srv.URL+"/db/"+k, `{"value":"v"}`)
+	}
+
+	listKeys := func(query string) []string {
+		t.Helper()
+		resp, err := http.Get(srv.URL + "/keys?" + query)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Fatalf("GET /keys?%s returned %d", query, resp.StatusCode)
+		}
+		var keys []string
+		if err := json.NewDecoder(resp.Body).Decode(&keys); err != nil {
+			t.Fatal(err)
+		}
+		return keys
+	}
+
+	if keys := listKeys("prefix=user:"); !reflect.DeepEqual(keys, []string{"user:1", "user:2", "user:3", "user:4", "user:5"}) {
+		t.Errorf("Unexpected prefix listing %v", keys)
+	}
+
+	var pages [][]string
+	after := ""
+	for {
+		page := listKeys("prefix=user:&limit=2&after=" + after)
+		if len(page) == 0 {
+			break
+		}
+		pages = append(pages, page)
+		after = page[len(page)-1]
+	}
+	expected := [][]string{{"user:1", "user:2"}, {"user:3", "user:4"}, {"user:5"}}
+	if !reflect.DeepEqual(pages, expected) {
+		t.Errorf("Unexpected pages %v", pages)
+	}
+
+	if keys := listKeys("after=user:5"); len(keys) != 0 {
+		t.Errorf("Expected no keys after the last one, got %v", keys)
+	}
+	// A cursor sorting before the prefix starts at the first matching key.
+	if keys := listKeys("prefix=user:&limit=2&after=other:1"); !reflect.DeepEqual(keys, []string{"user:1", "user:2"}) {
+		t.Errorf("Unexpected listing after a key before the prefix %v", keys)
+	}
+	if keys := listKeys("prefix=other:&after=user:1"); len(keys) != 0 {
+		t.Errorf("Expected no keys after a cursor past the prefix, got %v", keys)
+	}
+	for _, limit := range []string{"0", "-1", "abc", "1001"} {
+		if resp := doRequest(t, http.MethodGet, srv.URL+"/keys?limit="+limit, ""); resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("limit=%s returned %d", limit, resp.StatusCode)
+		}
+	}
+}
+
+func TestMetrics(t *testing.T) {
+	srv := startTestServer(t)
+
+	doRequest(t, http.MethodPost, srv.URL+"/db/k", `{"value":"some value"}`)
+	doRequest(t, http.MethodGet, srv.URL+"/db/k", "")
+	doRequest(t, http.MethodGet, srv.URL+"/db/missing", "")
+
+	resp, err := http.Get(srv.URL + "/metrics")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, line := range []string{
+		"db_puts_total 1",
+		"db_gets_total 2",
+		"db_get_misses_total 1",
+		`db_value_size_bytes_bucket{le="64"} 1`,
+		"db_value_size_bytes_sum 10",
+	} {
+		if !strings.Contains(string(body), line+"\n") {
+			t.Errorf("metrics output is missing %q:\n%s", line, body)
+		}
+	}
+}
+
+func TestDbHandler_BodyTooLarge(t *testing.T) {
+	srv := startTestServer(t)
+	defer func(limit int) { *maxBodyBytes = limit }(*maxBodyBytes)
+	*maxBodyBytes = 100
+
+	if resp := doRequest(t, http.MethodPost, srv.URL+"/db/big", `{"value":"`+strings.Repeat("v", 200)+`"}`); resp.StatusCode != http.StatusRequestEntityTooLarge {
+		t.Errorf("POST of an oversized body returned %d", resp.StatusCode)
+	}
+	if resp := doRequest(t, http.MethodGet, srv.URL+"/db/big", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("oversized value was stored: GET returned %d", resp.StatusCode)
+	}
+	if resp := doRequest(t, http.MethodPost, srv.URL+"/db/small", `{"value":"v"}`); resp.StatusCode != http.StatusCreated {
+		t.Errorf("POST below the limit returned %d", resp.StatusCode)
+	}
+}
+
+func TestDbHandler_Accept(t *testing.T) {
+	srv := startTestServer(t)
+	if resp := doRequest(t, http.MethodPost, srv.URL+"/db/k", `{"value":"plain value"}`); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST returned %d", resp.StatusCode)
+	}
+
+	for _, c := range []struct {
+		accept, contentType, body string
+	}{
+		{"", "application/json", `{"key":"k","value":"plain value"}` + "\n"},
+		{"application/json", "application/json", `{"key":"k","value":"plain value"}` + "\n"},
+		{"text/plain", "text/plain; charset=utf-8", "plain value"},
+		{"text/html, text/plain;q=0.9", "text/plain; charset=utf-8", "plain value"},
+	} {
+		req, _ := http.NewRequest(http.MethodGet, srv.URL+"/db/k", nil)
+		if c.accept != "" {
+			req.Header.Set("Accept", c.accept)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		// The write time is covered by TestDbHandler_LastModified.
+		body = regexp.MustCompile(`"modified":"[^"]*",`).ReplaceAll(body, nil)
+		if resp.StatusCode != http.StatusOK || resp.Header.Get("Content-Type") != c.contentType || string(body) != c.body {
+			t.Errorf("GET with Accept %q = %d %q %q", c.accept, resp.StatusCode, resp.Header.Get("Content-Type"), body)
+		}
+		if vary := resp.Header.Get("Vary"); vary != "Accept" {
+			t.Errorf("GET with Accept %q has Vary %q, want Accept", c.accept, vary)
+		}
+	}
+}
+
+func TestDbHandler_ETag(t *testing.T) {
+	srv := startTestServer(t)
+	url := srv.URL + "/db/k"
+	if resp := doRequest(t, http.MethodPost, url, `{"value":"v1"}`); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST returned %d", resp.StatusCode)
+	}
+
+	getAs := func(accept, ifNoneMatch string) (*http.Response, string) {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, url, nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if ifNoneMatch != "" {
+			req.Header.Set("If-None-Match", ifNoneMatch)
+		}
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		body, _ := io.ReadAll(resp.Body)
+		_ = resp.Body.Close()
+		return resp, string(body)
+	}
+	get := func(ifNoneMatch string) (*http.Response, string) {
+		t.Helper()
+		return getAs("", ifNoneMatch)
+	}
+
+	resp, _ := get("")
+	etag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || len(etag) < 3 {
+		t.Fatalf("GET = %d with ETag %q", resp.StatusCode, etag)
+	}
+	if resp, body := get(etag); resp.StatusCode != http.StatusNotModified || body != "" || resp.Header.Get("ETag") != etag {
+		t.Errorf("GET with a matching If-None-Match = %d %q", resp.StatusCode, body)
+	}
+	if resp, _ := get(`"other", ` + etag); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("GET with a matching If-None-Match list = %d", resp.StatusCode)
+	}
+	// The plain text representation has a tag of its own.
+	resp, body := getAs("text/plain", etag)
+	textTag := resp.Header.Get("ETag")
+	if resp.StatusCode != http.StatusOK || body != "v1" || textTag == etag {
+		t.Errorf("GET text/plain with the JSON ETag = %d %q, ETag %q", resp.StatusCode, body, textTag)
+	}
+	if resp, _ := getAs("text/plain", textTag); resp.StatusCode != http.StatusNotModified {
+		t.Errorf("GET text/plain with its own ETag = %d", resp.StatusCode)
+	}
+
+	if resp := doRequest(t, http.MethodPost, url, `{"value":"v2"}`); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST returned %d", resp.StatusCode)
+	}
+	resp, body = get(etag)
+	if resp.StatusCode != http.StatusOK || !strings.Contains(body, "v2") || resp.Header.Get("ETag") == etag {
+		t.Errorf("GET with a stale If-None-Match = %d %q, ETag %q", resp.StatusCode, body, resp.Header.Get("ETag"))
+	}
+}
+
+func TestDbHandler_EmptyValue(t *testing.T) {
+	srv := startTestServer(t)
+
+	if resp := doRequest(t, http.MethodPost, srv.URL+"/db/empty", `{"value":""}`); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST of an empty value returned %d", resp.StatusCode)
+	}
+	if resp := doRequest(t, http.MethodPost, srv.URL+"/db/no-value", `{}`); resp.StatusCode != http.StatusBadRequest {
+		t.Errorf("POST without a value returned %d", resp.StatusCode)
+	}
+
+	resp, err := http.Get(srv.URL + "/db/empty")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body map[string]string
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	delete(body, "modified")
+	if resp.StatusCode != http.StatusOK || !reflect.DeepEqual(body, map[string]string{"key": "empty", "value": ""}) {
+		t.Errorf("GET of an empty value = %d %v", resp.StatusCode, body)
+	}
+
+	if resp := doRequest(t, http.MethodGet, srv.URL+"/db/missing", ""); resp.StatusCode != http.StatusNotFound {
+		t.Errorf("GET of a missing key returned %d", resp.StatusCode)
+	}
+}
+
+func TestSegmentsHandler(t *testing.T) {
+	var err error
+	db, err = datastore.OpenWithLimit(t.TempDir(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+
+	srv := httptest.NewServer(newHandler())
+	resp, err := http.Get(srv.URL + "/segments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	srv.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("/segments without -debug-endpoints returned %d", resp.StatusCode)
+	}
+
+	*debugEndpoints = true
+	t.Cleanup(func() { *debugEndpoints = false })
+	srv = httptest.NewServer(newHandler())
+	defer srv.Close()
+	for _, k := range []string{"a", "b", "c", "d", "e"} {
+		doRequest(t, http.MethodPost, srv.URL+"/db/"+k, `{"value":"some value"}`)
+	}
+
+	resp, err = http.Get(srv.URL + "/segments")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body struct {
+		Segments []segmentResponse `json:"segments"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	if len(body.Segments) < 2 {
+		t.Fatalf("Expected rollovers, got %+v", body.Segments)
+	}
+	records := 0
+	for i, s := range body.Segments {
+		records += s.Records
+		if s.Current != (i == len(body.Segments)-1) || s.Size <= 0 {
+			t.Errorf("Unexpected segment %+v", s)
+		}
+	}
+	if records != 5 {
+		t.Errorf("Segments hold %d records, want 5", records)
+	}
+}
+
+func TestCompactHandler(t *testing.T) {
+	var err error
+	db, err = datastore.OpenWithLimit(t.TempDir(), 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	srv := httptest.NewServer(newHandler())
+	defer srv.Close()
+
+	for i := 0; i < 30; i++ {
+		doRequest(t, http.MethodPost, srv.URL+"/db/"+[]string{"a", "b", "c"}[i%3], `{"value":"some value"}`)
+	}
+	before, _ := db.Stats()
+
+	if resp := doRequest(t, http.MethodGet, srv.URL+"/compact", ""); resp.StatusCode != http.StatusMethodNotAllowed {
+		t.Errorf("GET /compact returned %d", resp.StatusCode)
+	}
+	resp, err := http.Post(srv.URL+"/compact", "", nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var body map[string]int64
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		t.Fatal(err)
+	}
+	after, _ := db.Stats()
+	if resp.StatusCode != http.StatusOK || body["reclaimed_bytes"] <= 0 || body["disk_bytes"] != after.DiskBytes || after.DiskBytes >= before.DiskBytes {
+		t.Errorf("POST /compact returned %d %v; disk bytes %d before, %d after", resp.StatusCode, body, before.DiskBytes, after.DiskBytes)
+	}
+	if body["segments"] != int64(after.Segments) || after.Segments >= before.Segments {
+		t.Errorf("Segments %d before, %d after, response %v", before.Segments, after.Segments, body)
+	}
+	if got, err := db.Get("b"); err != nil || got != "some value" {
+		t.Errorf("Get(b) after compaction = %q, %v", got, err)
+	}
+}
+
+func TestDbHandler_JSONErrors(t *testing.T) {
+	tmp := t.TempDir()
+	var err error
+	db, err = datastore.Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(newHandler())
+	defer srv.Close()
+	defer func(limit int) { *maxBodyBytes = limit }(*maxBodyBytes)
+	*maxBodyBytes = 100
+
+	doRequest(t, http.MethodPost, srv.URL+"/db/broken", `{"value":"some value"}`)
+	_, meta, err := db.GetWithMetadata("broken")
+	if err != nil {
+		t.Fatal(err)
+	}
+	f, err := os.OpenFile(filepath.Join(tmp, "segment-"+strconv.Itoa(meta.SegmentID)), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Overwrite the last value byte, just before the checksum.
+	if _, err := f.WriteAt([]byte("X"), meta.Offset+int64(meta.Size)-int64(len(meta.Checksum))-1); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	for _, tc := range []struct {
+		name, method, path, body string
+		status                   int
+		code                     string
+	}{
+		{"missing key", http.MethodGet, "/db/absent", "", http.StatusNotFound, codeNotFound},
+		{"corrupted value", http.MethodGet, "/db/broken", "", http.StatusUnprocessableEntity, codeCorrupted},
+		{"empty key", http.MethodGet, "/db/", "", http.StatusBadRequest, codeBadRequest},
+		{"invalid body", http.MethodPost, "/db/k", "not json", http.StatusBadRequest, codeBadRequest},
+		{"oversized body", http.MethodPost, "/db/k", `{"value":"` + strings.Repeat("v", 200) + `"}`, http.StatusRequestEntityTooLarge, codeTooLarge},
+		{"bad method", http.MethodPut, "/db/k", "", http.StatusMethodNotAllowed, codeMethodNotAllowed},
+		{"delete missing", http.MethodDelete, "/db/absent", "", http.StatusNotFound, codeNotFound},
+		{"closed store", http.MethodPost, "/db/k", `{"value":"v"}`, http.StatusInternalServerError, codeInternal},
+	} {
+		if tc.name == "closed store" {
+			_ = db.Close()
+		}
+		req, _ := http.NewRequest(tc.method, srv.URL+tc.path, strings.NewReader(tc.body))
+		resp, err := http.DefaultClient.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var body errorResponse
+		decodeErr := json.NewDecoder(resp.Body).Decode(&body)
+		_ = resp.Body.Close()
+		if resp.StatusCode != tc.status || decodeErr != nil || body.Code != tc.code || body.Error == "" {
+			t.Errorf("%s: got %d %+v (%v), want %d with code %s", tc.name, resp.StatusCode, body, decodeErr, tc.status, tc.code)
+		}
+		if ct := resp.Header.Get("Content-Type"); ct != "application/json" {
+			t.Errorf("%s: content type %q", tc.name, ct)
+		}
+	}
+}
+
+func TestDbHandler_CorruptedValue(t *testing.T) {
+	tmp := t.TempDir()
+	var logs bytes.Buffer
+	var err error
+	db, err = datastore.Open(tmp, datastore.WithLogger(slog.New(slog.NewTextHandler(&logs, nil))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = db.Close() })
+	srv := httptest.NewServer(newHandler())
+	defer srv.Close()
+
+	doRequest(t, http.MethodPost, srv.URL+"/db/a", `{"value":"first"}`)
+	doRequest(t, http.MethodPost, srv.URL+"/db/b", `{"value":"second"}`)
+	_, meta, err := db.GetWithMetadata("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(tmp, "segment-"+strconv.Itoa(meta.SegmentID))
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[meta.Offset+int64(meta.Size)-int64(len(meta.Checksum))-1] ^= 0xFF
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	resp := doRequest(t, http.MethodGet, srv.URL+"/db/b", "")
+	if resp.StatusCode == http.StatusNotFound || resp.StatusCode == http.StatusOK {
+		t.Errorf("GET of a corrupted value returned %d", resp.StatusCode)
+	}
+	want := fmt.Sprintf("segment=%d offset=%d", meta.SegmentID, meta.Offset)
+	if !strings.Contains(logs.String(), want) {
+		t.Errorf("Corruption log does not contain %q:\n%s", want, logs.String())
+	}
+	if resp := doRequest(t, http.MethodGet, srv.URL+"/db/a", ""); resp.StatusCode != http.StatusOK {
+		t.Errorf("GET of an intact value returned %d", resp.StatusCode)
+	}
+}
+
+func TestDbHandler_LastModified(t *testing.T) {
+	srv := startTestServer(t)
+	url := srv.URL + "/db/k"
+
+	get := func() (time.Time, time.Time) {
+		t.Helper()
+		resp, err := http.Get(url)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		header, err := http.ParseTime(resp.Header.Get("Last-Modified"))
+		if err != nil {
+			t.Fatalf("Last-Modified %q: %v", resp.Header.Get("Last-Modified"), err)
+		}
+		var body struct {
+			Modified time.Time `json:"modified"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&body); err != nil || body.Modified.IsZero() {
+			t.Fatalf("GET body without a modified time: %v", err)
+		}
+		if !header.Equal(body.Modified.Truncate(time.Second)) {
+			t.Errorf("Last-Modified %v does not match the modified field %v", header, body.Modified)
+		}
+		return header, body.Modified
+	}
+
+	var lastHeader, lastModified time.Time
+	for i := 0; i < 3; i++ {
+		if resp := doRequest(t, http.MethodPost, url, fmt.Sprintf(`{"value":"v%d"}`, i)); resp.StatusCode != http.StatusCreated {
+			t.Fatalf("POST returned %d", resp.StatusCode)
+		}
+		header, modified := get()
+		if header.Before(lastHeader) || !modified.After(lastModified) {
+			t.Errorf("Put %d went back in time: %v after %v", i, modified, lastModified)
+		}
+		lastHeader, lastModified = header, modified
+	}
+}
+
+func TestSubscribeHandler(t *testing.T) {
+	srv := startTestServer(t)
+
+	resp, err := http.Get(srv.URL + "/subscribe")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	if ct := resp.Header.Get("Content-Type"); ct != "text/event-stream" {
+		t.Errorf("Content-Type = %q", ct)
+	}
+
+	if resp := doRequest(t, http.MethodPost, srv.URL+"/db/k", `{"value":"v"}`); resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST returned %d", resp.StatusCode)
+	}
+	line, err := bufio.NewReader(resp.Body).ReadString('\n')
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `data: {"key":"k","type":"put"}` + "\n"; line != want {
+		t.Errorf("event %q, want %q", line, want)
+	}
+}
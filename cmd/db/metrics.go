@@ -0,0 +1,83 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sync/atomic"
+
+	"github.com/roman-mazur/architecture-practice-4-template/httptools"
+)
+
+// valueSizeBuckets are the upper bounds, in bytes, of the value size
+// histogram.
+var valueSizeBuckets = []int{64, 256, 1024, 4096, 16384, 65536, 262144, 1048576}
+
+// metrics collects datastore operations and serves them in the Prometheus
+// text exposition format.
+type metrics struct {
+	puts, gets, getMisses, corruptions, compactions atomic.Int64
+
+	sizeBuckets []atomic.Int64 // one per bucket, not cumulative
+	sizeCount   atomic.Int64
+	sizeSum     atomic.Int64
+
+	// http, when set, adds the metrics of the HTTP requests to the output.
+	http *httptools.HTTPMetrics
+}
+
+func newMetrics() *metrics {
+	return &metrics{sizeBuckets: make([]atomic.Int64, len(valueSizeBuckets))}
+}
+
+func (m *metrics) IncPuts()        { m.puts.Add(1) }
+func (m *metrics) IncGets()        { m.gets.Add(1) }
+func (m *metrics) IncGetMisses()   { m.getMisses.Add(1) }
+func (m *metrics) IncCorruptions() { m.corruptions.Add(1) }
+func (m *metrics) IncCompactions() { m.compactions.Add(1) }
+
+func (m *metrics) ObserveValueSize(size int) {
+	for i, bound := range valueSizeBuckets {
+		if size <= bound {
+			m.sizeBuckets[i].Add(1)
+			break
+		}
+	}
+	m.sizeCount.Add(1)
+	m.sizeSum.Add(int64(size))
+}
+
+func (m *metrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		writeJSONError(w, http.StatusMethodNotAllowed, codeMethodNotAllowed, "method not allowed")
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+
+	counters := []struct {
+		name  string
+		value int64
+	}{
+		{"db_puts_total", m.puts.Load()},
+		{"db_gets_total", m.gets.Load()},
+		{"db_get_misses_total", m.getMisses.Load()},
+		{"db_corruptions_total", m.corruptions.Load()},
+		{"db_compactions_total", m.compactions.Load()},
+	}
+	for _, c := range counters {
+		fmt.Fprintf(w, "# TYPE %s counter\n%s %d\n", c.name, c.name, c.value)
+	}
+
+	fmt.Fprintln(w, "# TYPE db_value_size_bytes histogram")
+	cumulative := int64(0)
+	for i, bound := range valueSizeBuckets {
+		cumulative += m.sizeBuckets[i].Load()
+		fmt.Fprintf(w, "db_value_size_bytes_bucket{le=\"%d\"} %d\n", bound, cumulative)
+	}
+	count := m.sizeCount.Load()
+	fmt.Fprintf(w, "db_value_size_bytes_bucket{le=\"+Inf\"} %d\n", count)
+	fmt.Fprintf(w, "db_value_size_bytes_sum %d\n", m.sizeSum.Load())
+	fmt.Fprintf(w, "db_value_size_bytes_count %d\n", count)
+	if m.http != nil {
+		m.http.WriteText(w)
+	}
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+
+	"google.golang.org/grpc"
+
+	"github.com/roman-mazur/architecture-practice-4-template/cmd/grpc/storepb"
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+	"github.com/roman-mazur/architecture-practice-4-template/env"
+	"github.com/roman-mazur/architecture-practice-4-template/httptools"
+	"github.com/roman-mazur/architecture-practice-4-template/signal"
+)
+
+var (
+	port = flag.Int("port", env.Int("GRPC_PORT", 8078), "gRPC server port (env GRPC_PORT)")
+	dir  = flag.String("dir", env.String("DB_DIR", filepath.Join(os.TempDir(), "db-data")), "storage directory (env DB_DIR)")
+
+	logFormat = flag.String("log-format", httptools.LogFormatText, "log format: text or json")
+	logLevel  = flag.String("log-level", "info", "lowest logged level: debug, info, warn or error")
+)
+
+func main() {
+	flag.Parse()
+
+	logger, err := httptools.NewLogger(os.Stderr, *logLevel, *logFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	ctx, stop := signal.NotifyContext()
+	defer stop()
+
+	if err := os.MkdirAll(*dir, 0o755); err != nil {
+		logger.Error("failed to create the storage dir", "dir", *dir, "err", err)
+		os.Exit(1)
+	}
+	db, err := datastore.Open(*dir, datastore.WithLogger(logger))
+	if err != nil {
+		logger.Error("failed to open db", "dir", *dir, "err", err)
+		os.Exit(1)
+	}
+
+	addr := fmt.Sprintf(":%d", *port)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		logger.Error("failed to start the gRPC server", "addr", addr, "err", err)
+		_ = db.Close()
+		os.Exit(1)
+	}
+	server := newServer(db)
+	go func() {
+		logger.Info("gRPC server listening", "addr", addr, "dir", *dir)
+		if err := server.Serve(ln); err != nil {
+			logger.Error("gRPC server finished", "err", err)
+			os.Exit(1)
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	logger.Info("shutting down")
+	// Closing the store after the in-flight calls keeps acknowledged writes.
+	server.GracefulStop()
+	if err := db.Close(); err != nil {
+		logger.Error("failed to close db", "err", err)
+	}
+}
+
+func newServer(db *datastore.Db) *grpc.Server {
+	server := grpc.NewServer()
+	storepb.RegisterStoreServer(server, &storeServer{db: db})
+	return server
+}
@@ -0,0 +1,98 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"strings"
+
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/status"
+
+	"github.com/roman-mazur/architecture-practice-4-template/cmd/grpc/storepb"
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+// storeServer implements the Store service on top of a datastore.Db.
+type storeServer struct {
+	storepb.UnimplementedStoreServer
+	db *datastore.Db
+}
+
+func (s *storeServer) Get(ctx context.Context, req *storepb.GetRequest) (*storepb.GetResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, toStatus(err)
+	}
+	value, err := s.db.GetBytes(req.GetKey())
+	if err != nil {
+		return nil, toStatus(err)
+	}
+	return &storepb.GetResponse{Value: value}, nil
+}
+
+func (s *storeServer) Put(ctx context.Context, req *storepb.PutRequest) (*storepb.PutResponse, error) {
+	if err := s.db.PutContext(ctx, req.GetKey(), string(req.GetValue())); err != nil {
+		return nil, toStatus(err)
+	}
+	return &storepb.PutResponse{}, nil
+}
+
+func (s *storeServer) Delete(ctx context.Context, req *storepb.DeleteRequest) (*storepb.DeleteResponse, error) {
+	if err := ctx.Err(); err != nil {
+		return nil, toStatus(err)
+	}
+	if err := s.db.Delete(req.GetKey()); err != nil {
+		return nil, toStatus(err)
+	}
+	return &storepb.DeleteResponse{}, nil
+}
+
+// Scan reads the values one at a time as they are sent, so a large scan
+// does not hold all of them in memory. Keys deleted while the scan runs are
+// skipped.
+func (s *storeServer) Scan(req *storepb.ScanRequest, stream storepb.Store_ScanServer) error {
+	prefix := req.GetPrefix()
+	it := s.db.NewIterator(datastore.IteratorOptions{Start: prefix})
+	defer it.Close()
+	for it.Next() {
+		key := it.Key()
+		if !strings.HasPrefix(key, prefix) {
+			break
+		}
+		if err := stream.Context().Err(); err != nil {
+			return toStatus(err)
+		}
+		value, err := it.Value()
+		if errors.Is(err, datastore.ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return toStatus(err)
+		}
+		if err := stream.Send(&storepb.KeyValue{Key: key, Value: []byte(value)}); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// toStatus maps datastore errors to gRPC status codes.
+func toStatus(err error) error {
+	var code codes.Code
+	switch {
+	case errors.Is(err, datastore.ErrNotFound), errors.Is(err, datastore.ErrSegmentMissing):
+		code = codes.NotFound
+	case errors.Is(err, datastore.ErrCorrupted):
+		code = codes.DataLoss
+	case errors.Is(err, datastore.ErrEmptyKey), errors.Is(err, datastore.ErrValueTooLarge):
+		code = codes.InvalidArgument
+	case errors.Is(err, datastore.ErrReadOnly):
+		code = codes.FailedPrecondition
+	case errors.Is(err, datastore.ErrClosed):
+		code = codes.Unavailable
+	case errors.Is(err, context.Canceled), errors.Is(err, context.DeadlineExceeded):
+		return status.FromContextError(err).Err()
+	default:
+		code = codes.Internal
+	}
+	return status.Error(code, err.Error())
+}
@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strconv"
+	"testing"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/grpc/status"
+	"google.golang.org/grpc/test/bufconn"
+
+	"github.com/roman-mazur/architecture-practice-4-template/cmd/grpc/storepb"
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+func startTestServer(t *testing.T, db *datastore.Db) storepb.StoreClient {
+	t.Helper()
+	ln := bufconn.Listen(1 << 20)
+	server := newServer(db)
+	go func() { _ = server.Serve(ln) }()
+	t.Cleanup(server.Stop)
+
+	conn, err := grpc.NewClient("passthrough:///bufconn",
+		grpc.WithContextDialer(func(ctx context.Context, _ string) (net.Conn, error) {
+			return ln.DialContext(ctx)
+		}),
+		grpc.WithTransportCredentials(insecure.NewCredentials()),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { _ = conn.Close() })
+	return storepb.NewStoreClient(conn)
+}
+
+func TestStoreServer(t *testing.T) {
+	db, err := datastore.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	client := startTestServer(t, db)
+	ctx := context.Background()
+
+	for _, kv := range [][2]string{{"user:2", "bob"}, {"user:1", "alice"}, {"other", "x"}} {
+		if _, err := client.Put(ctx, &storepb.PutRequest{Key: kv[0], Value: []byte(kv[1])}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	resp, err := client.Get(ctx, &storepb.GetRequest{Key: "user:1"})
+	if err != nil || string(resp.GetValue()) != "alice" {
+		t.Errorf("Get(user:1) = %q, %v", resp.GetValue(), err)
+	}
+
+	stream, err := client.Scan(ctx, &storepb.ScanRequest{Prefix: "user:"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []string
+	for {
+		kv, err := stream.Recv()
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		got = append(got, kv.GetKey()+"="+string(kv.GetValue()))
+	}
+	if len(got) != 2 || got[0] != "user:1=alice" || got[1] != "user:2=bob" {
+		t.Errorf("Scan(user:) = %q", got)
+	}
+
+	if _, err := client.Delete(ctx, &storepb.DeleteRequest{Key: "user:1"}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := client.Get(ctx, &storepb.GetRequest{Key: "user:1"}); status.Code(err) != codes.NotFound {
+		t.Errorf("Get() of a deleted key: %v, want NotFound", err)
+	}
+	if _, err := client.Delete(ctx, &storepb.DeleteRequest{Key: "user:1"}); status.Code(err) != codes.NotFound {
+		t.Errorf("Delete() of a deleted key: %v, want NotFound", err)
+	}
+	if _, err := client.Put(ctx, &storepb.PutRequest{Key: ""}); status.Code(err) != codes.InvalidArgument {
+		t.Errorf("Put() of an empty key: %v, want InvalidArgument", err)
+	}
+}
+
+func TestStoreServer_CorruptedValue(t *testing.T) {
+	dir := t.TempDir()
+	db, err := datastore.Open(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	client := startTestServer(t, db)
+
+	if err := db.Put("k", "value"); err != nil {
+		t.Fatal(err)
+	}
+	_, meta, err := db.GetWithMetadata("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "segment-"+strconv.Itoa(meta.SegmentID))
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[meta.Offset+int64(meta.Size)-int64(len(meta.Checksum))-1] ^= 0xFF
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := client.Get(context.Background(), &storepb.GetRequest{Key: "k"}); status.Code(err) != codes.DataLoss {
+		t.Errorf("Get() of a corrupted value: %v, want DataLoss", err)
+	}
+}
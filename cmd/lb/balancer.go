@@ -20,6 +20,11 @@ var (
 	timeoutSec   = flag.Int("timeout-sec", 3, "request timeout time in seconds")
 	https        = flag.Bool("https", false, "whether backends support HTTPs")
 	traceEnabled = flag.Bool("trace", false, "whether to include tracing information into responses")
+	readTimeout  = flag.Duration("read-timeout", 10*time.Second, "max time to read a request, 0 for no limit")
+	writeTimeout = flag.Duration("write-timeout", 10*time.Second, "max time to write a response, 0 for no limit")
+	idleTimeout  = flag.Duration("idle-timeout", 0, "max time a keep-alive connection waits for a request, 0 for the read timeout")
+	tlsCert      = flag.String("tls-cert", "", "certificate file to serve HTTPS with, together with -tls-key")
+	tlsKey       = flag.String("tls-key", "", "key file of -tls-cert")
 )
 
 var (
@@ -151,7 +156,11 @@ func main() {
 
 	updateHealthLoop()
 
-	frontend := httptools.CreateServer(*port, http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+	tlsConf, err := httptools.LoadTLSConfig(*tlsCert, *tlsKey)
+	if err != nil {
+		log.Fatalf("Failed to load the TLS certificate: %s", err)
+	}
+	handler := http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
 		remoteAddr := r.Header.Get("X-Test-Client")
 		if remoteAddr == "" {
 			remoteAddr = r.RemoteAddr
@@ -163,10 +172,18 @@ func main() {
 			return
 		}
 		forward(dst, rw, r)
-	}))
+	})
+	frontend := httptools.CreateServer(*port, handler,
+		httptools.WithReadTimeout(*readTimeout),
+		httptools.WithWriteTimeout(*writeTimeout),
+		httptools.WithIdleTimeout(*idleTimeout),
+		httptools.WithTLSConfig(tlsConf),
+	)
 
 	log.Println("Starting load balancer...")
 	log.Printf("Tracing support enabled: %t", *traceEnabled)
-	frontend.Start()
+	if err := frontend.Start(); err != nil {
+		log.Fatalf("Failed to start the load balancer: %s", err)
+	}
 	signal.WaitForTerminationSignal()
 }
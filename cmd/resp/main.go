@@ -0,0 +1,107 @@
+package main
+
+import (
+	"errors"
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+	"github.com/roman-mazur/architecture-practice-4-template/env"
+	"github.com/roman-mazur/architecture-practice-4-template/httptools"
+	"github.com/roman-mazur/architecture-practice-4-template/signal"
+)
+
+var (
+	port = flag.Int("port", env.Int("RESP_PORT", 6379), "RESP server port (env RESP_PORT)")
+	dir  = flag.String("dir", env.String("DB_DIR", filepath.Join(os.TempDir(), "db-data")), "storage directory (env DB_DIR)")
+
+	logFormat = flag.String("log-format", httptools.LogFormatText, "log format: text or json")
+	logLevel  = flag.String("log-level", "info", "lowest logged level: debug, info, warn or error")
+)
+
+func main() {
+	flag.Parse()
+
+	logger, err := httptools.NewLogger(os.Stderr, *logLevel, *logFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	ctx, stop := signal.NotifyContext()
+	defer stop()
+
+	if err := os.MkdirAll(*dir, 0o755); err != nil {
+		logger.Error("failed to create the storage dir", "dir", *dir, "err", err)
+		os.Exit(1)
+	}
+	db, err := datastore.Open(*dir, datastore.WithLogger(logger))
+	if err != nil {
+		logger.Error("failed to open db", "dir", *dir, "err", err)
+		os.Exit(1)
+	}
+
+	addr := fmt.Sprintf(":%d", *port)
+	ln, err := net.Listen("tcp", addr)
+	if err != nil {
+		logger.Error("failed to start the RESP server", "addr", addr, "err", err)
+		_ = db.Close()
+		os.Exit(1)
+	}
+	logger.Info("RESP server listening", "addr", addr, "dir", *dir)
+
+	var (
+		mu      sync.Mutex
+		conns   = make(map[net.Conn]struct{})
+		closing bool
+		wg      sync.WaitGroup
+	)
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			if err != nil {
+				logger.Warn("accept failed", "err", err)
+				continue
+			}
+			mu.Lock()
+			if closing {
+				mu.Unlock()
+				_ = conn.Close()
+				return
+			}
+			conns[conn] = struct{}{}
+			wg.Add(1)
+			mu.Unlock()
+			go func() {
+				defer wg.Done()
+				serveConn(db, conn, logger)
+				mu.Lock()
+				delete(conns, conn)
+				mu.Unlock()
+			}()
+		}
+	}()
+
+	<-ctx.Done()
+	stop()
+	logger.Info("shutting down")
+	_ = ln.Close()
+	// Closing the connections interrupts their reads; a command already
+	// read still completes before its goroutine sees the error.
+	mu.Lock()
+	closing = true
+	for conn := range conns {
+		_ = conn.Close()
+	}
+	mu.Unlock()
+	wg.Wait()
+	if err := db.Close(); err != nil {
+		logger.Error("failed to close db", "err", err)
+	}
+}
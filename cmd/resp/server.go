@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"io"
+	"log/slog"
+	"net"
+	"strings"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+// serveConn answers the commands read from conn until the client quits or
+// disconnects. Replies of pipelined commands are flushed together once no
+// more input is buffered.
+func serveConn(db *datastore.Db, conn net.Conn, logger *slog.Logger) {
+	defer conn.Close()
+	r := bufio.NewReader(conn)
+	w := bufio.NewWriter(conn)
+	for {
+		args, err := readCommand(r)
+		if errors.Is(err, errProtocol) {
+			writeError(w, "ERR "+err.Error())
+			_ = w.Flush()
+			return
+		}
+		if err != nil {
+			if !errors.Is(err, io.EOF) && !errors.Is(err, net.ErrClosed) {
+				logger.Debug("RESP connection failed", "remote", conn.RemoteAddr(), "err", err)
+			}
+			return
+		}
+		if len(args) == 0 {
+			continue
+		}
+		quit := execute(db, args, w)
+		if r.Buffered() == 0 || quit {
+			if err := w.Flush(); err != nil {
+				return
+			}
+		}
+		if quit {
+			return
+		}
+	}
+}
+
+// execute runs one command and writes its reply. It reports whether the
+// client asked to close the connection.
+func execute(db *datastore.Db, args []string, w *bufio.Writer) bool {
+	name := strings.ToLower(args[0])
+	args = args[1:]
+	arity := func(ok bool) bool {
+		if !ok {
+			writeError(w, "ERR wrong number of arguments for '"+name+"' command")
+		}
+		return ok
+	}
+
+	switch name {
+	case "ping":
+		if !arity(len(args) <= 1) {
+			break
+		}
+		if len(args) == 1 {
+			writeBulk(w, []byte(args[0]))
+		} else {
+			writeSimple(w, "PONG")
+		}
+	case "quit":
+		writeSimple(w, "OK")
+		return true
+	case "get":
+		if !arity(len(args) == 1) {
+			break
+		}
+		value, err := db.GetBytes(args[0])
+		if errors.Is(err, datastore.ErrNotFound) {
+			writeNull(w)
+			break
+		}
+		if err != nil {
+			writeStoreError(w, err)
+			break
+		}
+		writeBulk(w, value)
+	case "set":
+		if !arity(len(args) == 2) {
+			break
+		}
+		if err := db.Put(args[0], args[1]); err != nil {
+			writeStoreError(w, err)
+			break
+		}
+		writeSimple(w, "OK")
+	case "del":
+		if !arity(len(args) >= 1) {
+			break
+		}
+		n := 0
+		for _, key := range args {
+			err := db.Delete(key)
+			if errors.Is(err, datastore.ErrNotFound) {
+				continue
+			}
+			if err != nil {
+				writeStoreError(w, err)
+				return false
+			}
+			n++
+		}
+		writeInt(w, n)
+	case "exists":
+		if !arity(len(args) >= 1) {
+			break
+		}
+		// Like Redis, a key given twice is counted twice.
+		n := 0
+		for _, key := range args {
+			ok, _, err := db.Exists(key)
+			if err != nil {
+				writeStoreError(w, err)
+				return false
+			}
+			if ok {
+				n++
+			}
+		}
+		writeInt(w, n)
+	default:
+		writeError(w, "ERR unknown command '"+truncate(name)+"'")
+	}
+	return false
+}
+
+// truncate shortens a client supplied name for an error reply.
+func truncate(name string) string {
+	if len(name) > 64 {
+		return name[:64] + "..."
+	}
+	return name
+}
+
+func writeStoreError(w *bufio.Writer, err error) {
+	switch {
+	case errors.Is(err, datastore.ErrCorrupted):
+		writeError(w, "ERR stored value is corrupted")
+	case errors.Is(err, datastore.ErrEmptyKey):
+		writeError(w, "ERR key is empty")
+	case errors.Is(err, datastore.ErrValueTooLarge):
+		writeError(w, "ERR value is too large")
+	case errors.Is(err, datastore.ErrReadOnly):
+		writeError(w, "READONLY the store is read-only")
+	default:
+		writeError(w, "ERR "+err.Error())
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bufio"
+	"io"
+	"log/slog"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/datastore"
+)
+
+func TestServeConn(t *testing.T) {
+	db, err := datastore.Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	client, server := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		serveConn(db, server, slog.New(slog.NewTextHandler(io.Discard, nil)))
+	}()
+	defer client.Close()
+	_ = client.SetDeadline(time.Now().Add(5 * time.Second))
+	replies := bufio.NewReader(client)
+
+	for _, tc := range []struct {
+		name    string
+		command string
+		reply   string
+	}{
+		{"ping", "*1\r\n$4\r\nPING\r\n", "+PONG\r\n"},
+		{"get missing", "*2\r\n$3\r\nGET\r\n$1\r\nk\r\n", "$-1\r\n"},
+		{"set", "*3\r\n$3\r\nSET\r\n$1\r\nk\r\n$5\r\nhello\r\n", "+OK\r\n"},
+		{"get", "*2\r\n$3\r\nget\r\n$1\r\nk\r\n", "$5\r\nhello\r\n"},
+		{"binary value", "*3\r\n$3\r\nSET\r\n$1\r\nb\r\n$4\r\na\r\nb\r\n", "+OK\r\n"},
+		{"get binary", "*2\r\n$3\r\nGET\r\n$1\r\nb\r\n", "$4\r\na\r\nb\r\n"},
+		{"exists", "*4\r\n$6\r\nEXISTS\r\n$1\r\nk\r\n$1\r\nx\r\n$1\r\nk\r\n", ":2\r\n"},
+		{"del", "*3\r\n$3\r\nDEL\r\n$1\r\nk\r\n$1\r\nx\r\n", ":1\r\n"},
+		{"exists deleted", "*2\r\n$6\r\nEXISTS\r\n$1\r\nk\r\n", ":0\r\n"},
+		{"inline", "GET b\r\n", "$4\r\na\r\nb\r\n"},
+		{"arity", "*1\r\n$3\r\nGET\r\n", "-ERR wrong number of arguments for 'get' command\r\n"},
+		{"unknown", "*1\r\n$5\r\nFLUSH\r\n", "-ERR unknown command 'flush'\r\n"},
+		{"empty key", "*3\r\n$3\r\nSET\r\n$0\r\n\r\n$1\r\nv\r\n", "-ERR key is empty\r\n"},
+	} {
+		if _, err := io.WriteString(client, tc.command); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		got := make([]byte, len(tc.reply))
+		if _, err := io.ReadFull(replies, got); err != nil {
+			t.Fatalf("%s: reading the reply: %v", tc.name, err)
+		}
+		if string(got) != tc.reply {
+			t.Errorf("%s: reply %q, want %q", tc.name, got, tc.reply)
+		}
+	}
+
+	// Bad framing ends the connection after an error reply.
+	if _, err := io.WriteString(client, "*1\r\n+PING\r\n"); err != nil {
+		t.Fatal(err)
+	}
+	line, err := replies.ReadString('\n')
+	if err != nil || line[0] != '-' {
+		t.Errorf("reply to bad framing: %q, %v", line, err)
+	}
+	<-done
+}
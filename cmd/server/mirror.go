@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sync"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/dbclient"
+)
+
+// mirror copies writes to a secondary db in the background. A write that
+// still fails after the client retries is logged and dropped, so the
+// secondary may lag behind or miss values; it is a best-effort copy.
+type mirror struct {
+	client  *dbclient.Client
+	timeout time.Duration
+	queue   chan mirrorWrite
+	wg      sync.WaitGroup
+
+	mu     sync.Mutex // guards closed and sends on queue
+	closed bool
+}
+
+type mirrorWrite struct {
+	key, value string
+}
+
+const mirrorTimeout = 10 * time.Second
+
+// newMirror starts a mirror holding up to queueSize pending writes. client
+// should be created WithRetry to retry failed writes.
+func newMirror(client *dbclient.Client, queueSize int) *mirror {
+	m := &mirror{
+		client:  client,
+		timeout: mirrorTimeout,
+		queue:   make(chan mirrorWrite, queueSize),
+	}
+	m.wg.Add(1)
+	go m.run()
+	return m
+}
+
+func (m *mirror) run() {
+	defer m.wg.Done()
+	for w := range m.queue {
+		ctx, cancel := context.WithTimeout(context.Background(), m.timeout)
+		if err := m.client.Put(ctx, w.key, w.value); err != nil {
+			slog.Warn("mirror write failed", "key", w.key, "err", err)
+		}
+		cancel()
+	}
+}
+
+// put queues a write without blocking, dropping it when the queue is full
+// or the mirror is closed.
+func (m *mirror) put(key, value string) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if m.closed {
+		slog.Warn("mirror is closed, dropping write", "key", key)
+		return
+	}
+	select {
+	case m.queue <- mirrorWrite{key: key, value: value}:
+	default:
+		slog.Warn("mirror queue is full, dropping write", "key", key)
+	}
+}
+
+// close waits for the queued writes to be sent.
+func (m *mirror) close() {
+	m.mu.Lock()
+	if !m.closed {
+		m.closed = true
+		close(m.queue)
+	}
+	m.mu.Unlock()
+	m.wg.Wait()
+}
@@ -2,31 +2,129 @@ package main
 
 import (
 	"encoding/json"
-	"log"
+	"log/slog"
 	"net/http"
+	"sort"
+	"sync"
 )
 
-const reportMaxLen = 100
+const (
+	reportMaxLen        = 100
+	defaultReportLimit  = 1000
+	reportMaxAuthorSize = 256
+)
+
+// Report keeps the last reportMaxLen request counters of every author seen
+// in the lb-author header, along with the number of requests of each. It is
+// safe for concurrent use.
+type Report struct {
+	mu      sync.Mutex
+	authors map[string][]string
+	counts  map[string]int
+	// maxAuthors caps the number of distinct authors; requests of new
+	// authors beyond it are only counted in dropped.
+	maxAuthors int
+	dropped    int
+}
 
-type Report map[string][]string
+// NewReport returns a report tracking at most maxAuthors authors, or
+// defaultReportLimit if maxAuthors is not positive.
+func NewReport(maxAuthors int) *Report {
+	if maxAuthors <= 0 {
+		maxAuthors = defaultReportLimit
+	}
+	return &Report{authors: make(map[string][]string), counts: make(map[string]int), maxAuthors: maxAuthors}
+}
 
-func (r Report) Process(req *http.Request) {
+type reportAuthor struct {
+	Author   string   `json:"author"`
+	Count    int      `json:"count"`
+	Requests []string `json:"requests"`
+}
+
+type reportResponse struct {
+	Authors []reportAuthor `json:"authors"`
+	// DroppedRequests counts requests of authors over the limit.
+	DroppedRequests int `json:"dropped_requests,omitempty"`
+}
+
+// Process records the counter of req in constant time.
+func (r *Report) Process(req *http.Request) {
 	author := req.Header.Get("lb-author")
 	counter := req.Header.Get("lb-req-cnt")
-	log.Printf("GET some-data from [%s] request [%s]", author, counter)
+	slog.Debug("some-data request", "author", author, "counter", counter)
+	if len(author) == 0 {
+		return
+	}
+	if len(author) > reportMaxAuthorSize {
+		author = author[:reportMaxAuthorSize]
+	}
 
-	if len(author) > 0 {
-		list := r[author]
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	list, ok := r.authors[author]
+	if !ok && len(r.authors) >= r.maxAuthors {
+		r.dropped++
+		return
+	}
+	if len(list) == reportMaxLen {
+		// Shift within the backing array instead of reslicing, which would
+		// make append reallocate as the list slides forward.
+		copy(list, list[1:])
+		list[len(list)-1] = counter
+	} else {
 		list = append(list, counter)
-		if len(list) > reportMaxLen {
-			list = list[len(list)-reportMaxLen:]
-		}
-		r[author] = list
 	}
+	r.authors[author] = list
+	r.counts[author]++
+}
+
+// Reset forgets every author and their requests.
+func (r *Report) Reset() {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	clear(r.authors)
+	clear(r.counts)
+	r.dropped = 0
+}
+
+func (r *Report) snapshot() reportResponse {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	resp := reportResponse{
+		Authors:         make([]reportAuthor, 0, len(r.authors)),
+		DroppedRequests: r.dropped,
+	}
+	for author, requests := range r.authors {
+		resp.Authors = append(resp.Authors, reportAuthor{
+			Author:   author,
+			Count:    r.counts[author],
+			Requests: append([]string(nil), requests...),
+		})
+	}
+	return resp
 }
 
-func (r Report) ServeHTTP(rw http.ResponseWriter, _ *http.Request) {
+// ServeHTTP returns the last reportMaxLen request counters of every author,
+// sorted by author name. DELETE clears the report.
+func (r *Report) ServeHTTP(rw http.ResponseWriter, req *http.Request) {
+	switch req.Method {
+	case http.MethodGet:
+	case http.MethodDelete:
+		r.Reset()
+		rw.WriteHeader(http.StatusNoContent)
+		return
+	default:
+		http.Error(rw, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+
+	resp := r.snapshot()
+	sort.Slice(resp.Authors, func(i, j int) bool {
+		return resp.Authors[i].Author < resp.Authors[j].Author
+	})
+
 	rw.Header().Set("content-type", "application/json")
 	rw.WriteHeader(http.StatusOK)
-	_ = json.NewEncoder(rw).Encode(r)
+	_ = json.NewEncoder(rw).Encode(resp)
 }
@@ -1,8 +1,11 @@
 package main
 
 import (
+	"encoding/json"
+	"net/http"
 	"net/http/httptest"
 	"reflect"
+	"strconv"
 	"testing"
 )
 
@@ -11,25 +14,86 @@ func TestReport_Process(t *testing.T) {
 	req.Header.Set("lb-author", "test-author")
 	req.Header.Set("lb-req-cnt", "1")
 
-	r := make(Report)
+	r := NewReport(0)
 
 	r.Process(req)
-	if !reflect.DeepEqual(r["test-author"], []string{"1"}) {
-		t.Errorf("Unexpected report state %s", r)
+	if !reflect.DeepEqual(r.authors["test-author"], []string{"1"}) {
+		t.Errorf("Unexpected report state %v", r.authors)
 	}
 
 	req.Header.Set("lb-req-cnt", "2")
 	r.Process(req)
-	if !reflect.DeepEqual(r["test-author"], []string{"1", "2"}) {
-		t.Errorf("Unexpected report state %s", r)
+	if !reflect.DeepEqual(r.authors["test-author"], []string{"1", "2"}) {
+		t.Errorf("Unexpected report state %v", r.authors)
 	}
 
 	req.Header.Set("lb-author", "test-len")
 	for i := 0; i < 103; i++ {
-		req.Header.Set("lb-req-cnt", "test-len")
+		req.Header.Set("lb-req-cnt", strconv.Itoa(i))
 		r.Process(req)
 	}
-	if len(r["test-len"]) != reportMaxLen {
-		t.Errorf("Unexpectd error length: %d", len(r["test-len"]))
+	if got := r.authors["test-len"]; len(got) != reportMaxLen || got[0] != "3" || got[reportMaxLen-1] != "102" {
+		t.Errorf("Unexpected counters %v", got)
+	}
+	for _, a := range r.snapshot().Authors {
+		if a.Author == "test-len" && a.Count != 103 {
+			t.Errorf("Count of %s = %d, want 103", a.Author, a.Count)
+		}
+	}
+
+	r.Reset()
+	r.Process(req)
+	if resp := r.snapshot(); len(resp.Authors) != 1 || resp.Authors[0].Count != 1 {
+		t.Errorf("Unexpected report after Reset %+v", resp.Authors)
+	}
+}
+
+func TestReport_ServeHTTP(t *testing.T) {
+	r := NewReport(0)
+	for i, author := range []string{"b", "a", "b"} {
+		req := httptest.NewRequest("GET", "/api/v1/some-data", nil)
+		req.Header.Set("lb-author", author)
+		req.Header.Set("lb-req-cnt", strconv.Itoa(i))
+		r.Process(req)
+	}
+
+	rec := httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("GET", "/report", nil))
+	if ct := rec.Header().Get("content-type"); ct != "application/json" {
+		t.Errorf("Unexpected content type %s", ct)
+	}
+	var resp reportResponse
+	if err := json.NewDecoder(rec.Body).Decode(&resp); err != nil {
+		t.Fatal(err)
+	}
+	expected := []reportAuthor{
+		{Author: "a", Count: 1, Requests: []string{"1"}},
+		{Author: "b", Count: 2, Requests: []string{"0", "2"}},
+	}
+	if !reflect.DeepEqual(resp.Authors, expected) {
+		t.Errorf("Unexpected report %+v", resp.Authors)
+	}
+
+	rec = httptest.NewRecorder()
+	r.ServeHTTP(rec, httptest.NewRequest("DELETE", "/report", nil))
+	if rec.Code != http.StatusNoContent || len(r.authors) != 0 {
+		t.Errorf("DELETE returned %d, report %v", rec.Code, r)
+	}
+}
+
+func TestReport_MaxAuthors(t *testing.T) {
+	r := NewReport(2)
+	for _, author := range []string{"a", "b", "c", "a", "d"} {
+		req := httptest.NewRequest("GET", "/api/v1/some-data", nil)
+		req.Header.Set("lb-author", author)
+		req.Header.Set("lb-req-cnt", "1")
+		r.Process(req)
+	}
+	resp := r.snapshot()
+	if len(resp.Authors) != 2 || resp.DroppedRequests != 2 {
+		t.Errorf("Unexpected report %+v", resp)
+	}
+	if got := r.authors["a"]; len(got) != 2 {
+		t.Errorf("Known author lost requests over the limit: %v", got)
 	}
 }
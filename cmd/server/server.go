@@ -1,29 +1,154 @@
 package main
 
 import (
-	"bytes"
+	"context"
 	"encoding/json"
+	"errors"
 	"flag"
 	"fmt"
+	"log/slog"
 	"net/http"
 	"os"
 	"strconv"
 	"time"
 
+	"github.com/roman-mazur/architecture-practice-4-template/cache"
+	"github.com/roman-mazur/architecture-practice-4-template/dbclient"
+	"github.com/roman-mazur/architecture-practice-4-template/env"
 	"github.com/roman-mazur/architecture-practice-4-template/httptools"
 	"github.com/roman-mazur/architecture-practice-4-template/signal"
 )
 
-var port = flag.Int("port", 8080, "server port")
+var dbURLs listFlag
+
+func init() {
+	flag.Var(&dbURLs, "db", "db backend URL, repeat to shard keys over several backends (default "+dbServiceURL+")")
+}
+
+var (
+	port         = flag.Int("port", 8080, "server port")
+	dbRetries    = flag.Int("db-retries", 5, "max attempts for a db request")
+	dbRetryDelay = flag.Duration("db-retry-delay", 200*time.Millisecond, "delay before the first db retry, doubled after each attempt")
+	healthDb     = flag.Bool("health-check-db", false, "whether /health also verifies that the db is reachable")
+	cacheSize    = flag.Int("cache-size", 1000, "max number of cached db values, 0 disables the cache")
+	reportLimit  = flag.Int("report-max-authors", defaultReportLimit, "max number of distinct lb-author values kept in /report")
+	mirrorURL    = flag.String("db-mirror", "", "secondary db backend receiving a copy of every write in the background; empty disables mirroring")
+	mirrorQueue  = flag.Int("db-mirror-queue", 1000, "max number of writes waiting to be mirrored")
+	cacheTTL     = flag.Duration("cache-ttl", 30*time.Second, "how long a cached db value stays fresh")
+	dbTimeout    = flag.Duration("db-timeout", env.Duration(confDbTimeout, 2*time.Second), "timeout of a single db request (env "+confDbTimeout+")")
+	logRequests  = flag.Bool("log-requests", false, "log every handled request")
+	httpMetrics  = flag.Bool("http-metrics", false, "serve request counts by method and status class and latency percentiles at /metrics")
+	logFormat    = flag.String("log-format", httptools.LogFormatText, "log format: text or json")
+	logLevel     = flag.String("log-level", "info", "lowest logged level: debug, info, warn or error")
+	corsOrigins  = flag.String("cors-origins", "", "comma separated origins allowed to call the server from a browser, * for any; empty disables CORS")
+	corsMethods  = flag.String("cors-methods", "", "comma separated methods allowed for cross-origin requests")
+	corsHeaders  = flag.String("cors-headers", "", "comma separated request headers allowed for cross-origin requests")
+	readTimeout  = flag.Duration("read-timeout", 10*time.Second, "max time to read a request, 0 for no limit")
+	writeTimeout = flag.Duration("write-timeout", 10*time.Second, "max time to write a response, 0 for no limit")
+	idleTimeout  = flag.Duration("idle-timeout", 0, "max time a keep-alive connection waits for a request, 0 for the read timeout")
+	tlsCert      = flag.String("tls-cert", "", "certificate file to serve HTTPS with, together with -tls-key")
+	tlsKey       = flag.String("tls-key", "", "key file of -tls-cert")
+)
 
 const (
 	confResponseDelaySec = "CONF_RESPONSE_DELAY_SEC"
 	confHealthFailure    = "CONF_HEALTH_FAILURE"
+	confDbTimeout        = "CONF_DB_TIMEOUT"
 	teamKey              = "invlabs"
 	dbServiceURL         = "http://db:8079"
+	maxBodyBytes         = 1 << 20
+	dbHealthTimeout      = time.Second
+	shutdownTimeout      = 10 * time.Second
 )
 
 func main() {
+	flag.Parse()
+
+	logger, err := httptools.NewLogger(os.Stderr, *logLevel, *logFormat)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(2)
+	}
+	slog.SetDefault(logger)
+	ctx, stop := signal.NotifyContext()
+	defer stop()
+
+	if len(dbURLs) == 0 {
+		dbURLs = listFlag{dbServiceURL}
+	}
+	db := newShards(dbURLs,
+		dbclient.WithRetry(*dbRetries, *dbRetryDelay),
+		dbclient.WithTimeout(*dbTimeout),
+	)
+
+	if *mirrorURL != "" {
+		db.mirror = newMirror(dbclient.New(*mirrorURL,
+			dbclient.WithRetry(*dbRetries, *dbRetryDelay),
+			dbclient.WithTimeout(*dbTimeout),
+		), *mirrorQueue)
+	}
+
+	today := time.Now().Format("2006-01-02")
+	_ = db.put(ctx, teamKey, today)
+
+	var values *cache.LRU
+	if *cacheSize > 0 {
+		values = cache.New(*cacheSize, *cacheTTL)
+	}
+
+	handler := newHandler(db, values, NewReport(*reportLimit), *healthDb)
+	handler = httptools.CORS(handler, httptools.CORSConfig{
+		Origins: httptools.SplitList(*corsOrigins),
+		Methods: httptools.SplitList(*corsMethods),
+		Headers: httptools.SplitList(*corsHeaders),
+	})
+	if *logRequests {
+		handler = httptools.LogRequests(handler, logger)
+	}
+	if *httpMetrics {
+		handler = withHTTPMetrics(handler, httptools.NewHTTPMetrics())
+	}
+	tlsConf, err := httptools.LoadTLSConfig(*tlsCert, *tlsKey)
+	if err != nil {
+		logger.Error("failed to load the TLS certificate", "err", err)
+		os.Exit(2)
+	}
+	server := httptools.CreateServer(*port, handler,
+		httptools.WithReadTimeout(*readTimeout),
+		httptools.WithWriteTimeout(*writeTimeout),
+		httptools.WithIdleTimeout(*idleTimeout),
+		httptools.WithTLSConfig(tlsConf),
+	)
+	if err := server.Start(); err != nil {
+		logger.Error("failed to start the HTTP server", "port", *port, "err", err)
+		os.Exit(1)
+	}
+	<-ctx.Done()
+	stop()
+	logger.Info("shutting down")
+	// In-flight requests finish before the mirror stops taking writes.
+	shutdownCtx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+	defer cancel()
+	if err := server.Shutdown(shutdownCtx); err != nil {
+		logger.Error("HTTP server shutdown failed", "err", err)
+	}
+	if db.mirror != nil {
+		db.mirror.close()
+	}
+}
+
+// withHTTPMetrics records the requests handled by next and serves them at
+// /metrics.
+func withHTTPMetrics(next http.Handler, m *httptools.HTTPMetrics) http.Handler {
+	h := http.NewServeMux()
+	h.Handle("/metrics", m)
+	h.Handle("/", next)
+	return m.Wrap(h)
+}
+
+// newHandler builds the server routes. values may be nil to read every value
+// from the db.
+func newHandler(db *shards, values *cache.LRU, report *Report, checkDb bool) http.Handler {
 	h := new(http.ServeMux)
 
 	h.HandleFunc("/health", func(rw http.ResponseWriter, r *http.Request) {
@@ -31,19 +156,23 @@ func main() {
 		if failConfig := os.Getenv(confHealthFailure); failConfig == "true" {
 			rw.WriteHeader(http.StatusInternalServerError)
 			_, _ = rw.Write([]byte("FAILURE"))
-		} else {
-			rw.WriteHeader(http.StatusOK)
-			_, _ = rw.Write([]byte("OK"))
+			return
 		}
+		if checkDb {
+			ctx, cancel := context.WithTimeout(r.Context(), dbHealthTimeout)
+			defer cancel()
+			for _, client := range db.all() {
+				if _, err := client.Exists(ctx, teamKey); err != nil {
+					rw.WriteHeader(http.StatusServiceUnavailable)
+					_, _ = rw.Write([]byte("DB UNAVAILABLE"))
+					return
+				}
+			}
+		}
+		rw.WriteHeader(http.StatusOK)
+		_, _ = rw.Write([]byte("OK"))
 	})
 
-	today := time.Now().Format("2006-01-02")
-	payload := map[string]string{"value": today}
-	body, _ := json.Marshal(payload)
-	_, _ = http.Post(fmt.Sprintf("%s/db/%s", dbServiceURL, teamKey), "application/json", bytes.NewReader(body))
-
-	report := make(Report)
-
 	h.HandleFunc("/api/v1/some-data", func(rw http.ResponseWriter, r *http.Request) {
 		respDelayString := os.Getenv(confResponseDelaySec)
 		if delaySec, parseErr := strconv.Atoi(respDelayString); parseErr == nil && delaySec > 0 && delaySec < 300 {
@@ -58,30 +187,59 @@ func main() {
 			return
 		}
 
-		resp, err := http.Get(fmt.Sprintf("%s/db/%s", dbServiceURL, key))
-		if err != nil || resp.StatusCode != http.StatusOK {
-			http.NotFound(rw, r)
+		if r.Method == http.MethodPost {
+			values.Delete(key)
+			writeSomeData(db, key, rw, r)
+			// A read that missed the cache during the write may have read
+			// the value from before it; invalidating again keeps that read
+			// from caching it.
+			values.Delete(key)
 			return
 		}
-		defer resp.Body.Close()
 
-		var result struct {
-			Key   string `json:"key"`
-			Value string `json:"value"`
-		}
-		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
-			http.Error(rw, "failed to decode db response", http.StatusInternalServerError)
-			return
+		value, ok := values.Get(key)
+		if !ok {
+			version := values.Version(key)
+			var err error
+			if value, err = db.get(r.Context(), key); err != nil {
+				if errors.Is(err, dbclient.ErrNotFound) {
+					http.NotFound(rw, r)
+					return
+				}
+				slog.Warn("db read failed", "key", key, "err", err)
+				http.Error(rw, "failed to read value", http.StatusBadGateway)
+				return
+			}
+			values.SetIfCurrent(key, value, version)
 		}
 
 		rw.Header().Set("Content-Type", "application/json")
 		rw.WriteHeader(http.StatusOK)
-		_ = json.NewEncoder(rw).Encode(result.Value)
+		_ = json.NewEncoder(rw).Encode(value)
 	})
 
 	h.Handle("/report", report)
 
-	server := httptools.CreateServer(*port, h)
-	server.Start()
-	signal.WaitForTerminationSignal()
+	h.HandleFunc("/stats", func(rw http.ResponseWriter, r *http.Request) {
+		rw.Header().Set("content-type", "application/json")
+		_ = json.NewEncoder(rw).Encode(map[string]any{"cache": values.Stats()})
+	})
+
+	return h
+}
+
+func writeSomeData(db *shards, key string, rw http.ResponseWriter, r *http.Request) {
+	var body struct {
+		Value *string `json:"value"`
+	}
+	if err := json.NewDecoder(http.MaxBytesReader(rw, r.Body, maxBodyBytes)).Decode(&body); err != nil || body.Value == nil {
+		http.Error(rw, "invalid body, expected {\"value\": \"...\"}", http.StatusBadRequest)
+		return
+	}
+
+	if err := db.put(r.Context(), key, *body.Value); err != nil {
+		http.Error(rw, "failed to store value", http.StatusBadGateway)
+		return
+	}
+	rw.WriteHeader(http.StatusCreated)
 }
@@ -0,0 +1,425 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/roman-mazur/architecture-practice-4-template/cache"
+	"github.com/roman-mazur/architecture-practice-4-template/dbclient"
+)
+
+type fakeDb struct {
+	mu   sync.Mutex
+	data map[string]string
+}
+
+func (f *fakeDb) ServeHTTP(rw http.ResponseWriter, r *http.Request) {
+	key := strings.TrimPrefix(r.URL.Path, "/db/")
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	switch r.Method {
+	case http.MethodGet, http.MethodHead:
+		value, ok := f.data[key]
+		if !ok {
+			http.NotFound(rw, r)
+			return
+		}
+		_ = json.NewEncoder(rw).Encode(map[string]string{"key": key, "value": value})
+	case http.MethodPost:
+		var body struct {
+			Value string `json:"value"`
+		}
+		_ = json.NewDecoder(r.Body).Decode(&body)
+		f.data[key] = body.Value
+		rw.WriteHeader(http.StatusCreated)
+	}
+}
+
+func startServer(t *testing.T) (*httptest.Server, *fakeDb) {
+	t.Helper()
+	db := &fakeDb{data: map[string]string{}}
+	dbSrv := httptest.NewServer(db)
+	srv := httptest.NewServer(newHandler(newShards([]string{dbSrv.URL}), nil, NewReport(0), true))
+	t.Cleanup(func() {
+		srv.Close()
+		dbSrv.Close()
+	})
+	return srv, db
+}
+
+func TestSomeData_Write(t *testing.T) {
+	srv, db := startServer(t)
+
+	resp, err := http.Post(srv.URL+"/api/v1/some-data?key=k1", "application/json", strings.NewReader(`{"value":"v1"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST returned %d", resp.StatusCode)
+	}
+	if db.data["k1"] != "v1" {
+		t.Errorf("Value was not forwarded to the db: %v", db.data)
+	}
+
+	resp, err = http.Get(srv.URL + "/api/v1/some-data?key=k1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var value string
+	if err := json.NewDecoder(resp.Body).Decode(&value); err != nil || value != "v1" {
+		t.Errorf("GET returned %q, %v", value, err)
+	}
+
+	for _, tc := range []struct{ query, body string }{
+		{"", `{"value":"v"}`},
+		{"?key=k2", `not json`},
+		{"?key=k2", `{"other":"v"}`},
+	} {
+		resp, err := http.Post(srv.URL+"/api/v1/some-data"+tc.query, "application/json", strings.NewReader(tc.body))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		if resp.StatusCode != http.StatusBadRequest {
+			t.Errorf("POST %s %s returned %d", tc.query, tc.body, resp.StatusCode)
+		}
+	}
+}
+
+func TestHealth(t *testing.T) {
+	dbSrv := httptest.NewServer(&fakeDb{data: map[string]string{}})
+	srv := httptest.NewServer(newHandler(newShards([]string{dbSrv.URL}), nil, NewReport(0), true))
+	defer srv.Close()
+
+	health := func() int {
+		t.Helper()
+		resp, err := http.Get(srv.URL + "/health")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+		return resp.StatusCode
+	}
+
+	if code := health(); code != http.StatusOK {
+		t.Errorf("Expected healthy server, got %d", code)
+	}
+
+	t.Setenv(confHealthFailure, "true")
+	if code := health(); code != http.StatusInternalServerError {
+		t.Errorf("Expected forced failure, got %d", code)
+	}
+	t.Setenv(confHealthFailure, "")
+
+	dbSrv.Close()
+	if code := health(); code != http.StatusServiceUnavailable {
+		t.Errorf("Expected 503 with the db down, got %d", code)
+	}
+}
+
+func TestSomeData_Cache(t *testing.T) {
+	db := &fakeDb{data: map[string]string{"k": "v1"}}
+	dbSrv := httptest.NewServer(db)
+	defer dbSrv.Close()
+	values := cache.New(10, time.Minute)
+	srv := httptest.NewServer(newHandler(newShards([]string{dbSrv.URL}), values, NewReport(0), false))
+	defer srv.Close()
+
+	get := func() string {
+		t.Helper()
+		resp, err := http.Get(srv.URL + "/api/v1/some-data?key=k")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer resp.Body.Close()
+		var value string
+		_ = json.NewDecoder(resp.Body).Decode(&value)
+		return value
+	}
+
+	get()
+	db.mu.Lock()
+	db.data["k"] = "changed behind the cache"
+	db.mu.Unlock()
+	if v := get(); v != "v1" {
+		t.Errorf("Expected cached value, got %q", v)
+	}
+	if st := values.Stats(); st.Hits != 1 || st.Misses != 1 {
+		t.Errorf("Unexpected cache stats %+v", st)
+	}
+
+	resp, err := http.Post(srv.URL+"/api/v1/some-data?key=k", "application/json", strings.NewReader(`{"value":"v2"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if v := get(); v != "v2" {
+		t.Errorf("Expected write to invalidate the cache, got %q", v)
+	}
+}
+
+func TestSomeData_CacheReadDuringWrite(t *testing.T) {
+	db := &fakeDb{data: map[string]string{"k": "v1"}}
+	values := cache.New(10, time.Minute)
+	dbSrv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method == http.MethodPost {
+			// A concurrent read caches the value before the write lands.
+			values.Set("k", "v1")
+		}
+		db.ServeHTTP(rw, r)
+	}))
+	defer dbSrv.Close()
+	srv := httptest.NewServer(newHandler(newShards([]string{dbSrv.URL}), values, NewReport(0), false))
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/api/v1/some-data?key=k", "application/json", strings.NewReader(`{"value":"v2"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if v, ok := values.Get("k"); ok {
+		t.Errorf("Expected the write to invalidate the cache, still cached %q", v)
+	}
+}
+
+func TestSomeData_StaleReadDuringWrite(t *testing.T) {
+	db := &fakeDb{data: map[string]string{"k": "v1"}}
+	read, release := make(chan struct{}), make(chan struct{})
+	var once sync.Once
+	dbSrv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			db.ServeHTTP(rw, r)
+			return
+		}
+		// The first read gets the value from before the write and answers
+		// only once the write has finished.
+		rec := httptest.NewRecorder()
+		db.ServeHTTP(rec, r)
+		once.Do(func() {
+			close(read)
+			<-release
+		})
+		rw.WriteHeader(rec.Code)
+		_, _ = rw.Write(rec.Body.Bytes())
+	}))
+	defer dbSrv.Close()
+	values := cache.New(10, time.Minute)
+	srv := httptest.NewServer(newHandler(newShards([]string{dbSrv.URL}), values, NewReport(0), false))
+	defer srv.Close()
+
+	get := func() string {
+		t.Helper()
+		resp, err := http.Get(srv.URL + "/api/v1/some-data?key=k")
+		if err != nil {
+			t.Error(err)
+			return ""
+		}
+		defer resp.Body.Close()
+		var value string
+		_ = json.NewDecoder(resp.Body).Decode(&value)
+		return value
+	}
+
+	stale := make(chan string)
+	go func() { stale <- get() }()
+	<-read
+	resp, err := http.Post(srv.URL+"/api/v1/some-data?key=k", "application/json", strings.NewReader(`{"value":"v2"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	close(release)
+	if v := <-stale; v != "v1" {
+		t.Fatalf("Expected the read started before the write to return v1, got %q", v)
+	}
+	if v := get(); v != "v2" {
+		t.Errorf("Expected the stale read not to be cached, got %q", v)
+	}
+}
+
+func TestSomeData_DbError(t *testing.T) {
+	dbSrv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		http.Error(rw, "internal error", http.StatusInternalServerError)
+	}))
+	defer dbSrv.Close()
+	srv := httptest.NewServer(newHandler(newShards([]string{dbSrv.URL}), nil, NewReport(0), false))
+	defer srv.Close()
+
+	resp, err := http.Get(srv.URL + "/api/v1/some-data?key=k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusBadGateway {
+		t.Errorf("Expected a db failure to return 502, got %d", resp.StatusCode)
+	}
+
+	srv, _ = startServer(t)
+	resp, err = http.Get(srv.URL + "/api/v1/some-data?key=missing")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusNotFound {
+		t.Errorf("Expected a missing key to return 404, got %d", resp.StatusCode)
+	}
+}
+
+func TestSomeData_ConcurrentReport(t *testing.T) {
+	dbSrv := httptest.NewServer(&fakeDb{data: map[string]string{"k": "v"}})
+	defer dbSrv.Close()
+	report := NewReport(0)
+	srv := httptest.NewServer(newHandler(newShards([]string{dbSrv.URL}), nil, report, false))
+	defer srv.Close()
+
+	const (
+		workers  = 16
+		requests = 20
+	)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < requests; i++ {
+				req, _ := http.NewRequest("GET", srv.URL+"/api/v1/some-data?key=k", nil)
+				req.Header.Set("lb-author", fmt.Sprintf("author-%d", w%4))
+				req.Header.Set("lb-req-cnt", strconv.Itoa(i))
+				resp, err := http.DefaultClient.Do(req)
+				if err != nil {
+					t.Error(err)
+					return
+				}
+				_ = resp.Body.Close()
+			}
+		}()
+	}
+	wg.Wait()
+
+	resp := report.snapshot()
+	if len(resp.Authors) != 4 {
+		t.Fatalf("Unexpected authors %+v", resp.Authors)
+	}
+	for _, a := range resp.Authors {
+		if a.Count != workers/4*requests {
+			t.Errorf("Author %s has %d requests, want %d", a.Author, a.Count, workers/4*requests)
+		}
+	}
+}
+
+func TestSomeData_Shards(t *testing.T) {
+	dbs := []*fakeDb{{data: map[string]string{}}, {data: map[string]string{}}}
+	var urls []string
+	for _, db := range dbs {
+		dbSrv := httptest.NewServer(db)
+		defer dbSrv.Close()
+		urls = append(urls, dbSrv.URL)
+	}
+	shards := newShards(urls)
+	srv := httptest.NewServer(newHandler(shards, nil, NewReport(0), false))
+	defer srv.Close()
+
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		resp, err := http.Post(srv.URL+"/api/v1/some-data?key="+key, "application/json", strings.NewReader(`{"value":"v"}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		_ = resp.Body.Close()
+	}
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		owner := shards.ring.Get(key)
+		if owner != newShards([]string{urls[1], urls[0]}).ring.Get(key) {
+			t.Errorf("Key %s changed backend with the flag order", key)
+		}
+		for j, db := range dbs {
+			if _, ok := db.data[key]; ok != (urls[j] == owner) {
+				t.Errorf("Key %s stored in backend %d: %v, owner %s", key, j, ok, owner)
+			}
+		}
+	}
+	if len(dbs[0].data) == 0 || len(dbs[1].data) == 0 {
+		t.Errorf("Keys were not spread over the backends: %d and %d", len(dbs[0].data), len(dbs[1].data))
+	}
+}
+
+func TestSomeData_Mirror(t *testing.T) {
+	primary := &fakeDb{data: map[string]string{}}
+	secondary := &fakeDb{data: map[string]string{}}
+	primarySrv := httptest.NewServer(primary)
+	defer primarySrv.Close()
+	secondarySrv := httptest.NewServer(secondary)
+	defer secondarySrv.Close()
+
+	db := newShards([]string{primarySrv.URL})
+	db.mirror = newMirror(dbclient.New(secondarySrv.URL), 10)
+	srv := httptest.NewServer(newHandler(db, nil, NewReport(0), false))
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/api/v1/some-data?key=k", "application/json", strings.NewReader(`{"value":"v"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	if resp.StatusCode != http.StatusCreated {
+		t.Fatalf("POST returned %d", resp.StatusCode)
+	}
+	db.mirror.close()
+	if primary.data["k"] != "v" || secondary.data["k"] != "v" {
+		t.Fatalf("Write was not mirrored: primary %v, secondary %v", primary.data, secondary.data)
+	}
+
+	primary.mu.Lock()
+	delete(primary.data, "k")
+	primary.mu.Unlock()
+	resp, err = http.Get(srv.URL + "/api/v1/some-data?key=k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	var value string
+	if err := json.NewDecoder(resp.Body).Decode(&value); err != nil || value != "v" {
+		t.Errorf("GET with a primary miss returned %q, %v", value, err)
+	}
+}
+
+func TestMirror_FailureDoesNotFailWrite(t *testing.T) {
+	primary := &fakeDb{data: map[string]string{}}
+	primarySrv := httptest.NewServer(primary)
+	defer primarySrv.Close()
+	down := httptest.NewServer(http.NotFoundHandler())
+	down.Close()
+
+	db := newShards([]string{primarySrv.URL})
+	db.mirror = newMirror(dbclient.New(down.URL), 10)
+	srv := httptest.NewServer(newHandler(db, nil, NewReport(0), false))
+	defer srv.Close()
+
+	resp, err := http.Post(srv.URL+"/api/v1/some-data?key=k", "application/json", strings.NewReader(`{"value":"v"}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_ = resp.Body.Close()
+	db.mirror.close()
+	if resp.StatusCode != http.StatusCreated || primary.data["k"] != "v" {
+		t.Errorf("POST with the mirror down returned %d, primary %v", resp.StatusCode, primary.data)
+	}
+}
+
+func TestMirror_PutAfterClose(t *testing.T) {
+	m := newMirror(dbclient.New("http://127.0.0.1:1"), 10)
+	m.close()
+	// A write racing with shutdown is dropped instead of panicking.
+	m.put("k", "v")
+	m.close()
+}
@@ -0,0 +1,80 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"strings"
+
+	"github.com/roman-mazur/architecture-practice-4-template/dbclient"
+	"github.com/roman-mazur/architecture-practice-4-template/hashring"
+)
+
+// listFlag collects the values of a repeatable flag.
+type listFlag []string
+
+func (l *listFlag) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlag) Set(value string) error {
+	*l = append(*l, value)
+	return nil
+}
+
+// shards spreads keys over the db backends with a consistent-hash ring.
+type shards struct {
+	ring    *hashring.Ring
+	urls    []string
+	clients map[string]*dbclient.Client
+	// mirror, when set, receives a copy of every write and serves reads
+	// the backends fail.
+	mirror *mirror
+}
+
+func newShards(urls []string, opts ...dbclient.Option) *shards {
+	s := &shards{
+		ring:    hashring.New(urls, 0),
+		urls:    urls,
+		clients: make(map[string]*dbclient.Client, len(urls)),
+	}
+	for _, url := range urls {
+		s.clients[url] = dbclient.New(url, opts...)
+	}
+	return s
+}
+
+// forKey returns the client of the backend storing key.
+func (s *shards) forKey(key string) *dbclient.Client {
+	return s.clients[s.ring.Get(key)]
+}
+
+func (s *shards) get(ctx context.Context, key string) (string, error) {
+	value, err := s.forKey(key).Get(ctx, key)
+	if err != nil && s.mirror != nil {
+		if mvalue, merr := s.mirror.client.Get(ctx, key); merr == nil {
+			slog.Debug("served value from the mirror", "key", key, "err", err)
+			return mvalue, nil
+		}
+	}
+	return value, err
+}
+
+// put stores value on the backend of key and queues it for the mirror.
+func (s *shards) put(ctx context.Context, key, value string) error {
+	if err := s.forKey(key).Put(ctx, key, value); err != nil {
+		return err
+	}
+	if s.mirror != nil {
+		s.mirror.put(key, value)
+	}
+	return nil
+}
+
+// all returns the clients of every backend in flag order.
+func (s *shards) all() []*dbclient.Client {
+	res := make([]*dbclient.Client, 0, len(s.urls))
+	for _, url := range s.urls {
+		res = append(res, s.clients[url])
+	}
+	return res
+}
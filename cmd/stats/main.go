@@ -17,7 +17,13 @@ var serversPool = []string{
 	"localhost:8082",
 }
 
-type report map[string][]string
+type report struct {
+	Authors []struct {
+		Author   string   `json:"author"`
+		Count    int      `json:"count"`
+		Requests []string `json:"requests"`
+	} `json:"authors"`
+}
 
 func scheme() string {
 	if *https {
@@ -40,12 +46,12 @@ func main()  {
 			if err := json.NewDecoder(resp.Body).Decode(&data); err != nil {
 				//log.Printf("error parsing froom %s: %s", s, err)
 			} else {
-				for k, v := range data {
-					l := len(v)
+				for i, a := range data.Authors {
+					l := len(a.Requests)
 					if l > 5 {
 						l = 5
 					}
-					data[k] = v[len(v)-l:]
+					data.Authors[i].Requests = a.Requests[len(a.Requests)-l:]
 				}
 				res[i] = data
 			}
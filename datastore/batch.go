@@ -0,0 +1,202 @@
+package datastore
+
+import (
+	"errors"
+	"os"
+)
+
+var ErrBatchDone = errors.New("batch already committed")
+
+// Batch collects puts and deletes that Commit makes visible all at once.
+// A Batch is not safe for concurrent use.
+type Batch struct {
+	db      *Db
+	entries []entry
+	done    bool
+}
+
+// Begin starts an empty batch.
+func (db *Db) Begin() *Batch {
+	return &Batch{db: db}
+}
+
+func (b *Batch) Put(key, value string) {
+	b.entries = append(b.entries, entry{key: key, value: []byte(value)})
+}
+
+// Delete removes key when the batch is committed. Deleting a missing key
+// is not an error.
+func (b *Batch) Delete(key string) {
+	b.entries = append(b.entries, entry{key: key, deleted: true})
+}
+
+// Len returns the number of buffered operations.
+func (b *Batch) Len() int {
+	return len(b.entries)
+}
+
+// Commit writes the batch contiguously and then publishes it to the index
+// in one step, so readers see either none or all of its operations, also
+// when it spans several segments or partitions. Every other write and
+// compaction waits while Commit runs. If Commit fails, the segments are
+// truncated back to where the batch started, so a restart does not replay
+// any of it either.
+func (b *Batch) Commit() error {
+	if b.done {
+		return ErrBatchDone
+	}
+	db := b.db
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	for _, e := range b.entries {
+		if e.key == "" {
+			return ErrEmptyKey
+		}
+	}
+	b.done = true
+	if len(b.entries) == 0 {
+		return nil
+	}
+	if _, err := db.commitEntries(b.entries); err != nil {
+		return err
+	}
+	db.observePuts(b.entries)
+	return nil
+}
+
+// commitEntries appends entries to their partitions while all writers are
+// paused and publishes them to the index at once.
+func (db *Db) commitEntries(entries []entry) ([]segmentRef, error) {
+	// A compaction would treat the records appended so far as dead, since
+	// the index does not point at them yet.
+	db.compactMu.Lock()
+	defer db.compactMu.Unlock()
+	if db.closed.Load() {
+		return nil, ErrClosed
+	}
+	resume, err := db.quiesce()
+	if err != nil {
+		return nil, err
+	}
+	defer resume()
+
+	groups := make([][]int, len(db.partitions))
+	for i, e := range entries {
+		p := db.partitionOf(e.key).id
+		groups[p] = append(groups[p], i)
+	}
+	refs := make([]segmentRef, len(entries))
+	var marks []commitMark
+	defer func() {
+		for _, m := range marks {
+			m.p.committing, m.p.created = false, nil
+		}
+	}()
+	fail := func(err error) ([]segmentRef, error) {
+		if rerr := db.rollback(marks); rerr != nil {
+			db.logger.Error("datastore: rollback of a failed commit failed", "err", rerr)
+		}
+		return nil, err
+	}
+	for id, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+		p := db.partitions[id]
+		if err := p.syncErr; err != nil {
+			p.syncErr = nil
+			return fail(err)
+		}
+		marks = append(marks, commitMark{p: p, segmentId: p.segmentId, offset: p.offset, hints: p.hints, pinned: p.pinned})
+		p.committing = true
+		part := make([]entry, len(group))
+		for i, j := range group {
+			part[i] = entries[j]
+		}
+		partRefs, err := db.appendEntries(p, part)
+		if err != nil {
+			return fail(err)
+		}
+		// The paused writer does not know about these records, so an
+		// interval policy is honoured right away.
+		if db.syncPolicy != SyncNever {
+			if err := p.segment.Sync(); err != nil {
+				return fail(err)
+			}
+		}
+		for i, j := range group {
+			refs[j] = partRefs[i]
+		}
+	}
+	db.publish(entries, refs)
+	return refs, nil
+}
+
+// commitMark is where a partition stood before commitEntries wrote to it.
+type commitMark struct {
+	p         *partition
+	segmentId int
+	offset    int64
+	hints     []hintRecord
+	pinned    int
+}
+
+// rollback truncates the partitions written by a failed commit back to
+// their marks, removing the segments the commit rolled over to.
+func (db *Db) rollback(marks []commitMark) error {
+	var errs []error
+	for _, m := range marks {
+		errs = append(errs, db.rollbackPartition(m))
+	}
+	return errors.Join(errs...)
+}
+
+func (db *Db) rollbackPartition(m commitMark) error {
+	p := m.p
+	db.mu.Lock()
+	_, sealed := db.recordCounts[m.segmentId]
+	db.mu.Unlock()
+	if sealed {
+		// The commit rolled over from the segment of the mark, which
+		// becomes the current one again.
+		_ = p.segment.Close()
+		for _, id := range p.created {
+			if err := os.Remove(db.segmentPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			if err := os.Remove(db.hintPath(id)); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+		}
+		if err := os.Remove(db.hintPath(m.segmentId)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		f, err := db.modes.openFile(db.segmentPath(m.segmentId), os.O_APPEND|os.O_WRONLY)
+		if err != nil {
+			return err
+		}
+		db.mu.Lock()
+		delete(db.recordCounts, m.segmentId)
+		for _, id := range p.created {
+			delete(db.recordCounts, id)
+		}
+		p.segment = f
+		p.segmentId = m.segmentId
+		db.mu.Unlock()
+	}
+	if err := p.segment.Truncate(m.offset); err != nil {
+		return err
+	}
+	if db.syncPolicy != SyncNever {
+		if err := p.segment.Sync(); err != nil {
+			return err
+		}
+	}
+	db.mu.Lock()
+	p.offset = m.offset
+	p.hints = m.hints
+	p.pinned = m.pinned
+	db.mu.Unlock()
+	return nil
+}
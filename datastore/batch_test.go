@@ -0,0 +1,210 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+)
+
+// indexSnapshot copies the index with every shard locked at once, which is
+// the view of a reader that could see a partially published batch.
+func indexSnapshot(idx *hashIndex) map[string]segmentRef {
+	for i := range idx.shards {
+		idx.shards[i].mu.RLock()
+	}
+	defer func() {
+		for i := range idx.shards {
+			idx.shards[i].mu.RUnlock()
+		}
+	}()
+	res := make(map[string]segmentRef)
+	for i := range idx.shards {
+		for key, ref := range idx.shards[i].refs {
+			res[key] = ref
+		}
+	}
+	return res
+}
+
+func TestBatch_AtomicVisibility(t *testing.T) {
+	db, err := OpenWithLimit(t.TempDir(), 150, WithWriters(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	first := db.Begin()
+	first.Put("a", "0")
+	first.Put("b", "0")
+	first.Put("slot-0", "token")
+	if err := first.Commit(); err != nil {
+		t.Fatal(err)
+	}
+
+	const rounds = 100
+	var (
+		done     atomic.Bool
+		wg       sync.WaitGroup
+		observed atomic.Int64
+	)
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for !done.Load() {
+				snap := indexSnapshot(db.index)
+				slots := 0
+				for key := range snap {
+					if strings.HasPrefix(key, "slot-") {
+						slots++
+					}
+				}
+				a, _, errA := db.readRecord("a", snap["a"])
+				b, _, errB := db.readRecord("b", snap["b"])
+				if errA != nil || errB != nil {
+					t.Errorf("read: %v, %v", errA, errB)
+					return
+				}
+				if slots != 1 || string(a.value) != string(b.value) {
+					t.Errorf("Partial batch visible: %d slots, a=%s b=%s", slots, a.value, b.value)
+					return
+				}
+				observed.Add(1)
+			}
+		}()
+	}
+
+	for n := 1; n <= rounds; n++ {
+		batch := db.Begin()
+		v := strconv.Itoa(n)
+		batch.Put("a", v)
+		batch.Delete(fmt.Sprintf("slot-%d", n-1))
+		batch.Put("pad", strings.Repeat("p", 40))
+		batch.Put(fmt.Sprintf("slot-%d", n), "token")
+		batch.Put("b", v)
+		if err := batch.Commit(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	done.Store(true)
+	wg.Wait()
+	if observed.Load() == 0 {
+		t.Error("Readers made no observations")
+	}
+	if st, _ := db.Stats(); st.Segments <= 3 {
+		t.Errorf("Batches did not roll segments over: %d segments", st.Segments)
+	}
+	if got, err := db.Get("b"); err != nil || got != strconv.Itoa(rounds) {
+		t.Errorf("Get(b) = %q, %v", got, err)
+	}
+}
+
+func TestBatch_Commit(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("old", "v"); err != nil {
+		t.Fatal(err)
+	}
+	batch := db.Begin()
+	batch.Put("new", "v")
+	batch.Delete("old")
+	batch.Delete("never-stored")
+	if _, err := db.Get("new"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Uncommitted Put is visible: %v", err)
+	}
+	if err := batch.Commit(); err != nil {
+		t.Fatal(err)
+	}
+	if err := batch.Commit(); !errors.Is(err, ErrBatchDone) {
+		t.Errorf("Second Commit error = %v, want ErrBatchDone", err)
+	}
+	empty := db.Begin()
+	empty.Put("", "v")
+	if err := empty.Commit(); !errors.Is(err, ErrEmptyKey) {
+		t.Errorf("Commit with an empty key error = %v", err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if got, err := db.Get("new"); err != nil || got != "v" {
+		t.Errorf("Get(new) = %q, %v", got, err)
+	}
+	if _, err := db.Get("old"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get(old) error = %v, want ErrNotFound", err)
+	}
+	if closed := db.Begin(); db.Close() == nil {
+		closed.Put("k", "v")
+		if err := closed.Commit(); !errors.Is(err, ErrClosed) {
+			t.Errorf("Commit after Close error = %v, want ErrClosed", err)
+		}
+	}
+}
+
+func TestBatch_CommitFailure(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := OpenWithLimit(tmp, 100, WithWriters(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("old", "v"); err != nil {
+		t.Fatal(err)
+	}
+	before, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Partition 0 is written first; the batch rolls it over a few segments
+	// before the pending sync error of partition 1 fails the commit.
+	batch := db.Begin()
+	for i := 0; i < 20; i++ {
+		batch.Put(fmt.Sprintf("key-%d", i), "value")
+	}
+	injected := errors.New("disk failed")
+	db.partitions[1].syncErr = injected
+	if err := batch.Commit(); !errors.Is(err, injected) {
+		t.Fatalf("Commit() error = %v, want %v", err, injected)
+	}
+	after, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Segments != before.Segments || after.DiskBytes != before.DiskBytes {
+		t.Errorf("failed commit left %d segments of %d bytes, want %d of %d", after.Segments, after.DiskBytes, before.Segments, before.DiskBytes)
+	}
+	if err := db.Put("new", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenWithLimit(tmp, 100, WithWriters(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 0; i < 20; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if _, err := db.Get(key); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get(%s) after reopening: %v, want ErrNotFound", key, err)
+		}
+	}
+	for _, key := range []string{"old", "new"} {
+		if got, err := db.Get(key); err != nil || got != "v" {
+			t.Errorf("Get(%s) = %q, %v", key, got, err)
+		}
+	}
+}
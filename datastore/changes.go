@@ -0,0 +1,114 @@
+package datastore
+
+import "sync"
+
+// subscriberBuffer is the number of events a subscriber may fall behind
+// before further events are dropped for it.
+const subscriberBuffer = 256
+
+type ChangeType int
+
+const (
+	ChangePut ChangeType = iota + 1
+	ChangeDelete
+)
+
+func (t ChangeType) String() string {
+	switch t {
+	case ChangePut:
+		return "put"
+	case ChangeDelete:
+		return "delete"
+	}
+	return "unknown"
+}
+
+// ChangeEvent describes a write made visible to readers. SegmentRef is where
+// the record, or the tombstone of a delete, was written.
+type ChangeEvent struct {
+	Key        string
+	Type       ChangeType
+	SegmentRef Location
+}
+
+// changeFeed fans change events out to the subscribers of a Db.
+type changeFeed struct {
+	mu      sync.Mutex
+	subs    map[chan ChangeEvent]struct{}
+	dropped int64
+	closed  bool
+}
+
+// Subscribe returns a channel receiving an event for every Put, Delete and
+// pair of a batch applied from now on. The events of a key arrive in the
+// order of its writes. Sending never blocks a writer: a subscriber that
+// falls subscriberBuffer events behind misses the events that do not fit,
+// which are counted in Stats.DroppedEvents. The returned function stops the
+// subscription and closes the channel; Close does the same for all
+// subscriptions.
+func (db *Db) Subscribe() (<-chan ChangeEvent, func()) {
+	ch := make(chan ChangeEvent, subscriberBuffer)
+	f := &db.changes
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if f.closed {
+		close(ch)
+		return ch, func() {}
+	}
+	if f.subs == nil {
+		f.subs = make(map[chan ChangeEvent]struct{})
+	}
+	f.subs[ch] = struct{}{}
+	return ch, func() {
+		f.mu.Lock()
+		defer f.mu.Unlock()
+		if _, ok := f.subs[ch]; ok {
+			delete(f.subs, ch)
+			close(ch)
+		}
+	}
+}
+
+// notify sends the events of the published entries to the subscribers.
+// Sends happen under mu, so concurrent writers cannot reorder the events of
+// a key.
+func (f *changeFeed) notify(entries []entry, refs []segmentRef) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if len(f.subs) == 0 {
+		return
+	}
+	for i, e := range entries {
+		ev := ChangeEvent{
+			Key:        e.key,
+			Type:       ChangePut,
+			SegmentRef: Location{SegmentID: refs[i].segmentId, Offset: refs[i].offset},
+		}
+		if e.deleted {
+			ev.Type = ChangeDelete
+		}
+		for ch := range f.subs {
+			select {
+			case ch <- ev:
+			default:
+				f.dropped++
+			}
+		}
+	}
+}
+
+func (f *changeFeed) droppedEvents() int64 {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return f.dropped
+}
+
+// close ends all subscriptions.
+func (f *changeFeed) close() {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	for ch := range f.subs {
+		close(ch)
+	}
+	f.subs, f.closed = nil, true
+}
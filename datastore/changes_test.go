@@ -0,0 +1,87 @@
+package datastore
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestDb_Subscribe(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	events, unsubscribe := db.Subscribe()
+	if err := db.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	loc, err := db.PutLocated("b", "2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutBatch([]KV{{Key: "c", Value: "3"}, {Key: "d", Value: "4"}}); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []struct {
+		key string
+		typ ChangeType
+	}{{"a", ChangePut}, {"b", ChangePut}, {"a", ChangeDelete}, {"c", ChangePut}, {"d", ChangePut}}
+	for i, w := range want {
+		ev := <-events
+		if ev.Key != w.key || ev.Type != w.typ {
+			t.Errorf("event %d = %s %q, want %s %q", i, ev.Type, ev.Key, w.typ, w.key)
+		}
+		if w.key == "b" && ev.SegmentRef != loc {
+			t.Errorf("event of b refers to %+v, want %+v", ev.SegmentRef, loc)
+		}
+	}
+
+	unsubscribe()
+	if _, ok := <-events; ok {
+		t.Error("channel is open after unsubscribing")
+	}
+	unsubscribe()
+	if err := db.Put("e", "5"); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestDb_SubscribeDropsForSlowConsumers(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	events, _ := db.Subscribe()
+	for i := 0; i < subscriberBuffer+10; i++ {
+		if err := db.Put(fmt.Sprintf("key-%d", i), "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	st, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st.DroppedEvents != 10 {
+		t.Errorf("DroppedEvents = %d, want 10", st.DroppedEvents)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	n := 0
+	for ev := range events {
+		if want := fmt.Sprintf("key-%d", n); ev.Key != want {
+			t.Errorf("event %d is for %q, want %q", n, ev.Key, want)
+		}
+		n++
+	}
+	if n != subscriberBuffer {
+		t.Errorf("received %d events, want %d", n, subscriberBuffer)
+	}
+}
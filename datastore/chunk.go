@@ -0,0 +1,113 @@
+package datastore
+
+import (
+	"errors"
+	"os"
+	"slices"
+)
+
+// maxRecordSize is the largest record the size field can describe, which
+// bounds chunked values too, as compaction merges them into one record.
+const maxRecordSize = taggedRecord - 1
+
+// chunkedValue is a value too large for one segment, split for writing.
+type chunkedValue struct {
+	head      entry    // the sealed entry, without its value
+	parts     [][]byte // the stored value, in order
+	valueSize int
+}
+
+// splitValue splits the stored value of e, which does not fit in a
+// segment, into parts that do once written as chunks. It returns nil if e
+// cannot be chunked.
+func (db *Db) splitValue(e entry, valueSize int) *chunkedValue {
+	if !db.chunkValues || e.deleted {
+		return nil
+	}
+	overhead := len((&entry{key: e.key, checksum: e.checksum, modified: e.modified, chunk: &chunkLink{}}).Encode())
+	room := int(db.segmentLimit) - overhead
+	if room <= 0 || len(e.value)+overhead > maxRecordSize {
+		return nil
+	}
+	c := &chunkedValue{head: e, valueSize: valueSize}
+	for v := e.value; len(v) > 0; v = v[min(room, len(v)):] {
+		c.parts = append(c.parts, v[:min(room, len(v))])
+	}
+	c.head.value = nil
+	return c
+}
+
+// chunk returns the record of part j of c, linked to next, the location of
+// part j+1. start is the segment of the last part, which is written first.
+func (c *chunkedValue) chunk(j int, next chunkLink, start int) entry {
+	if j > 0 {
+		return entry{
+			checksum: c.head.checksum,
+			value:    c.parts[j],
+			chunk:    &chunkLink{nextSegment: next.nextSegment, nextOffset: next.nextOffset},
+		}
+	}
+	head := c.head
+	head.value = c.parts[0]
+	head.chunk = &chunkLink{
+		nextSegment: next.nextSegment,
+		nextOffset:  next.nextOffset,
+		valueSize:   c.valueSize,
+		start:       start,
+	}
+	return head
+}
+
+// readChunked completes e, the first chunk of a chunked value, with the
+// other chunks and unseals the value.
+func (db *Db) readChunked(e *entry) error {
+	size := e.chunk.valueSize
+	if err := db.assembleChunks(e); err != nil {
+		return err
+	}
+	if err := e.unseal(); err != nil {
+		return err
+	}
+	if len(e.value) != size {
+		return ErrCorrupted
+	}
+	return nil
+}
+
+// assembleChunks appends the other chunks to the value of head, the first
+// chunk of a chunked value, leaving the value as stored.
+func (db *Db) assembleChunks(head *entry) error {
+	// The value may share its buffer with the checksum, so it is not
+	// appended to in place.
+	value := slices.Clip(head.value)
+	for link := head.chunk; link.nextSegment != 0; {
+		f, err := db.segmentFile(link.nextSegment)
+		if errors.Is(err, os.ErrNotExist) {
+			return ErrSegmentMissing
+		}
+		if err != nil {
+			return err
+		}
+		chunk := entry{skipVerify: db.skipVerify}
+		if _, err := chunk.DecodeAt(f, link.nextOffset); err != nil {
+			return ErrCorrupted
+		}
+		if chunk.chunk == nil || chunk.key != "" {
+			return ErrCorrupted
+		}
+		value = append(value, chunk.value...)
+		link = chunk.chunk
+	}
+	head.value, head.chunk = value, nil
+	return nil
+}
+
+// isChunkHead reports whether the encoded record is the first chunk of a
+// chunked value.
+func isChunkHead(record []byte) bool {
+	if len(record) < 13 || record[3]&(taggedRecord>>24) == 0 || record[4]&flagChunk == 0 {
+		return false
+	}
+	// Only the first chunk has a key.
+	return record[5]|record[6]|record[7]|record[8] != 0
+}
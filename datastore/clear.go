@@ -0,0 +1,89 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"os"
+)
+
+// Clear removes every key and segment file, leaving the store as if it had
+// just been created. Writes queued before Clear are applied first; writes
+// and compactions wait until it is done. Concurrent readers see either the
+// old contents or an empty store.
+func (db *Db) Clear() error {
+	db.compactMu.Lock()
+	defer db.compactMu.Unlock()
+	if db.closed.Load() {
+		return ErrClosed
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	resume, err := db.quiesce()
+	if err != nil {
+		return err
+	}
+	defer resume()
+
+	db.swapGen.Add(1)
+	defer db.swapGen.Add(1)
+	db.index.clear()
+	db.values.clear()
+
+	segments, err := listSegments(db.fsys)
+	if err != nil {
+		return err
+	}
+	db.mu.Lock()
+	for id, f := range db.segments {
+		_ = f.Close()
+		delete(db.segments, id)
+	}
+	for _, p := range db.partitions {
+		// The segment id is kept, so the new segments get fresh ids.
+		_ = p.segment.Close()
+		p.segment, p.offset, p.hints, p.pinned = nil, 0, nil, 0
+	}
+	clear(db.recordCounts)
+	db.records, db.tombstones = 0, 0
+	db.mu.Unlock()
+
+	for _, s := range segments {
+		if err := os.Remove(db.diskPath(s.name)); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+		if err := os.Remove(db.diskPath(s.name) + hintFileSuffix); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return err
+		}
+	}
+	for _, p := range db.partitions {
+		if err := db.createNewSegment(p); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// quiesce waits for every queued write and keeps the writers from starting
+// new ones until the returned function is called.
+func (db *Db) quiesce() (func(), error) {
+	if db.syncWrites {
+		for _, p := range db.partitions {
+			p.mu.Lock()
+		}
+		return func() {
+			for _, p := range db.partitions {
+				p.mu.Unlock()
+			}
+		}, nil
+	}
+
+	release := make(chan struct{})
+	for _, p := range db.partitions {
+		if _, err := db.submit(context.Background(), p, writeRequest{pause: release}); err != nil {
+			close(release)
+			return nil, err
+		}
+	}
+	return func() { close(release) }, nil
+}
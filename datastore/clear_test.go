@@ -0,0 +1,90 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"sync"
+	"testing"
+)
+
+func TestDb_Clear(t *testing.T) {
+	for name, opts := range map[string][]Option{
+		"writer":      nil,
+		"synchronous": {SynchronousWrites(true)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			tmp := t.TempDir()
+			db, err := OpenWithLimit(tmp, 100, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				_ = db.Close()
+			})
+			for i := 0; i < 30; i++ {
+				if err := db.Put(fmt.Sprintf("key-%d", i), "value"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			stop := make(chan struct{})
+			var wg sync.WaitGroup
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; ; i++ {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					key := fmt.Sprintf("key-%d", i%30)
+					if v, err := db.Get(key); err != nil && !errors.Is(err, ErrNotFound) || err == nil && v != "value" {
+						t.Errorf("Get(%s) during Clear = %q, %v", key, v, err)
+						return
+					}
+				}
+			}()
+			if err := db.Clear(); err != nil {
+				t.Fatal(err)
+			}
+			close(stop)
+			wg.Wait()
+
+			if keys := db.Keys(); len(keys) != 0 {
+				t.Errorf("Keys() after Clear = %v", keys)
+			}
+			if _, err := db.Get("key-1"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("Get() after Clear: %v", err)
+			}
+			segments, err := db.Segments()
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(segments) != 1 || segments[0].Size != 0 || !segments[0].Current {
+				t.Errorf("Segments() after Clear = %+v", segments)
+			}
+			files, _ := os.ReadDir(tmp)
+			files = slices.DeleteFunc(files, func(f os.DirEntry) bool { return f.Name() == lockFileName })
+			if len(files) != 1 || files[0].Name() != segmentFilename(segments[0].ID) {
+				t.Errorf("files after Clear: %v", files)
+			}
+
+			if err := db.Put("new", "value"); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+			db, err = OpenWithLimit(tmp, 100, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if keys := db.Keys(); len(keys) != 1 || keys[0] != "new" {
+				t.Errorf("Keys() after reopen = %v", keys)
+			}
+		})
+	}
+}
@@ -0,0 +1,278 @@
+package datastore
+
+import (
+	"errors"
+	"os"
+	"time"
+)
+
+const compactFileSuffix = ".compact"
+
+var ErrCompacting = errors.New("compaction already in progress")
+
+// Compact merges all sealed segments into one per partition, dropping
+// overwritten records. Tombstones of deleted keys are kept (once per key) so
+// that a copy of an older segment left behind by a crash cannot bring a key
+// back. The merged segment may be larger than the segment limit.
+//
+// Reads and writes proceed while Compact runs. Calling Compact while another
+// compaction is running returns ErrCompacting.
+func (db *Db) Compact() error {
+	if !db.compactMu.TryLock() {
+		return ErrCompacting
+	}
+	defer db.compactMu.Unlock()
+	if db.closed.Load() {
+		return ErrClosed
+	}
+	if db.readOnly {
+		return ErrReadOnly
+	}
+
+	ids, err := db.sealedSegments()
+	if err != nil || len(ids) == 0 {
+		return err
+	}
+	groups := make([][]int, len(db.partitions))
+	for _, id := range ids {
+		p := db.segmentPartition(id).id
+		groups[p] = append(groups[p], id)
+	}
+	start := time.Now()
+	reclaimed := int64(0)
+	for _, group := range groups {
+		if len(group) == 0 {
+			continue
+		}
+		n, err := db.compactSegments(group)
+		if err != nil {
+			return err
+		}
+		reclaimed += n
+	}
+
+	db.mu.Lock()
+	db.lastCompaction = time.Now()
+	db.lastReclaimed = reclaimed
+	db.mu.Unlock()
+	db.metrics.IncCompactions()
+	db.logger.Debug("datastore: compaction finished", "segments", len(ids), "reclaimed_bytes", reclaimed, "duration", time.Since(start))
+	return nil
+}
+
+// compactSegments merges the given sealed segments of one partition into
+// the last of them and returns the number of bytes reclaimed. The merged
+// segment keeps an id below the current segment of the partition, so its
+// records still replay before the newer ones.
+func (db *Db) compactSegments(ids []int) (int64, error) {
+	target := ids[len(ids)-1]
+
+	var (
+		oldSize, oldRecords, oldTombstones int
+		live                               []hintRecord
+		sources                            []int
+	)
+	deleted := make(map[string]bool)
+	for _, id := range ids {
+		records, err := db.loadSegmentHints(id)
+		if err != nil {
+			return 0, err
+		}
+		info, err := os.Stat(db.segmentPath(id))
+		if err != nil {
+			return 0, err
+		}
+		oldSize += int(info.Size())
+		oldRecords += len(records)
+		for _, r := range records {
+			if r.deleted {
+				oldTombstones++
+				if _, ok := db.index.get(r.key); !ok && !deleted[r.key] {
+					deleted[r.key] = true
+					live = append(live, r)
+					sources = append(sources, id)
+				}
+				continue
+			}
+			ref, ok := db.index.lookup(r.key)
+			if ok && ref.segmentId == id && ref.offset == r.offset {
+				live = append(live, r)
+				sources = append(sources, id)
+			}
+		}
+	}
+
+	live, sources, evicted, err := db.evict(db.segmentPartition(target), live, sources)
+	if err != nil {
+		return 0, err
+	}
+	hints, err := db.writeCompacted(target, live, sources)
+	if err != nil {
+		return 0, err
+	}
+
+	path := db.segmentPath(target)
+	hintPath := path + hintFileSuffix
+	if err := os.Remove(hintPath); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return 0, err
+	}
+	db.swapGen.Add(1)
+	defer db.swapGen.Add(1)
+	if err := os.Rename(path+compactFileSuffix, path); err != nil {
+		return 0, err
+	}
+	newSize := int64(0)
+	kept := 0
+	for i, h := range hints {
+		newSize += int64(h.size)
+		if h.deleted {
+			kept++
+			continue
+		}
+		old := segmentRef{segmentId: sources[i], offset: live[i].offset, valueSize: h.valueSize}
+		db.index.replace(h.key, old, segmentRef{segmentId: target, offset: h.offset, valueSize: h.valueSize})
+	}
+	for _, e := range evicted {
+		if db.index.removeIf(e.key, e.ref) {
+			db.values.remove(e.key)
+		}
+	}
+	if len(evicted) > 0 {
+		db.logger.Debug("datastore: evicted keys over the size limit", "segment", target, "keys", len(evicted))
+	}
+	if err := writeHintFile(hintPath, newSize, hints, db.modes); err != nil {
+		return 0, err
+	}
+
+	// Dropping the handles and removing the files under mu keeps readers from
+	// reopening a removed segment.
+	var stale []segmentReader
+	db.mu.Lock()
+	for _, id := range ids {
+		if f, ok := db.segments[id]; ok {
+			stale = append(stale, f)
+			delete(db.segments, id)
+		}
+		delete(db.recordCounts, id)
+		if id == target {
+			continue
+		}
+		path := db.segmentPath(id)
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			db.mu.Unlock()
+			return 0, err
+		}
+		_ = os.Remove(path + hintFileSuffix)
+	}
+	db.recordCounts[target] = len(hints)
+	db.records += len(hints) - oldRecords
+	db.tombstones += kept - oldTombstones
+	db.mu.Unlock()
+
+	for _, f := range stale {
+		_ = f.Close()
+	}
+	return int64(oldSize) - newSize, nil
+}
+
+// writeCompacted copies the given records, unchanged, into the temporary
+// file of the merged segment and returns their hints in the new file. A
+// record with a negative source is written as a new tombstone of its key.
+func (db *Db) writeCompacted(target int, records []hintRecord, sources []int) ([]hintRecord, error) {
+	path := db.segmentPath(target) + compactFileSuffix
+	out, err := db.modes.openFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY)
+	if err != nil {
+		return nil, err
+	}
+	defer out.Close()
+
+	hints := make([]hintRecord, 0, len(records))
+	offset := int64(0)
+	var buf []byte
+	for i, r := range records {
+		data, err := db.compactedRecord(r, sources[i], &buf)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := out.Write(data); err != nil {
+			return nil, err
+		}
+		h := r
+		h.offset = offset
+		h.size = len(data)
+		hints = append(hints, h)
+		offset += int64(len(data))
+	}
+	if err := out.Sync(); err != nil {
+		return nil, err
+	}
+	return hints, out.Close()
+}
+
+func (db *Db) compactedRecord(r hintRecord, source int, buf *[]byte) ([]byte, error) {
+	if source < 0 {
+		return db.encodeEntry(entry{key: r.key, deleted: true})
+	}
+	f, err := db.segmentFile(source)
+	if err != nil {
+		return nil, err
+	}
+	if cap(*buf) < r.size {
+		*buf = make([]byte, r.size)
+	}
+	*buf = (*buf)[:r.size]
+	if _, err := f.ReadAt(*buf, r.offset); err != nil {
+		return nil, err
+	}
+	if isChunkHead(*buf) {
+		// The chunks of a value are merged into one record, as the merged
+		// segment need not respect the segment limit.
+		var head entry
+		if err := head.decodeStored(*buf); err != nil {
+			return nil, err
+		}
+		if err := db.assembleChunks(&head); err != nil {
+			return nil, err
+		}
+		return head.Encode(), nil
+	}
+	return *buf, nil
+}
+
+// sealedSegments returns the ids of the read-only segments in ascending
+// order.
+func (db *Db) sealedSegments() ([]int, error) {
+	segments, err := listSegments(db.fsys)
+	if err != nil {
+		return nil, err
+	}
+	var ids []int
+	db.mu.RLock()
+	for _, s := range segments {
+		p := db.segmentPartition(s.id)
+		if s.id < p.segmentId && (p.pinned == 0 || s.id < p.pinned) {
+			ids = append(ids, s.id)
+		}
+	}
+	db.mu.RUnlock()
+	return ids, nil
+}
+
+// compactor runs Compact whenever the writer seals a segment and there are
+// more than compactAfter read-only segments.
+func (db *Db) compactor() {
+	defer db.wg.Done()
+	for {
+		select {
+		case <-db.closeCh:
+			return
+		case <-db.compactCh:
+			ids, err := db.sealedSegments()
+			if err == nil && len(ids) > db.compactAfter {
+				// There is nobody to report a failure to; the next sealed
+				// segment triggers another attempt.
+				_ = db.Compact()
+			}
+		}
+	}
+}
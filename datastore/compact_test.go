@@ -0,0 +1,216 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDb_Compact(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := OpenWithLimit(tmp, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for round := 0; round < 5; round++ {
+		for i := 0; i < 10; i++ {
+			if err := db.Put(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d-%d", i, round)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	if err := db.Delete("key-0"); err != nil {
+		t.Fatal(err)
+	}
+	before, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	after, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if after.Segments >= before.Segments || after.DiskBytes >= before.DiskBytes {
+		t.Errorf("compaction did not shrink the store: before %+v, after %+v", before, after)
+	}
+	if after.LastCompaction.IsZero() || after.LastReclaimedBytes <= 0 {
+		t.Errorf("compaction not reported in stats: %+v", after)
+	}
+
+	check := func(db *Db) {
+		t.Helper()
+		if _, err := db.Get("key-0"); err != ErrNotFound {
+			t.Errorf("Get(key-0) error = %v, want ErrNotFound", err)
+		}
+		for i := 1; i < 10; i++ {
+			key, want := fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d-4", i)
+			if got, err := db.Get(key); err != nil || got != want {
+				t.Errorf("Get(%s) = %q, %v; want %q", key, got, err, want)
+			}
+		}
+	}
+	check(db)
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenWithLimit(tmp, 500)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(db)
+}
+
+func TestDb_CompactConcurrentReads(t *testing.T) {
+	db, err := OpenWithLimit(t.TempDir(), 256)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const count = 20
+	for round := 0; round < 3; round++ {
+		for i := 0; i < count; i++ {
+			if err := db.Put(fmt.Sprintf("key-%d", i), strings.Repeat("v", 10)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	stop := make(chan struct{})
+	var wg sync.WaitGroup
+	for r := 0; r < 4; r++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; ; i++ {
+				select {
+				case <-stop:
+					return
+				default:
+				}
+				key := fmt.Sprintf("key-%d", i%count)
+				if _, err := db.Get(key); err != nil {
+					t.Errorf("Get(%s) during compaction: %v", key, err)
+					return
+				}
+			}
+		}()
+	}
+	for i := 0; i < 5; i++ {
+		if err := db.Put(fmt.Sprintf("key-%d", i), strings.Repeat("w", 80)); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Compact(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	close(stop)
+	wg.Wait()
+}
+
+func TestDb_CompactAfterSegments(t *testing.T) {
+	db, err := OpenWithLimit(t.TempDir(), 100, CompactAfterSegments(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 100; i++ {
+		if err := db.Put("key", fmt.Sprintf("value-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		st, err := db.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !st.LastCompaction.IsZero() && st.Segments <= 5 {
+			break
+		}
+		if time.Now().After(deadline) {
+			t.Fatalf("background compaction did not run: %+v", st)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	if got, err := db.Get("key"); err != nil || got != "value-99" {
+		t.Errorf("Get() = %q, %v", got, err)
+	}
+}
+
+func TestDb_CompactClosed(t *testing.T) {
+	db, err := Open(t.TempDir(), CompactAfterSegments(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(); err != ErrClosed {
+		t.Errorf("Compact() after Close: %v, want ErrClosed", err)
+	}
+}
+
+func TestDb_MaxBytes(t *testing.T) {
+	tmp := t.TempDir()
+	value := strings.Repeat("v", 100)
+	const limit = 3000
+	db, err := OpenWithLimit(tmp, 500, WithMaxBytes(limit))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 60; i++ {
+		if err := db.Put(fmt.Sprintf("key-%02d", i), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(db *Db) {
+		t.Helper()
+		if _, err := db.Get("key-00"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get(key-00) error = %v, want ErrNotFound for an evicted key", err)
+		}
+		if got, err := db.Get("key-59"); err != nil || got != value {
+			t.Errorf("Get(key-59) = %q, %v", got, err)
+		}
+		keys := db.Keys()
+		sort.Strings(keys)
+		if len(keys) == 0 || len(keys) == 60 {
+			t.Fatalf("Expected some keys to be evicted, %d left", len(keys))
+		}
+		// The survivors are the most recently written keys.
+		if first := fmt.Sprintf("key-%02d", 60-len(keys)); keys[0] != first {
+			t.Errorf("Oldest surviving key is %s, want %s", keys[0], first)
+		}
+		if st, _ := db.Stats(); st.DiskBytes > limit {
+			t.Errorf("Store takes %d bytes, limit %d", st.DiskBytes, limit)
+		}
+	}
+	check(db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenWithLimit(tmp, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(db)
+}
@@ -2,14 +2,24 @@ package datastore
 
 import (
 	"bufio"
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"encoding/binary"
 	"errors"
 	"fmt"
 	"io"
+	"io/fs"
+	"log/slog"
 	"os"
 	"path/filepath"
+	"runtime"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 )
 
 const (
@@ -17,238 +27,1478 @@ const (
 	defaultMaxSegmentSize = int64(10 * 1024 * 1024) // 10 MB
 )
 
-var ErrNotFound = fmt.Errorf("record does not exist")
-
-type hashIndex map[string]segmentRef
+var (
+	ErrNotFound = fmt.Errorf("record does not exist")
+	ErrClosed   = errors.New("database is closed")
+	// ErrSegmentMissing is returned by Get when the index points into a
+	// segment file that no longer exists, e.g. because it was deleted by hand.
+	ErrSegmentMissing = errors.New("segment file is missing")
+	ErrReadOnly       = errors.New("database is opened read-only")
+	// ErrValueTooLarge is returned when a single record would not fit in an
+	// empty segment.
+	ErrValueTooLarge = errors.New("value does not fit in a segment")
+	// ErrEmptyKey is returned by writes of an empty key. Empty values are
+	// valid and are returned by Get as such.
+	ErrEmptyKey = errors.New("key is empty")
+	// ErrNotInteger is returned by Increment when the stored value is not a
+	// decimal integer.
+	ErrNotInteger = errors.New("value is not an integer")
+)
 
 type segmentRef struct {
 	segmentId int
 	offset    int64
+	valueSize int
+}
+
+type KV struct {
+	Key   string
+	Value string
+}
+
+// RecordMeta describes the stored record of a key, as returned by
+// GetWithMetadata.
+type RecordMeta struct {
+	SegmentID int
+	Offset    int64
+	// Size is the length of the encoded record, header and checksum
+	// included.
+	Size         int
+	ChecksumAlgo Checksum
+	Checksum     []byte
+	// Modified is when the record was written, or zero for records written
+	// before write times were stored.
+	Modified time.Time
+}
+
+// Location identifies where a record was written.
+type Location struct {
+	SegmentID int
+	Offset    int64
 }
 
 type writeRequest struct {
-	key   string
-	value string
-	done  chan error
+	entries []entry
+	// flush asks the writer to fsync the current segment. It is sent by
+	// Flush instead of entries.
+	flush bool
+	// prepare, when set, builds the entries in the writer, so that it sees
+	// every earlier write of the partition. Returning no entries writes
+	// nothing.
+	prepare func() ([]entry, error)
+	// pause stops the writer until it is closed. The request is answered
+	// first, so the sender knows the writer is idle.
+	pause chan struct{}
+	done  chan writeResult
+}
+
+type writeResult struct {
+	refs []segmentRef
+	err  error
 }
 
 type Db struct {
-	dir              string
-	segmentLimit     int64
-	currentSegment   *os.File
-	currentSegmentId int
-	currentOffset    int64
+	dir            string
+	fsys           fs.FS
+	segmentLimit   int64
+	segmentRecords int
+	checksum       Checksum
+	compressMin    int
+	aead           cipher.AEAD
+	syncPolicy     SyncPolicy
+	syncWrites     bool
+	recoveryBytes  int64
+	recordCounts   map[int]int // records in each sealed segment
+	records        int
+	tombstones     int
+	compactAfter   int
+	maxBytes       int64
+	readOnly       bool
+	shardedLayout  bool
+	metrics        MetricsSink
+	logger         *slog.Logger
+	lastCompaction time.Time
+	lastReclaimed  int64
+
+	index      *hashIndex
+	values     *valueCache
+	segments   map[int]segmentReader
+	mu         sync.RWMutex
+	partitions []*partition
+	closeCh    chan struct{}
+
+	compactCh chan struct{}
+	compactMu sync.Mutex
+	swapGen   atomic.Uint64 // odd while compaction swaps segment files
+	modified  atomic.Int64  // write time of the last record, see now
+	clock     func() time.Time
+
+	chunkValues bool
+	skipVerify  bool
+	modes       fileModes
+	changes     changeFeed
 
-	index   hashIndex
-	mu      sync.RWMutex
-	writeCh chan writeRequest
-	closeCh chan struct{}
-	wg      sync.WaitGroup
+	closed atomic.Bool
+	wg     sync.WaitGroup
+	lock   *os.File // see lockDir
 }
 
-func Open(dir string) (*Db, error) {
-	return OpenWithLimit(dir, defaultMaxSegmentSize)
+// Open opens the store in dir, creating its first segment if dir holds
+// none. See the Option functions for the settings.
+func Open(dir string, opts ...Option) (*Db, error) {
+	root := dir
+	if root == "" {
+		root = "."
+	}
+	return open(dir, os.DirFS(root), opts)
+}
+
+// OpenReadOnly opens dir for reading only. Put, Delete and Compact return
+// ErrReadOnly, no writer is started and no file in dir is modified, so any
+// number of read-only instances can share a directory. The index reflects
+// the segments as they were when OpenReadOnly returned.
+func OpenReadOnly(dir string, opts ...Option) (*Db, error) {
+	return Open(dir, append(opts, WithReadOnly())...)
+}
+
+// OpenFS opens a store read from fsys, such as an embedded or archived
+// copy of a store directory. It works like OpenReadOnly: writes return
+// ErrReadOnly and no writer is started. Segment files must implement
+// io.ReaderAt.
+func OpenFS(fsys fs.FS, opts ...Option) (*Db, error) {
+	return open("", fsys, append(opts, WithReadOnly()))
+}
+
+// OpenWithLimit is Open with WithSegmentLimit(segmentLimit), which takes
+// precedence over a limit in opts.
+func OpenWithLimit(dir string, segmentLimit int64, opts ...Option) (*Db, error) {
+	return Open(dir, append(opts, WithSegmentLimit(segmentLimit))...)
 }
 
-func OpenWithLimit(dir string, segmentLimit int64) (*Db, error) {
+func open(dir string, fsys fs.FS, opts []Option) (*Db, error) {
+	o := defaultOptions()
+	for _, opt := range opts {
+		opt(&o)
+	}
+	if o.checksum.size() == 0 {
+		return nil, fmt.Errorf("unknown checksum algorithm %d", o.checksum)
+	}
+	if minLimit := int64(len((&entry{checksum: o.checksum, modified: 1}).Encode())); o.segmentLimit < minLimit {
+		return nil, fmt.Errorf("segment limit %d is smaller than an empty record (%d bytes)", o.segmentLimit, minLimit)
+	}
+
+	if o.writeBuffer < 0 {
+		return nil, fmt.Errorf("negative write buffer size %d", o.writeBuffer)
+	}
+	if o.writers < 1 {
+		return nil, fmt.Errorf("invalid number of writers %d", o.writers)
+	}
+	if o.warmupMax > 0 && o.cacheBytes <= 0 {
+		return nil, errors.New("warm-up needs a value cache")
+	}
+	if o.syncWrites && o.syncPolicy.interval > 0 {
+		return nil, errors.New("synchronous writes cannot use an interval sync policy")
+	}
+
+	var aead cipher.AEAD
+	if o.encryptKey != nil {
+		if len(o.encryptKey) != 32 {
+			return nil, fmt.Errorf("encryption key must be 32 bytes, got %d", len(o.encryptKey))
+		}
+		block, err := aes.NewCipher(o.encryptKey)
+		if err != nil {
+			return nil, err
+		}
+		if aead, err = cipher.NewGCM(block); err != nil {
+			return nil, err
+		}
+	}
+
 	db := &Db{
-		dir:          dir,
-		segmentLimit: segmentLimit,
-		index:        make(hashIndex),
-		writeCh:      make(chan writeRequest, 100),
-		closeCh:      make(chan struct{}),
+		dir:            dir,
+		fsys:           fsys,
+		segmentLimit:   o.segmentLimit,
+		segmentRecords: o.segmentRecords,
+		checksum:       o.checksum,
+		compressMin:    o.compressMin,
+		aead:           aead,
+		compactAfter:   o.compactAt,
+		maxBytes:       o.maxBytes,
+		readOnly:       o.readOnly,
+		shardedLayout:  o.shardedLayout,
+		metrics:        o.metrics,
+		logger:         o.logger,
+		syncPolicy:     o.syncPolicy,
+		syncWrites:     o.syncWrites,
+		clock:          o.clock,
+		chunkValues:    o.chunkValues,
+		skipVerify:     o.skipVerify,
+		modes:          o.modes,
+		index:          newHashIndex(o.indexShards),
+		values:         newValueCache(o.cacheBytes),
+		segments:       make(map[int]segmentReader),
+		recordCounts:   make(map[int]int),
+		closeCh:        make(chan struct{}),
+		compactCh:      make(chan struct{}, 1),
+	}
+	for i := 0; i < o.writers; i++ {
+		db.partitions = append(db.partitions, &partition{
+			id:      i,
+			writeCh: make(chan writeRequest, o.writeBuffer),
+			stopped: make(chan struct{}),
+		})
+	}
+	if o.hashedKeys {
+		db.index.hashKeys(db.keyAt)
 	}
 
+	// Read-only instances modify nothing, so they do not need the lock.
+	if !db.readOnly {
+		lock, err := lockDir(dir, o.modes)
+		if err != nil {
+			return nil, err
+		}
+		db.lock = lock
+	}
 	if err := db.loadSegments(); err != nil {
+		db.unlock()
 		return nil, err
 	}
+	if o.warmupMax > 0 {
+		db.warmup(o.warmupPrefix, o.warmupMax, o.warmupTimeout)
+	}
+	if o.scrubInterval > 0 {
+		db.wg.Add(1)
+		go db.scrubber(o.scrubInterval, o.onCorruption)
+	}
+	if db.readOnly {
+		return db, nil
+	}
 
-	db.wg.Add(1)
-	go db.writer()
+	if !db.syncWrites {
+		for _, p := range db.partitions {
+			db.wg.Add(1)
+			go db.writer(p)
+		}
+	}
+	if db.compactAfter > 0 {
+		db.wg.Add(1)
+		go db.compactor()
+	}
 
 	return db, nil
 }
 
-func (db *Db) writer() {
+func (db *Db) writer(p *partition) {
 	defer db.wg.Done()
+	defer close(p.stopped)
+
+	var tick <-chan time.Time
+	if db.syncPolicy.interval > 0 {
+		ticker := time.NewTicker(db.syncPolicy.interval)
+		defer ticker.Stop()
+		tick = ticker.C
+	}
+
+	dirty := false
 	for {
 		select {
-		case req := <-db.writeCh:
-			err := db.writeEntry(req.key, req.value)
-			req.done <- err
+		case req := <-p.writeCh:
+			res := db.handleWrite(p, req)
+			if req.flush {
+				dirty = dirty && res.err != nil
+			} else {
+				dirty = dirty || res.err == nil
+			}
+			req.done <- res
+			if req.pause != nil {
+				<-req.pause
+			}
+		case <-tick:
+			if dirty {
+				// There is no caller waiting for a background sync, so a failure
+				// is reported to the next write instead.
+				p.syncErr = p.segment.Sync()
+				dirty = false
+			}
 		case <-db.closeCh:
-			return
+			// Requests queued before Close are still applied.
+			for {
+				select {
+				case req := <-p.writeCh:
+					req.done <- db.handleWrite(p, req)
+					if req.pause != nil {
+						<-req.pause
+					}
+				default:
+					return
+				}
+			}
 		}
 	}
 }
 
-func (db *Db) writeEntry(key, value string) error {
-	e := entry{key: key, value: value}
-	data := e.Encode()
+func (db *Db) handleWrite(p *partition, req writeRequest) writeResult {
+	var res writeResult
+	if req.pause != nil {
+		return res
+	}
+	res.err, p.syncErr = p.syncErr, nil
+	if res.err == nil && req.flush {
+		res.err = p.segment.Sync()
+		return res
+	}
+	entries := req.entries
+	if res.err == nil && req.prepare != nil {
+		entries, res.err = req.prepare()
+		if res.err == nil && len(entries) == 0 {
+			return res
+		}
+	}
+	if res.err == nil {
+		res.refs, res.err = db.writeEntries(p, entries)
+	}
+	if res.err == nil && db.syncPolicy.everyWrite {
+		res.err = p.segment.Sync()
+	}
+	return res
+}
 
-	if db.currentOffset+int64(len(data)) > db.segmentLimit {
-		if err := db.currentSegment.Close(); err != nil {
-			return err
+func (db *Db) writeEntries(p *partition, entries []entry) ([]segmentRef, error) {
+	refs, err := db.appendEntries(p, entries)
+	if err != nil {
+		return nil, err
+	}
+	db.publish(entries, refs)
+	return refs, nil
+}
+
+// appendEntries writes entries to the segments of p without making them
+// visible to readers.
+func (db *Db) appendEntries(p *partition, entries []entry) ([]segmentRef, error) {
+	refs := make([]segmentRef, 0, len(entries))
+	var (
+		buf   []byte
+		hints []hintRecord
+	)
+	write := func() error {
+		if len(buf) == 0 {
+			return nil
+		}
+		n, err := p.segment.Write(buf)
+		db.mu.Lock()
+		p.offset += int64(n)
+		if err == nil {
+			p.hints = append(p.hints, hints...)
 		}
-		if err := db.createNewSegment(); err != nil {
+		db.mu.Unlock()
+		if err != nil {
 			return err
 		}
+		buf, hints = buf[:0], hints[:0]
+		return nil
 	}
 
-	n, err := db.currentSegment.Write(data)
-	if err != nil {
-		return err
+	// Encode the whole batch first so that an oversized entry rejects it
+	// before anything is written.
+	encoded := make([][]byte, len(entries))
+	chunked := make([]*chunkedValue, len(entries))
+	for i, e := range entries {
+		e.modified = db.now()
+		sealed, err := db.sealEntry(e)
+		if err != nil {
+			return nil, err
+		}
+		data := sealed.Encode()
+		if int64(len(data)) > db.segmentLimit {
+			if chunked[i] = db.splitValue(sealed, len(e.value)); chunked[i] == nil {
+				return nil, fmt.Errorf("%w: record for %q takes %d bytes", ErrValueTooLarge, e.key, len(data))
+			}
+			continue
+		}
+		encoded[i] = data
 	}
 
-	db.mu.Lock()
-	db.index[key] = segmentRef{
-		segmentId: db.currentSegmentId,
-		offset:    db.currentOffset,
+	offset := p.offset
+	// inChain is set while the chunks of a value are placed; rolling over
+	// then keeps the segments of the chain from being compacted.
+	inChain := false
+	// place makes room for a record of size bytes, rolling over to a new
+	// segment if needed, and returns its offset.
+	place := func(size int) (int64, error) {
+		full := db.segmentRecords > 0 && len(p.hints)+len(hints) >= db.segmentRecords
+		if !full && offset+int64(size) <= db.segmentLimit {
+			return offset, nil
+		}
+		if err := write(); err != nil {
+			return 0, err
+		}
+		sealed := p.segmentId
+		if err := db.sealSegment(p, offset); err != nil {
+			return 0, err
+		}
+		if err := db.createNewSegment(p); err != nil {
+			return 0, err
+		}
+		if !inChain {
+			// Every chain with its first chunk in the sealed segment is
+			// complete now.
+			db.mu.Lock()
+			p.pinned = 0
+			db.mu.Unlock()
+		}
+		db.logger.Debug("datastore: segment rolled over", "sealed", sealed, "size", offset, "segment", p.segmentId)
+		offset = 0
+		select {
+		case db.compactCh <- struct{}{}:
+		default:
+		}
+		return offset, nil
+	}
+	add := func(key string, data []byte, valueSize int, deleted bool) (int64, error) {
+		at, err := place(len(data))
+		if err != nil {
+			return 0, err
+		}
+		hints = append(hints, hintRecord{
+			key:       key,
+			offset:    at,
+			size:      len(data),
+			valueSize: valueSize,
+			deleted:   deleted,
+		})
+		buf = append(buf, data...)
+		offset += int64(len(data))
+		return at, nil
+	}
+
+	// addChunks writes the chunks of c last to first and returns the offset
+	// of the first. Until a rollover seals its segment, the first chunk is
+	// in the current segment, which is never compacted, while the others
+	// may already be sealed; pinned keeps them from being compacted, too.
+	addChunks := func(c *chunkedValue) (int64, error) {
+		var next chunkLink
+		start := 0
+		for j := len(c.parts) - 1; j >= 0; j-- {
+			chunk := c.chunk(j, next, start)
+			at, err := add(chunk.key, chunk.Encode(), chunk.chunk.valueSize, false)
+			if err != nil {
+				return 0, err
+			}
+			if start == 0 {
+				start = p.segmentId
+				inChain = true
+				db.mu.Lock()
+				if p.pinned == 0 || start < p.pinned {
+					p.pinned = start
+				}
+				db.mu.Unlock()
+			}
+			next = chunkLink{nextSegment: p.segmentId, nextOffset: at}
+		}
+		inChain = false
+		return next.nextOffset, nil
+	}
+
+	for i, e := range entries {
+		valueSize := len(e.value)
+		var at int64
+		var err error
+		if c := chunked[i]; c != nil {
+			at, err = addChunks(c)
+		} else {
+			at, err = add(e.key, encoded[i], valueSize, e.deleted)
+		}
+		if err != nil {
+			return nil, err
+		}
+		refs = append(refs, segmentRef{
+			segmentId: p.segmentId,
+			offset:    at,
+			valueSize: valueSize,
+		})
+	}
+	if err := write(); err != nil {
+		return nil, err
 	}
-	db.currentOffset += int64(n)
+	return refs, nil
+}
+
+// publish points the index at the refs entries were written to, all at
+// once.
+func (db *Db) publish(entries []entry, refs []segmentRef) {
+	updates := make([]indexUpdate, len(entries))
+	tombstones := 0
+	for i, e := range entries {
+		updates[i].key = e.key
+		if e.deleted {
+			tombstones++
+		} else {
+			updates[i].ref = &refs[i]
+		}
+	}
+	db.index.apply(updates)
+	for _, e := range entries {
+		db.values.remove(e.key)
+	}
+
+	db.mu.Lock()
+	db.tombstones += tombstones
+	db.records += len(entries)
 	db.mu.Unlock()
+	db.changes.notify(entries, refs)
+}
 
-	return nil
+// now returns the write time for a new record in Unix nanoseconds. It
+// never repeats or goes back, even if the wall clock does, so the records of
+// a key are ordered by it.
+func (db *Db) now() int64 {
+	for {
+		last := db.modified.Load()
+		t := db.clock().UnixNano()
+		if t <= last {
+			t = last + 1
+		}
+		if db.modified.CompareAndSwap(last, t) {
+			return t
+		}
+	}
+}
+
+// encodeEntry applies the configured compression and encryption to e and
+// returns its on-disk record.
+func (db *Db) encodeEntry(e entry) ([]byte, error) {
+	e, err := db.sealEntry(e)
+	if err != nil {
+		return nil, err
+	}
+	return e.Encode(), nil
+}
+
+// sealEntry returns e with the configured compression and encryption
+// applied to its value.
+func (db *Db) sealEntry(e entry) (entry, error) {
+	e.checksum = db.checksum
+	if db.compressMin > 0 && len(e.value) >= db.compressMin && !e.deleted {
+		compressed, err := deflate(e.value)
+		if err != nil {
+			return entry{}, err
+		}
+		if len(compressed) < len(e.value) {
+			e.value, e.compressed = compressed, true
+		}
+	}
+	if db.aead != nil && !e.deleted {
+		sealed, err := sealValue(db.aead, e.key, e.value)
+		if err != nil {
+			return entry{}, err
+		}
+		e.value, e.encrypted = sealed, true
+	}
+	return e, nil
 }
 
 func (db *Db) Put(key, value string) error {
-	req := writeRequest{
-		key:   key,
-		value: value,
-		done:  make(chan error),
+	return db.PutContext(context.Background(), key, value)
+}
+
+// PutContext is like Put but gives up waiting for the writer once ctx is
+// done. A cancelled write may still be applied if the writer has already
+// picked it up.
+func (db *Db) PutContext(ctx context.Context, key, value string) error {
+	_, err := db.write(ctx, []entry{{key: key, value: []byte(value)}})
+	return err
+}
+
+// PutLocated is like Put but also reports where the record was written.
+func (db *Db) PutLocated(key, value string) (Location, error) {
+	refs, err := db.write(context.Background(), []entry{{key: key, value: []byte(value)}})
+	if err != nil {
+		return Location{}, err
 	}
-	db.writeCh <- req
-	return <-req.done
+	return Location{SegmentID: refs[0].segmentId, Offset: refs[0].offset}, nil
 }
 
-func (db *Db) Get(key string) (string, error) {
-	db.mu.RLock()
-	ref, ok := db.index[key]
-	db.mu.RUnlock()
-	if !ok {
-		return "", ErrNotFound
+// PutBytes stores an arbitrary byte value. The slice is not copied and must
+// not be modified until PutBytes returns.
+func (db *Db) PutBytes(key string, value []byte) error {
+	_, err := db.write(context.Background(), []entry{{key: key, value: value}})
+	return err
+}
+
+// PutBatch writes all pairs with a single request to the writer. Entries are
+// appended in order, so a key repeated in pairs ends up with its last value.
+// The batch is applied as a whole or not at all, also with several writers.
+func (db *Db) PutBatch(pairs []KV) error {
+	if len(pairs) == 0 {
+		return nil
+	}
+	entries := make([]entry, len(pairs))
+	for i, p := range pairs {
+		entries[i] = entry{key: p.Key, value: []byte(p.Value)}
+	}
+	_, err := db.write(context.Background(), entries)
+	return err
+}
+
+// Delete removes key by appending a tombstone record. It returns ErrNotFound
+// when the key is not stored.
+func (db *Db) Delete(key string) error {
+	if db.readOnly {
+		return ErrReadOnly
+	}
+	if key == "" {
+		return ErrEmptyKey
+	}
+	if _, ok := db.index.get(key); !ok {
+		if db.closed.Load() {
+			return ErrClosed
+		}
+		return ErrNotFound
+	}
+	_, err := db.write(context.Background(), []entry{{key: key, deleted: true}})
+	return err
+}
+
+func (db *Db) write(ctx context.Context, entries []entry) ([]segmentRef, error) {
+	for _, e := range entries {
+		if e.key == "" {
+			return nil, ErrEmptyKey
+		}
+	}
+	refs, err := db.submitEntries(ctx, entries)
+	if err == nil {
+		db.observePuts(entries)
 	}
-	path := filepath.Join(db.dir, segmentFilename(ref.segmentId))
-	f, err := os.Open(path)
+	return refs, err
+}
+
+func (db *Db) observePuts(entries []entry) {
+	for _, e := range entries {
+		if !e.deleted {
+			db.metrics.IncPuts()
+			db.metrics.ObserveValueSize(len(e.value))
+		}
+	}
+}
+
+// PutIfAbsent stores value only if key is not stored yet and reports whether
+// it did. Like Increment it is evaluated by the writer of the key, so of
+// several concurrent calls for the same key exactly one succeeds.
+func (db *Db) PutIfAbsent(key, value string) (bool, error) {
+	if key == "" {
+		return false, ErrEmptyKey
+	}
+	var written []entry
+	_, err := db.submit(context.Background(), db.partitionOf(key), writeRequest{prepare: func() ([]entry, error) {
+		if _, ok := db.index.get(key); ok {
+			return nil, nil
+		}
+		written = []entry{{key: key, value: []byte(value)}}
+		return written, nil
+	}})
 	if err != nil {
-		return "", err
+		return false, err
 	}
-	defer f.Close()
+	db.observePuts(written)
+	return written != nil, nil
+}
 
-	_, err = f.Seek(ref.offset, io.SeekStart)
+// Increment adds delta to the integer stored under key and returns the new
+// value. A missing key counts as 0. The update is evaluated by the writer of
+// the key, so it does not interleave with other writes of the same key. A
+// value that is not a decimal int64 fails with ErrNotInteger.
+func (db *Db) Increment(key string, delta int64) (int64, error) {
+	if key == "" {
+		return 0, ErrEmptyKey
+	}
+	var (
+		result  int64
+		written []entry
+	)
+	_, err := db.submit(context.Background(), db.partitionOf(key), writeRequest{prepare: func() ([]entry, error) {
+		current := int64(0)
+		record, _, err := db.getRecord(key)
+		switch {
+		case errors.Is(err, ErrNotFound):
+		case err != nil:
+			return nil, err
+		default:
+			if current, err = strconv.ParseInt(string(record.value), 10, 64); err != nil {
+				return nil, fmt.Errorf("%w: %q holds %q", ErrNotInteger, key, record.value)
+			}
+		}
+		result = current + delta
+		written = []entry{{key: key, value: []byte(strconv.FormatInt(result, 10))}}
+		return written, nil
+	}})
 	if err != nil {
-		return "", err
+		return 0, err
+	}
+	db.observePuts(written)
+	return result, nil
+}
+
+// Append adds suffix to the end of the value of key and returns the length
+// of the new value in bytes. A missing key starts from an empty value. Like
+// Increment, the update is evaluated by the writer of the key, so concurrent
+// appends to a key never lose one another.
+func (db *Db) Append(key, suffix string) (int, error) {
+	if key == "" {
+		return 0, ErrEmptyKey
+	}
+	var written []entry
+	_, err := db.submit(context.Background(), db.partitionOf(key), writeRequest{prepare: func() ([]entry, error) {
+		record, _, err := db.getRecord(key)
+		if err != nil && !errors.Is(err, ErrNotFound) {
+			return nil, err
+		}
+		value := make([]byte, 0, len(record.value)+len(suffix))
+		value = append(append(value, record.value...), suffix...)
+		written = []entry{{key: key, value: value}}
+		return written, nil
+	}})
+	if err != nil {
+		return 0, err
 	}
+	db.observePuts(written)
+	return len(written[0].value), nil
+}
 
-	var record entry
-	if _, err := record.DecodeFromReader(bufio.NewReader(f)); err != nil {
-		if errors.Is(err, ErrCorrupted) {
-			return "", ErrCorrupted
+// Flush blocks until every write queued before the call has been applied
+// and the current segments are fsynced, whatever the sync policy.
+func (db *Db) Flush() error {
+	for _, p := range db.partitions {
+		if _, err := db.submit(context.Background(), p, writeRequest{flush: true}); err != nil {
+			return err
 		}
+	}
+	return nil
+}
+
+func (db *Db) submit(ctx context.Context, p *partition, req writeRequest) ([]segmentRef, error) {
+	if db.closed.Load() {
+		return nil, ErrClosed
+	}
+	if db.readOnly {
+		return nil, ErrReadOnly
+	}
+	if db.syncWrites {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		// Close takes the lock before closing the segment.
+		if db.closed.Load() {
+			return nil, ErrClosed
+		}
+		res := db.handleWrite(p, req)
+		return res.refs, res.err
+	}
+	req.done = make(chan writeResult, 1)
+	select {
+	case p.writeCh <- req:
+	case <-db.closeCh:
+		return nil, ErrClosed
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+	select {
+	case res := <-req.done:
+		return res.refs, res.err
+	case <-db.closeCh:
+		// The writer applies the requests queued before it saw Close, but
+		// a request that slipped in after its last look is never answered.
+		<-p.stopped
+		select {
+		case res := <-req.done:
+			return res.refs, res.err
+		default:
+			return nil, ErrClosed
+		}
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (db *Db) Get(key string) (string, error) {
+	return db.GetContext(context.Background(), key)
+}
+
+func (db *Db) GetContext(ctx context.Context, key string) (string, error) {
+	value, err := db.get(ctx, key)
+	if err != nil {
 		return "", err
 	}
+	return string(value), nil
+}
+
+// GetMany returns the values of all found keys. Missing keys are left out of
+// the result rather than failing the whole call.
+func (db *Db) GetMany(keys []string) (map[string]string, error) {
+	res := make(map[string]string, len(keys))
+	for _, key := range keys {
+		value, err := db.Get(key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("get %s: %w", key, err)
+		}
+		res[key] = value
+	}
+	return res, nil
+}
+
+// Exists reports whether key is stored and the size of its value, using
+// only the in-memory index.
+func (db *Db) Exists(key string) (bool, int, error) {
+	if db.closed.Load() {
+		return false, 0, ErrClosed
+	}
+	ref, ok := db.index.get(key)
+	return ok, ref.valueSize, nil
+}
+
+func (db *Db) GetBytes(key string) ([]byte, error) {
+	return db.get(context.Background(), key)
+}
+
+// GetWithMetadata is like Get but also reports where and how the value is
+// stored.
+func (db *Db) GetWithMetadata(key string) (string, RecordMeta, error) {
+	record, meta, err := db.read(context.Background(), key)
+	if err != nil {
+		return "", RecordMeta{}, err
+	}
+	return string(record.value), meta, nil
+}
+
+func (db *Db) get(ctx context.Context, key string) ([]byte, error) {
+	record, _, err := db.read(ctx, key)
+	if err != nil {
+		return nil, err
+	}
 	return record.value, nil
 }
 
+// read serves a Get: it checks the database is open and reports the lookup
+// to the metrics sink.
+func (db *Db) read(ctx context.Context, key string) (entry, RecordMeta, error) {
+	if err := ctx.Err(); err != nil {
+		return entry{}, RecordMeta{}, err
+	}
+	if db.closed.Load() {
+		return entry{}, RecordMeta{}, ErrClosed
+	}
+	record, meta, err := db.getRecord(key)
+	db.metrics.IncGets()
+	if errors.Is(err, ErrNotFound) {
+		db.metrics.IncGetMisses()
+	}
+	if errors.Is(err, ErrCorrupted) {
+		db.metrics.IncCorruptions()
+	}
+	return record, meta, err
+}
+
+// getRecord returns the latest record of key. Unlike read it is also used
+// by the writer, which may still run after Close.
+func (db *Db) getRecord(key string) (entry, RecordMeta, error) {
+	for {
+		// Compaction replaces segment files while readers hold no lock. A
+		// read that overlapped the swap may have paired a ref with the wrong
+		// file, so it is retried.
+		gen := db.swapGen.Load()
+		// readRecord checks the key, so the ref need not be verified here.
+		ref, ok := db.index.lookup(key)
+		if !ok {
+			return entry{}, RecordMeta{}, ErrNotFound
+		}
+		if record, meta, ok := db.values.get(key, ref); ok {
+			return record, meta, nil
+		}
+		record, n, err := db.readRecord(key, ref)
+		if gen%2 == 1 || db.swapGen.Load() != gen {
+			runtime.Gosched()
+			continue
+		}
+		if err != nil {
+			return entry{}, RecordMeta{}, err
+		}
+		meta := RecordMeta{
+			SegmentID:    ref.segmentId,
+			Offset:       ref.offset,
+			Size:         n,
+			ChecksumAlgo: record.checksum,
+			Checksum:     record.sum,
+		}
+		if record.modified != 0 {
+			meta.Modified = time.Unix(0, record.modified)
+		}
+		db.values.add(ref, record, meta, &db.swapGen, gen)
+		return record, meta, nil
+	}
+}
+
+// readRecord decodes the record ref points to and returns it with its
+// encoded size.
+func (db *Db) readRecord(key string, ref segmentRef) (entry, int, error) {
+	f, err := db.segmentFile(ref.segmentId)
+	if errors.Is(err, os.ErrNotExist) {
+		db.logger.Warn("datastore: key refers to a missing segment", "key", key, "segment", ref.segmentId)
+		return entry{}, 0, ErrSegmentMissing
+	}
+	if err != nil {
+		return entry{}, 0, err
+	}
+
+	// ReadAt does not move a shared file offset, so concurrent readers of the
+	// same segment need no lock once they hold the handle.
+	record := entry{aead: db.aead, skipVerify: db.skipVerify}
+	n, err := record.DecodeAt(f, ref.offset)
+	if err == nil && record.chunk != nil {
+		err = db.readChunked(&record)
+	}
+	if err == nil && record.key != key {
+		// With hashed keys, a key that is not stored can share the digest
+		// of one that is.
+		if db.index.hashed() {
+			return entry{}, 0, ErrNotFound
+		}
+		err = ErrCorrupted
+	}
+	if errors.Is(err, ErrCorrupted) {
+		db.logger.Error("datastore: corrupted record", "key", key, "segment", ref.segmentId, "offset", ref.offset)
+		return entry{}, 0, fmt.Errorf("%w: record of %q in segment %d at offset %d", ErrCorrupted, key, ref.segmentId, ref.offset)
+	}
+	if err != nil {
+		return entry{}, 0, err
+	}
+	return record, n, nil
+}
+
+// keyAt reads the key of the record ref points to, for an index with
+// hashed keys.
+func (db *Db) keyAt(ref segmentRef) (string, error) {
+	for {
+		gen := db.swapGen.Load()
+		f, err := db.segmentFile(ref.segmentId)
+		var record entry
+		if err == nil {
+			record = entry{aead: db.aead}
+			_, err = record.DecodeAt(f, ref.offset)
+		}
+		if gen%2 == 1 || db.swapGen.Load() != gen {
+			runtime.Gosched()
+			continue
+		}
+		return record.key, err
+	}
+}
+
+// Keys returns the keys currently stored in the database. The slice is a
+// snapshot of the index: writes made after the call returns are not
+// reflected in it. Index shards are copied one at a time, so a write racing
+// with Keys may be seen in some shards and not in others.
+func (db *Db) Keys() []string {
+	return db.index.keys(nil)
+}
+
+// KeysIter calls fn for every stored key until fn returns false. The keys
+// are taken from a snapshot of the index, so fn may safely call other Db
+// methods; concurrent writes made during the iteration are not reflected.
+func (db *Db) KeysIter(fn func(key string) bool) {
+	for _, key := range db.Keys() {
+		if !fn(key) {
+			return
+		}
+	}
+}
+
+// Scan returns all pairs whose key starts with prefix, in no particular
+// order. The index has no ordering, so every scan visits all keys: it costs
+// O(n) in the number of stored keys plus one read per matching value.
+func (db *Db) Scan(prefix string) ([]KV, error) {
+	keys := db.index.keys(func(key string) bool {
+		return strings.HasPrefix(key, prefix)
+	})
+
+	res := make([]KV, 0, len(keys))
+	for _, key := range keys {
+		value, err := db.Get(key)
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return nil, fmt.Errorf("scan %s: %w", key, err)
+		}
+		res = append(res, KV{Key: key, Value: value})
+	}
+	return res, nil
+}
+
+// ScanSorted is like Scan but returns the pairs sorted by key, which adds an
+// O(m log m) sort over the m matching keys.
+func (db *Db) ScanSorted(prefix string) ([]KV, error) {
+	res, err := db.Scan(prefix)
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(res, func(i, j int) bool {
+		return res[i].Key < res[j].Key
+	})
+	return res, nil
+}
+
+func (db *Db) segmentFile(id int) (segmentReader, error) {
+	db.mu.RLock()
+	f, ok := db.segments[id]
+	db.mu.RUnlock()
+	if ok {
+		return f, nil
+	}
+
+	db.mu.Lock()
+	defer db.mu.Unlock()
+	if f, ok := db.segments[id]; ok {
+		return f, nil
+	}
+	f, err := db.openSegment(id)
+	if err != nil {
+		return nil, err
+	}
+	db.segments[id] = f
+	return f, nil
+}
+
+// Close stops the writer and releases all files. Closing an already closed
+// database is a no-op.
 func (db *Db) Close() error {
+	if !db.closed.CompareAndSwap(false, true) {
+		return nil
+	}
 	close(db.closeCh)
 	db.wg.Wait()
-	if db.currentSegment != nil {
-		return db.currentSegment.Close()
+	db.changes.close()
+	// Wait for a Compact call made by the user to finish.
+	db.compactMu.Lock()
+	defer db.compactMu.Unlock()
+
+	var err error
+	db.mu.Lock()
+	for id, f := range db.segments {
+		if cerr := f.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+		delete(db.segments, id)
 	}
-	return nil
+	db.mu.Unlock()
+
+	for _, p := range db.partitions {
+		// Wait for a synchronous write in progress.
+		p.mu.Lock()
+		defer p.mu.Unlock()
+		if p.segment == nil {
+			continue
+		}
+		if db.syncPolicy != SyncNever {
+			if serr := p.segment.Sync(); serr != nil && err == nil {
+				err = serr
+			}
+		}
+		if cerr := p.segment.Close(); cerr != nil && err == nil {
+			err = cerr
+		}
+	}
+	if cerr := db.unlock(); cerr != nil && err == nil {
+		err = cerr
+	}
+	return err
 }
 
+// unlock releases the lock of the directory taken by Open.
+func (db *Db) unlock() error {
+	if db.lock == nil {
+		return nil
+	}
+	err := db.lock.Close()
+	db.lock = nil
+	return err
+}
+
+// Size returns the number of bytes in the current segment, summed over all
+// partitions.
 func (db *Db) Size() (int64, error) {
-	return db.currentOffset, nil
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	size := int64(0)
+	for _, p := range db.partitions {
+		size += p.offset
+	}
+	return size, nil
+}
+
+func (db *Db) sealSegment(p *partition, size int64) error {
+	if db.syncPolicy != SyncNever {
+		if err := p.segment.Sync(); err != nil {
+			return err
+		}
+	}
+	if err := p.segment.Close(); err != nil {
+		return err
+	}
+	db.mu.Lock()
+	hints := p.hints
+	p.hints = nil
+	db.recordCounts[p.segmentId] = len(hints)
+	db.mu.Unlock()
+	return writeHintFile(db.hintPath(p.segmentId), size, hints, db.modes)
+}
+
+type Stats struct {
+	Keys             int   `json:"keys"`
+	Segments         int   `json:"segments"`
+	CurrentSegmentID int   `json:"current_segment_id"`
+	CurrentOffset    int64 `json:"current_offset"`
+	DiskBytes        int64 `json:"disk_bytes"`
+	DeadRecords      int   `json:"dead_records"`
+	Tombstones       int   `json:"tombstones"`
+
+	LastCompaction     time.Time `json:"last_compaction"`
+	LastReclaimedBytes int64     `json:"last_reclaimed_bytes"`
+
+	// Value cache counters, zero without WithValueCache.
+	CacheHits   int64 `json:"cache_hits"`
+	CacheMisses int64 `json:"cache_misses"`
+	CacheBytes  int64 `json:"cache_bytes"`
+
+	// DroppedEvents counts the change events not delivered to subscribers
+	// that fell behind, see Subscribe.
+	DroppedEvents int64 `json:"dropped_events"`
+}
+
+// Stats reports the state of the index and the segment files on disk. With
+// several writers, CurrentSegmentID is the newest of the current segments
+// and CurrentOffset is their total size.
+func (db *Db) Stats() (Stats, error) {
+	keys := db.index.len()
+	db.mu.RLock()
+	st := Stats{
+		Keys:        keys,
+		DeadRecords: db.records - keys,
+		Tombstones:  db.tombstones,
+
+		LastCompaction:     db.lastCompaction,
+		LastReclaimedBytes: db.lastReclaimed,
+	}
+	for _, p := range db.partitions {
+		st.CurrentSegmentID = max(st.CurrentSegmentID, p.segmentId)
+		st.CurrentOffset += p.offset
+	}
+	db.mu.RUnlock()
+	st.CacheHits, st.CacheMisses, st.CacheBytes = db.values.stats()
+	st.DroppedEvents = db.changes.droppedEvents()
+
+	segments, err := listSegments(db.fsys)
+	if err != nil {
+		return Stats{}, err
+	}
+	for _, s := range segments {
+		st.Segments++
+		st.DiskBytes += s.size
+	}
+	return st, nil
+}
+
+// SegmentInfo describes a segment file, as returned by Segments.
+type SegmentInfo struct {
+	ID      int
+	Size    int64
+	Records int
+	ModTime time.Time
+	// Current marks a segment that new records are appended to.
+	Current bool
+}
+
+// Segments lists the segment files in ascending id order. Record counts
+// come from memory, so the call costs one directory scan.
+func (db *Db) Segments() ([]SegmentInfo, error) {
+	segments, err := listSegments(db.fsys)
+	if err != nil {
+		return nil, err
+	}
+	res := make([]SegmentInfo, 0, len(segments))
+	db.mu.RLock()
+	defer db.mu.RUnlock()
+	for _, s := range segments {
+		info := SegmentInfo{ID: s.id, Size: s.size, ModTime: s.modTime}
+		if p := db.segmentPartition(s.id); p.segmentId == s.id {
+			info.Current = true
+			info.Records = len(p.hints)
+		} else {
+			info.Records = db.recordCounts[s.id]
+		}
+		res = append(res, info)
+	}
+	return res, nil
 }
 
 func (db *Db) loadSegments() error {
-	files, err := os.ReadDir(db.dir)
+	if !db.readOnly {
+		if err := db.removeCompactLeftovers(); err != nil {
+			return err
+		}
+	}
+	segments, err := listSegments(db.fsys)
 	if err != nil {
 		return err
 	}
+	if err := db.checkPartitions(len(segments) == 0); err != nil {
+		return err
+	}
 
-	segmentIds := []int{}
-	for _, file := range files {
-		if strings.HasPrefix(file.Name(), outFileNamePrefix) {
-			idStr := strings.TrimPrefix(file.Name(), outFileNamePrefix)
-			id, err := strconv.Atoi(idStr)
-			if err == nil {
-				segmentIds = append(segmentIds, id)
+	// The latest segment of every partition is its current one.
+	for _, s := range segments {
+		p := db.segmentPartition(s.id)
+		p.segmentId = max(p.segmentId, s.id)
+	}
+	for _, s := range segments {
+		id := s.id
+		p := db.segmentPartition(id)
+		var records []hintRecord
+		if id == p.segmentId {
+			if records, err = db.recoverSegment(id); err != nil {
+				return err
+			}
+			p.hints = records
+		} else if records, err = db.loadSegmentHints(id); err != nil {
+			return err
+		} else {
+			db.recordCounts[id] = len(records)
+		}
+		for _, r := range records {
+			if r.key == "" {
+				// Chunks after the first of a chunked value.
+				continue
 			}
+			if r.chunkStart > 0 && (p.pinned == 0 || r.chunkStart < p.pinned) {
+				p.pinned = r.chunkStart
+			}
+			if r.deleted {
+				db.index.remove(r.key)
+				db.tombstones++
+				continue
+			}
+			db.index.set(r.key, segmentRef{
+				segmentId: id,
+				offset:    r.offset,
+				valueSize: r.valueSize,
+			})
 		}
+		db.records += len(records)
 	}
 
-	if len(segmentIds) == 0 {
-		return db.createNewSegment()
+	for _, p := range db.partitions {
+		if err := db.openCurrentSegment(p); err != nil {
+			return err
+		}
 	}
+	return nil
+}
 
-	maxId := -1
-	for _, id := range segmentIds {
-		if id > maxId {
-			maxId = id
+// openCurrentSegment opens the latest segment of p for appending, creating
+// the first one of a new partition.
+func (db *Db) openCurrentSegment(p *partition) error {
+	if p.segmentId == 0 {
+		if db.readOnly {
+			return nil
 		}
-		if err := db.recoverSegment(id); err != nil {
+		return db.createNewSegment(p)
+	}
+	if db.readOnly {
+		info, err := fs.Stat(db.fsys, db.segmentName(p.segmentId))
+		if err != nil {
 			return err
 		}
+		p.offset = info.Size()
+		return nil
 	}
-	db.currentSegmentId = maxId
-
-	path := filepath.Join(db.dir, segmentFilename(maxId))
-	f, err := os.OpenFile(path, os.O_APPEND|os.O_WRONLY, 0o600)
+	f, err := db.modes.openFile(db.segmentPath(p.segmentId), os.O_APPEND|os.O_WRONLY)
 	if err != nil {
 		return err
 	}
-	db.currentSegment = f
+	p.segment = f
 	info, err := f.Stat()
 	if err != nil {
 		return err
 	}
-	db.currentOffset = info.Size()
+	p.offset = info.Size()
 	return nil
 }
 
-func (db *Db) recoverSegment(id int) error {
-	path := filepath.Join(db.dir, segmentFilename(id))
-	f, err := os.Open(path)
+// loadSegmentHints reads the records of a sealed segment from its hint file,
+// replaying the segment itself (and rewriting the hint) when the hint is
+// missing or does not match the segment.
+func (db *Db) loadSegmentHints(id int) ([]hintRecord, error) {
+	name := db.segmentName(id)
+	info, err := fs.Stat(db.fsys, name)
 	if err != nil {
-		return err
+		return nil, err
+	}
+	records, n, err := readHintFile(db.fsys, name+hintFileSuffix, info.Size())
+	db.recoveryBytes += int64(n)
+	if err == nil {
+		return records, nil
+	}
+
+	if records, err = db.recoverSegment(id); err != nil {
+		return nil, err
+	}
+	if db.readOnly {
+		return records, nil
+	}
+	if err := writeHintFile(db.diskPath(name)+hintFileSuffix, info.Size(), records, db.modes); err != nil {
+		return nil, err
+	}
+	return records, nil
+}
+
+func (db *Db) recoverSegment(id int) ([]hintRecord, error) {
+	name := db.segmentName(id)
+	f, err := db.fsys.Open(name)
+	if err != nil {
+		return nil, err
 	}
 	defer f.Close()
 
+	var (
+		records []hintRecord
+		buf     []byte
+	)
 	reader := bufio.NewReader(f)
 	offset := int64(0)
 	for {
-		var record entry
-		n, err := record.DecodeFromReader(reader)
+		// Keys are copied out of buf by Decode and values are only
+		// measured, so the buffer can be reused for every record.
+		record := entry{aead: db.aead}
+		var n int
+		n, buf, err = record.decodeFromReaderBuf(reader, buf)
 		if errors.Is(err, io.EOF) {
 			break
 		}
+		if errors.Is(err, io.ErrUnexpectedEOF) {
+			torn, terr := db.tornTail(name, offset)
+			if terr != nil {
+				return nil, terr
+			}
+			if !torn {
+				return nil, fmt.Errorf("corrupted segment: %w: record at offset %d runs past the end of the segment", ErrCorrupted, offset)
+			}
+			// The last append was interrupted; drop the partial record so new
+			// writes start at a record boundary.
+			if db.readOnly {
+				break
+			}
+			if err := os.Truncate(db.diskPath(name), offset); err != nil {
+				return nil, err
+			}
+			break
+		}
 		if err != nil {
-			return fmt.Errorf("corrupted segment: %w", err)
+			return nil, fmt.Errorf("corrupted segment: %w", err)
 		}
-		db.index[record.key] = segmentRef{
-			segmentId: id,
+		h := hintRecord{
+			key:       record.key,
 			offset:    offset,
+			size:      n,
+			valueSize: len(record.value),
+			deleted:   record.deleted,
+		}
+		if record.chunk != nil && record.key != "" {
+			h.valueSize, h.chunkStart = record.chunk.valueSize, record.chunk.start
 		}
+		records = append(records, h)
 		offset += int64(n)
+		db.recoveryBytes += int64(n)
 	}
-	return nil
+	return records, nil
 }
 
-func (db *Db) createNewSegment() error {
-	db.currentSegmentId++
-	path := filepath.Join(db.dir, segmentFilename(db.currentSegmentId))
-	f, err := os.OpenFile(path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0o600)
+// tornTail reports whether the record at offset of segment name, which
+// runs past the end of the file, was cut off by an interrupted append. A
+// middle record with a damaged size field runs past the end as well, but
+// valid records still follow it.
+func (db *Db) tornTail(name string, offset int64) (bool, error) {
+	data, err := fs.ReadFile(db.fsys, name)
 	if err != nil {
-		return err
+		return false, err
+	}
+	tail := data[offset:]
+	// Only records that fit in the rest of the file are decoded.
+	fits := func(pos int) bool {
+		return len(tail)-pos >= 4 && int(binary.LittleEndian.Uint32(tail[pos:])&^taggedRecord) <= len(tail)-pos
+	}
+	if fits(0) {
+		return false, nil
+	}
+	// Untagged records carry no checksum that would tell one apart from
+	// the bytes of a partial record.
+	for pos := 1; pos < len(tail); pos++ {
+		if !fits(pos) || binary.LittleEndian.Uint32(tail[pos:])&taggedRecord == 0 {
+			continue
+		}
+		record := entry{aead: db.aead}
+		if record.Decode(tail[pos:pos+int(binary.LittleEndian.Uint32(tail[pos:])&^taggedRecord)]) == nil {
+			return false, nil
+		}
+	}
+	return true, nil
+}
+
+// createNewSegment starts a new current segment for p. Its id is above
+// every id p used before, and ids of files that already exist, say left
+// behind by another process, are skipped, so an id is never reused.
+func (db *Db) createNewSegment(p *partition) error {
+	id := db.nextSegmentId(p)
+	var f *os.File
+	for {
+		path := db.segmentPath(id)
+		if err := db.modes.mkdirAll(filepath.Dir(path)); err != nil {
+			return err
+		}
+		var err error
+		f, err = db.modes.openFile(path, os.O_CREATE|os.O_EXCL|os.O_WRONLY|os.O_APPEND)
+		if errors.Is(err, fs.ErrExist) {
+			id += len(db.partitions)
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		break
+	}
+
+	db.mu.Lock()
+	p.segment = f
+	p.segmentId = id
+	p.offset = 0
+	db.mu.Unlock()
+	if p.committing {
+		p.created = append(p.created, id)
 	}
-	db.currentSegment = f
-	db.currentOffset = 0
 	return nil
 }
 
 func segmentFilename(id int) string {
 	return fmt.Sprintf("%s%d", outFileNamePrefix, id)
 }
+
+func parseSegmentFilename(name string) (int, bool) {
+	if !strings.HasPrefix(name, outFileNamePrefix) {
+		return 0, false
+	}
+	id, err := strconv.Atoi(strings.TrimPrefix(name, outFileNamePrefix))
+	return id, err == nil
+}
@@ -1,12 +1,22 @@
 package datastore
 
 import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
 	"errors"
 	"fmt"
+	"log/slog"
 	"os"
+	"path"
+	"path/filepath"
+	"reflect"
+	"sort"
 	"strings"
 	"sync"
 	"testing"
+	"testing/fstest"
 	"time"
 )
 
@@ -183,6 +193,202 @@ func TestDb_ParallelPutGet(t *testing.T) {
 
 	wg.Wait()
 }
+
+func TestDb_ConcurrentStress(t *testing.T) {
+	db, err := OpenWithLimit(t.TempDir(), 512)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	const (
+		workers = 8
+		rounds  = 200
+	)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(3)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				if err := db.Put(fmt.Sprintf("key-%d-%d", w, i%10), fmt.Sprintf("value-%d", i)); err != nil {
+					t.Errorf("Put failed: %v", err)
+					return
+				}
+			}
+		}(w)
+		go func(w int) {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				_, err := db.Get(fmt.Sprintf("key-%d-%d", w, i%10))
+				if err != nil && !errors.Is(err, ErrNotFound) {
+					t.Errorf("Get failed: %v", err)
+					return
+				}
+			}
+		}(w)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < rounds; i++ {
+				if size, err := db.Size(); err != nil || size < 0 {
+					t.Errorf("Size() = %d, %v", size, err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for w := 0; w < workers; w++ {
+		for k := 0; k < 10; k++ {
+			want := fmt.Sprintf("value-%d", rounds-10+k)
+			if got, err := db.Get(fmt.Sprintf("key-%d-%d", w, k)); err != nil || got != want {
+				t.Errorf("Get(key-%d-%d) = %q, %v; want %q", w, k, got, err, want)
+			}
+		}
+	}
+}
+
+func TestDb_RecoversTruncatedTail(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := db.Put(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	validSize, _ := db.Size()
+	if err := db.Put("partial", "lost-on-crash"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := fmt.Sprintf("%s/segment-1", tmp)
+	// Cut into the body of the last record, then leave only part of its size.
+	for _, keep := range []func(size int64) int64{
+		func(size int64) int64 { return size - 3 },
+		func(int64) int64 { return validSize + 2 },
+	} {
+		info, err := os.Stat(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Truncate(path, keep(info.Size())); err != nil {
+			t.Fatal(err)
+		}
+		db, err = Open(tmp)
+		if err != nil {
+			t.Fatalf("Open failed after truncating to %d bytes: %v", keep(info.Size()), err)
+		}
+		for i := 0; i < 5; i++ {
+			if got, err := db.Get(fmt.Sprintf("key-%d", i)); err != nil || got != fmt.Sprintf("value-%d", i) {
+				t.Errorf("Get(key-%d) = %q, %v", i, got, err)
+			}
+		}
+		if _, err := db.Get("partial"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected partial record to be dropped, got %v", err)
+		}
+		if size, _ := db.Size(); size != validSize {
+			t.Errorf("Expected segment to be truncated to %d bytes, got %d", validSize, size)
+		}
+		if err := db.Put("partial", "rewritten"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	db, err = Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if got, err := db.Get("partial"); err != nil || got != "rewritten" {
+		t.Errorf("Get(partial) = %q, %v", got, err)
+	}
+}
+
+func TestDb_CorruptedMiddleRecord(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := db.Put(fmt.Sprintf("key-%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ref, _ := db.index.get("key-1")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := fmt.Sprintf("%s/segment-%d", tmp, ref.segmentId)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	record := entry{key: "key-1", value: []byte("value")}
+	data[ref.offset+int64(len(record.Encode()))-1] ^= 0xFF
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if db, err := Open(tmp); err == nil {
+		_ = db.Close()
+		t.Fatal("Expected Open to fail on a corrupted middle record")
+	}
+}
+
+func TestDb_CorruptedMiddleRecordSize(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 3; i++ {
+		if err := db.Put(fmt.Sprintf("key-%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ref, _ := db.index.get("key-1")
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	path := fmt.Sprintf("%s/segment-%d", tmp, ref.segmentId)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// The record now seems to run past the end of the segment, like one
+	// cut off by a crash, but key-2 still follows it.
+	size := binary.LittleEndian.Uint32(data[ref.offset:])
+	binary.LittleEndian.PutUint32(data[ref.offset:], size&taggedRecord|uint32(len(data)))
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	if db, err := Open(tmp); !errors.Is(err, ErrCorrupted) {
+		if err == nil {
+			_ = db.Close()
+		}
+		t.Fatalf("Open of a segment with a damaged middle record size: %v, want ErrCorrupted", err)
+	}
+	if info, err := os.Stat(path); err != nil || info.Size() != int64(len(data)) {
+		t.Errorf("Segment was truncated: %v, %v", info, err)
+	}
+}
+
 func TestDb_DetectsCorruptedValue(t *testing.T) {
 	tmp := t.TempDir()
 
@@ -200,9 +406,7 @@ func TestDb_DetectsCorruptedValue(t *testing.T) {
 		t.Fatalf("Put failed: %v", err)
 	}
 
-	db.mu.RLock()
-	ref, ok := db.index[key]
-	db.mu.RUnlock()
+	ref, ok := db.index.get(key)
 	if !ok {
 		t.Fatal("key not found in index")
 	}
@@ -231,3 +435,2275 @@ func TestDb_DetectsCorruptedValue(t *testing.T) {
 		t.Fatalf("expected ErrCorrupted, got: %v", err)
 	}
 }
+
+func TestDb_VerifyOnReadOff(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp, WithVerifyOnRead(false))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("k", "value"); err != nil {
+		t.Fatal(err)
+	}
+	_, meta, err := db.GetWithMetadata("k")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := fmt.Sprintf("%s/segment-%d", tmp, meta.SegmentID)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[meta.Offset+13+1] = 'V'
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	// The damage goes unnoticed: that is the tradeoff of the option.
+	if got, err := db.Get("k"); err != nil || got != "Value" {
+		t.Errorf("Get() = %q, %v, want the damaged value", got, err)
+	}
+	if res, err := db.Verify(); err != nil || res.BadRecords != 1 {
+		t.Errorf("Verify() = %+v, %v, want the damage reported", res, err)
+	}
+}
+
+func TestDb_Delete(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := OpenWithLimit(tmp, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 6; i++ {
+		if err := db.Put(fmt.Sprintf("key-%d", i), strings.Repeat("v", 20)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, k := range []string{"key-1", "key-4"} {
+		if err := db.Delete(k); err != nil {
+			t.Fatalf("Delete(%s) failed: %v", k, err)
+		}
+	}
+	if err := db.Delete("key-1"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound deleting a missing key, got %v", err)
+	}
+	if err := db.Put("key-4", "again"); err != nil {
+		t.Fatal(err)
+	}
+
+	check := func() {
+		t.Helper()
+		if _, err := db.Get("key-1"); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Expected deleted key to be missing, got %v", err)
+		}
+		if got, err := db.Get("key-4"); err != nil || got != "again" {
+			t.Errorf("Get(key-4) = %q, %v", got, err)
+		}
+		if len(db.Keys()) != 5 {
+			t.Errorf("Unexpected keys %v", db.Keys())
+		}
+		if st, _ := db.Stats(); st.Tombstones != 2 {
+			t.Errorf("Expected 2 tombstones, got %+v", st)
+		}
+	}
+	check()
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenWithLimit(tmp, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	check()
+}
+
+func TestDb_GetMany(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	_ = db.Put("a", "1")
+	_ = db.Put("b", "2")
+
+	res, err := db.GetMany([]string{"a", "missing", "b"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(res, map[string]string{"a": "1", "b": "2"}) {
+		t.Errorf("Unexpected result %v", res)
+	}
+}
+
+func TestDb_Exists(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := OpenWithLimit(tmp, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 5; i++ {
+		if err := db.Put(fmt.Sprintf("key-%d", i), strings.Repeat("v", 20+i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenWithLimit(tmp, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	for i := 0; i < 5; i++ {
+		ok, size, err := db.Exists(fmt.Sprintf("key-%d", i))
+		if err != nil || !ok || size != 20+i {
+			t.Errorf("Exists(key-%d) = %t, %d, %v", i, ok, size, err)
+		}
+	}
+	if ok, _, err := db.Exists("missing"); ok || err != nil {
+		t.Errorf("Exists(missing) = %t, %v", ok, err)
+	}
+}
+
+func TestDb_Keys(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	for _, k := range []string{"k1", "k2", "k3", "k2"} {
+		if err := db.Put(k, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	keys := db.Keys()
+	sort.Strings(keys)
+	if !reflect.DeepEqual(keys, []string{"k1", "k2", "k3"}) {
+		t.Errorf("Unexpected keys %v", keys)
+	}
+
+	visited := 0
+	db.KeysIter(func(key string) bool {
+		visited++
+		return visited < 2
+	})
+	if visited != 2 {
+		t.Errorf("KeysIter did not stop early: visited %d keys", visited)
+	}
+}
+
+func TestDb_PutBytes(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	values := map[string][]byte{
+		"empty": {},
+		"nul":   {'a', 0, 'b', 0, 0},
+		"large": bytes.Repeat([]byte{0, 0xFF}, 1<<20),
+	}
+	for k, v := range values {
+		if err := db.PutBytes(k, v); err != nil {
+			t.Fatalf("PutBytes(%s) failed: %v", k, err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	for k, v := range values {
+		got, err := db.GetBytes(k)
+		if err != nil {
+			t.Errorf("GetBytes(%s) failed: %v", k, err)
+		}
+		if !bytes.Equal(got, v) {
+			t.Errorf("GetBytes(%s) returned %d bytes, expected %d", k, len(got), len(v))
+		}
+	}
+}
+
+func TestDb_InvalidSegmentLimit(t *testing.T) {
+	e := entry{key: "key", value: []byte("value"), modified: 1}
+	header := int64(len((&entry{modified: 1}).Encode()))
+	for _, limit := range []int64{0, 1, -100, header - 1} {
+		if db, err := OpenWithLimit(t.TempDir(), limit); err == nil {
+			_ = db.Close()
+			t.Errorf("Expected OpenWithLimit to reject limit %d", limit)
+		}
+	}
+
+	db, err := OpenWithLimit(t.TempDir(), int64(len(e.Encode()))-1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	if err := db.Put(e.key, string(e.value)); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("Put of a record over the limit: %v, want ErrValueTooLarge", err)
+	}
+	if err := db.Put(e.key, string(e.value[1:])); err != nil {
+		t.Fatalf("Put failed: %v", err)
+	}
+	if got, err := db.Get(e.key); err != nil || got != string(e.value[1:]) {
+		t.Errorf("Get = %q, %v", got, err)
+	}
+}
+
+func TestDb_ChecksumOption(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp, WithChecksum(ChecksumSHA1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("old", "sha1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = Open(tmp, WithChecksum(ChecksumCRC32C))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	if err := db.Put("new", "crc32c"); err != nil {
+		t.Fatal(err)
+	}
+	for k, v := range map[string]string{"old": "sha1", "new": "crc32c"} {
+		if got, err := db.Get(k); err != nil || got != v {
+			t.Errorf("Get(%s) = %q, %v", k, got, err)
+		}
+	}
+
+	if _, err := Open(t.TempDir(), WithChecksum(Checksum(42))); err == nil {
+		t.Error("Expected an error for an unknown checksum algorithm")
+	}
+}
+
+func TestDb_CombinedOptions(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp,
+		WithSegmentLimit(256),
+		WithSyncPolicy(SyncEveryWrite),
+		WithChecksum(ChecksumCRC32C),
+		WithCompression(64),
+		WithWriteBuffer(0),
+	)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := strings.Repeat("compressible ", 20)
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("key-%d", i), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, meta, err := db.GetWithMetadata("key-0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if meta.ChecksumAlgo != ChecksumCRC32C || meta.Size >= len(value) {
+		t.Errorf("Unexpected record metadata %+v", meta)
+	}
+	if st, _ := db.Stats(); st.Segments < 2 {
+		t.Errorf("Expected rollovers with a 256 byte limit, got %d segments", st.Segments)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The limit passed to OpenWithLimit wins over WithSegmentLimit.
+	if _, err := OpenWithLimit(tmp, 1, WithSegmentLimit(1<<20)); err == nil {
+		t.Error("Expected OpenWithLimit to reject a 1 byte limit")
+	}
+
+	ro, err := Open(tmp, WithReadOnly(), WithSegmentLimit(1<<20), WithIndexShards(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	if got, err := ro.Get("key-9"); err != nil || got != value {
+		t.Errorf("Get(key-9) = %q, %v", got, err)
+	}
+	if err := ro.Put("key-0", "new"); err != ErrReadOnly {
+		t.Errorf("Put() error = %v, want ErrReadOnly", err)
+	}
+}
+
+func TestDb_SyncPolicy(t *testing.T) {
+	for name, policy := range map[string]SyncPolicy{
+		"never":    SyncNever,
+		"every":    SyncEveryWrite,
+		"interval": SyncInterval(10 * time.Millisecond),
+	} {
+		t.Run(name, func(t *testing.T) {
+			tmp := t.TempDir()
+			db, err := OpenWithLimit(tmp, 100, WithSyncPolicy(policy))
+			if err != nil {
+				t.Fatal(err)
+			}
+			for i := 0; i < 10; i++ {
+				if err := db.Put(fmt.Sprintf("key-%d", i), strings.Repeat("v", 20)); err != nil {
+					t.Fatalf("Put failed: %v", err)
+				}
+			}
+			time.Sleep(30 * time.Millisecond)
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			db, err = OpenWithLimit(tmp, 100, WithSyncPolicy(policy))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			for i := 0; i < 10; i++ {
+				if _, err := db.Get(fmt.Sprintf("key-%d", i)); err != nil {
+					t.Errorf("Get failed after reopen: %v", err)
+				}
+			}
+		})
+	}
+}
+
+func TestDb_PutLocated(t *testing.T) {
+	db, err := OpenWithLimit(t.TempDir(), 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	var prev Location
+	for i := 0; i < 10; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		loc, err := db.PutLocated(key, strings.Repeat("v", 20))
+		if err != nil {
+			t.Fatal(err)
+		}
+		ref, _ := db.index.get(key)
+		if loc.SegmentID != ref.segmentId || loc.Offset != ref.offset {
+			t.Errorf("Location %+v does not match index %+v", loc, ref)
+		}
+		if i > 0 && loc.SegmentID == prev.SegmentID && loc.Offset <= prev.Offset {
+			t.Errorf("Location %+v did not advance past %+v", loc, prev)
+		}
+		prev = loc
+	}
+}
+
+func TestDb_GetWithMetadata(t *testing.T) {
+	for _, c := range []Checksum{ChecksumSHA1, ChecksumCRC32C} {
+		t.Run(fmt.Sprint(c), func(t *testing.T) {
+			db, err := OpenWithLimit(t.TempDir(), 200, WithChecksum(c))
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			for i := 0; i < 10; i++ {
+				key, value := fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i)
+				loc, err := db.PutLocated(key, value)
+				if err != nil {
+					t.Fatal(err)
+				}
+				got, meta, err := db.GetWithMetadata(key)
+				if err != nil || got != value {
+					t.Fatalf("GetWithMetadata(%s) = %q, %v", key, got, err)
+				}
+				record := (&entry{key: key, value: []byte(value), checksum: c, modified: meta.Modified.UnixNano()}).Encode()
+				want := RecordMeta{
+					SegmentID:    loc.SegmentID,
+					Offset:       loc.Offset,
+					Size:         len(record),
+					ChecksumAlgo: c,
+					Checksum:     record[len(record)-c.size():],
+					Modified:     meta.Modified,
+				}
+				if !reflect.DeepEqual(meta, want) {
+					t.Errorf("GetWithMetadata(%s) meta = %+v, want %+v", key, meta, want)
+				}
+			}
+			if _, _, err := db.GetWithMetadata("missing"); !errors.Is(err, ErrNotFound) {
+				t.Errorf("GetWithMetadata(missing) error = %v", err)
+			}
+		})
+	}
+}
+
+func TestDb_Stats(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := OpenWithLimit(tmp, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("key-%d", i%4), strings.Repeat("v", 20)); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	check := func(st Stats) {
+		t.Helper()
+		if st.Keys != 4 {
+			t.Errorf("Expected 4 keys, got %d", st.Keys)
+		}
+		if st.DeadRecords != 6 {
+			t.Errorf("Expected 6 dead records, got %d", st.DeadRecords)
+		}
+		if st.Segments < 2 || st.CurrentSegmentID != st.Segments {
+			t.Errorf("Unexpected segment stats %+v", st)
+		}
+		if st.DiskBytes < st.CurrentOffset || st.DiskBytes == 0 {
+			t.Errorf("Unexpected disk usage %+v", st)
+		}
+	}
+
+	st, err := db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(st)
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenWithLimit(tmp, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	st, err = db.Stats()
+	if err != nil {
+		t.Fatal(err)
+	}
+	check(st)
+}
+
+func TestDb_SegmentList(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := OpenWithLimit(tmp, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	check := func(db *Db, puts int) []SegmentInfo {
+		t.Helper()
+		segments, err := db.Segments()
+		if err != nil {
+			t.Fatal(err)
+		}
+		records := 0
+		for i, s := range segments {
+			records += s.Records
+			if s.Current != (i == len(segments)-1) || s.ModTime.IsZero() || s.Size == 0 {
+				t.Errorf("Segments()[%d] = %+v", i, s)
+			}
+		}
+		if records != puts {
+			t.Errorf("Segments() count %d records, want %d: %+v", records, puts, segments)
+		}
+		return segments
+	}
+
+	prev := 0
+	for i := 1; i <= 20; i++ {
+		if err := db.Put(fmt.Sprintf("key-%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+		segments := check(db, i)
+		if len(segments) < prev {
+			t.Errorf("Segments() shrank from %d to %d", prev, len(segments))
+		}
+		prev = len(segments)
+	}
+	if prev < 3 {
+		t.Errorf("expected the store to roll over, got %d segments", prev)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenWithLimit(tmp, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if segments := check(db, 20); len(segments) != prev {
+		t.Errorf("Segments() after reopen = %+v", segments)
+	}
+}
+
+func TestDb_PutBatch(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := OpenWithLimit(tmp, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	var pairs []KV
+	for i := 0; i < 20; i++ {
+		pairs = append(pairs, KV{Key: fmt.Sprintf("key-%d", i), Value: strings.Repeat("v", 20)})
+	}
+	pairs = append(pairs, KV{Key: "key-0", Value: "last"})
+	if err := db.PutBatch(pairs); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := os.ReadDir(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(files) < 2 {
+		t.Errorf("Expected batch to span multiple segments, found %d", len(files))
+	}
+
+	for _, p := range pairs[1:20] {
+		if val, err := db.Get(p.Key); err != nil || val != p.Value {
+			t.Errorf("Get(%s) = %q, %v", p.Key, val, err)
+		}
+	}
+	if val, _ := db.Get("key-0"); val != "last" {
+		t.Errorf("Expected last value for repeated key, got %q", val)
+	}
+}
+
+func TestDb_IndexShards(t *testing.T) {
+	for _, shards := range []int{0, 1, 7} {
+		t.Run(fmt.Sprintf("shards=%d", shards), func(t *testing.T) {
+			tmp := t.TempDir()
+			db, err := Open(tmp, WithIndexShards(shards))
+			if err != nil {
+				t.Fatal(err)
+			}
+
+			var pairs []KV
+			for i := 0; i < 50; i++ {
+				pairs = append(pairs, KV{Key: fmt.Sprintf("key-%d", i), Value: fmt.Sprintf("value-%d", i)})
+			}
+			if err := db.PutBatch(pairs); err != nil {
+				t.Fatal(err)
+			}
+			if err := db.Delete("key-0"); err != nil {
+				t.Fatal(err)
+			}
+			if n := len(db.Keys()); n != 49 {
+				t.Errorf("Keys() returned %d keys, want 49", n)
+			}
+			if err := db.Close(); err != nil {
+				t.Fatal(err)
+			}
+
+			// The shard count is not persisted, so reopening with a different
+			// one must still find every key.
+			db, err = Open(tmp, WithIndexShards(shards+3))
+			if err != nil {
+				t.Fatal(err)
+			}
+			t.Cleanup(func() {
+				_ = db.Close()
+			})
+			for _, p := range pairs[1:] {
+				if val, err := db.Get(p.Key); err != nil || val != p.Value {
+					t.Errorf("Get(%s) = %q, %v", p.Key, val, err)
+				}
+			}
+			if st, err := db.Stats(); err != nil || st.Keys != 49 {
+				t.Errorf("Stats() = %+v, %v", st, err)
+			}
+		})
+	}
+}
+
+func TestDb_Compression(t *testing.T) {
+	value := strings.Repeat(`{"name":"value","count":42},`, 200)
+	diskSize := func(t *testing.T, opts ...Option) int64 {
+		tmp := t.TempDir()
+		db, err := Open(tmp, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("big", value); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("small", "tiny"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+
+		db, err = Open(tmp, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer db.Close()
+		if got, err := db.Get("big"); err != nil || got != value {
+			t.Errorf("Get(big) returned %d bytes, %v", len(got), err)
+		}
+		if got, err := db.Get("small"); err != nil || got != "tiny" {
+			t.Errorf("Get(small) = %q, %v", got, err)
+		}
+		if _, size, _ := db.Exists("big"); size != len(value) {
+			t.Errorf("Exists reported size %d, want %d", size, len(value))
+		}
+		size, _ := db.Size()
+		return size
+	}
+
+	plain := diskSize(t)
+	compressed := diskSize(t, WithCompression(64))
+	if compressed >= plain/2 {
+		t.Errorf("compressed segment is %d bytes, uncompressed %d", compressed, plain)
+	}
+}
+
+func TestDb_Encryption(t *testing.T) {
+	tmp := t.TempDir()
+	key := bytes.Repeat([]byte{7}, 32)
+	db, err := Open(tmp, WithEncryptionKey(key), WithCompression(16))
+	if err != nil {
+		t.Fatal(err)
+	}
+	secret := strings.Repeat("top secret ", 10)
+	if err := db.Put("k", secret); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.Get("k"); err != nil || got != secret {
+		t.Errorf("Get() = %q, %v", got, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := os.ReadFile(filepath.Join(tmp, segmentFilename(1)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bytes.Contains(data, []byte("secret")) {
+		t.Error("segment contains the plain text value")
+	}
+
+	db, err = Open(tmp, WithEncryptionKey(key))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.Get("k"); err != nil || got != secret {
+		t.Errorf("Get() after reopen = %q, %v", got, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(tmp, WithEncryptionKey(bytes.Repeat([]byte{8}, 32))); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Open with wrong key: %v, want ErrCorrupted", err)
+	}
+	if _, err := Open(tmp); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Open without key: %v, want ErrCorrupted", err)
+	}
+	if _, err := Open(t.TempDir(), WithEncryptionKey([]byte("short"))); err == nil {
+		t.Error("expected an error for a short key")
+	}
+}
+
+func TestDb_MissingSegment(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := OpenWithLimit(tmp, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("key-%d", i), strings.Repeat("v", 20)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenWithLimit(tmp, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	ref, _ := db.index.get("key-0")
+	if err := os.Remove(filepath.Join(tmp, segmentFilename(ref.segmentId))); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("key-0"); !errors.Is(err, ErrSegmentMissing) {
+		t.Errorf("Get() from a deleted segment: %v, want ErrSegmentMissing", err)
+	}
+	if _, err := db.Get("key-9"); err != nil {
+		t.Errorf("Get() from an intact segment: %v", err)
+	}
+}
+
+func TestDb_OpenReadOnly(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := OpenWithLimit(tmp, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	before, err := os.ReadDir(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	readers := make([]*Db, 2)
+	for i := range readers {
+		if readers[i], err = OpenReadOnly(tmp); err != nil {
+			t.Fatal(err)
+		}
+		defer readers[i].Close()
+	}
+	for _, ro := range readers {
+		if got, err := ro.Get("key-3"); err != nil || got != "value-3" {
+			t.Errorf("Get() = %q, %v", got, err)
+		}
+		if n := len(ro.Keys()); n != 10 {
+			t.Errorf("Keys() returned %d keys", n)
+		}
+		if err := ro.Put("key-3", "new"); err != ErrReadOnly {
+			t.Errorf("Put() error = %v, want ErrReadOnly", err)
+		}
+		if err := ro.Delete("key-3"); err != ErrReadOnly {
+			t.Errorf("Delete() error = %v, want ErrReadOnly", err)
+		}
+		if err := ro.Compact(); err != ErrReadOnly {
+			t.Errorf("Compact() error = %v, want ErrReadOnly", err)
+		}
+	}
+
+	after, err := os.ReadDir(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(after) != len(before) {
+		t.Errorf("read-only open changed the directory: %d files before, %d after", len(before), len(after))
+	}
+
+	if _, err := OpenReadOnly(filepath.Join(tmp, "missing")); err == nil {
+		t.Error("expected an error for a missing directory")
+	}
+}
+
+func TestDb_OpenFS(t *testing.T) {
+	var sealed, current []byte
+	for _, e := range []entry{
+		{key: "user-1", value: []byte("old")},
+		{key: "user-2", value: []byte("bob")},
+		{key: "other", value: []byte("x")},
+	} {
+		sealed = append(sealed, e.Encode()...)
+	}
+	for _, e := range []entry{
+		{key: "user-1", value: []byte("alice")},
+		{key: "other", deleted: true},
+	} {
+		current = append(current, e.Encode()...)
+	}
+	fsys := fstest.MapFS{
+		segmentFilename(1): {Data: sealed},
+		path.Join(segmentsDirName, segmentShard(2), segmentFilename(2)): {Data: current},
+	}
+
+	db, err := OpenFS(fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if got, err := db.Get("user-1"); err != nil || got != "alice" {
+		t.Errorf("Get(user-1) = %q, %v", got, err)
+	}
+	if _, err := db.Get("other"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get(other) error = %v, want ErrNotFound", err)
+	}
+	got, err := db.ScanSorted("user-")
+	want := []KV{{Key: "user-1", Value: "alice"}, {Key: "user-2", Value: "bob"}}
+	if err != nil || !reflect.DeepEqual(got, want) {
+		t.Errorf("ScanSorted() = %v, %v; want %v", got, err, want)
+	}
+	if err := db.Put("user-3", "carol"); err != ErrReadOnly {
+		t.Errorf("Put() error = %v, want ErrReadOnly", err)
+	}
+	if err := db.Delete("user-1"); err != ErrReadOnly {
+		t.Errorf("Delete() error = %v, want ErrReadOnly", err)
+	}
+}
+
+func TestDb_Flush(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := db.Put(fmt.Sprintf("key-%d", i), "value"); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if err := db.Flush(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Open a second instance without closing the first, as a restart after
+	// a crash would. The crashed process would have released the lock.
+	_ = db.unlock()
+	crashed, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer crashed.Close()
+	for i := 0; i < 20; i++ {
+		if _, err := crashed.Get(fmt.Sprintf("key-%d", i)); err != nil {
+			t.Errorf("key-%d lost after flush: %v", i, err)
+		}
+	}
+
+	ro, err := OpenReadOnly(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ro.Close()
+	if err := ro.Flush(); err != ErrReadOnly {
+		t.Errorf("Flush() on a read-only db: %v, want ErrReadOnly", err)
+	}
+}
+
+func TestDb_ValueTooLarge(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := OpenWithLimit(tmp, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("big", strings.Repeat("v", 100)); !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("Put() of an oversized value: %v, want ErrValueTooLarge", err)
+	}
+	err = db.PutBatch([]KV{{Key: "small", Value: "v"}, {Key: "big", Value: strings.Repeat("v", 100)}})
+	if !errors.Is(err, ErrValueTooLarge) {
+		t.Errorf("PutBatch() with an oversized value: %v, want ErrValueTooLarge", err)
+	}
+	if _, err := db.Get("small"); err != ErrNotFound {
+		t.Errorf("rejected batch was partially applied: %v", err)
+	}
+	if size, _ := db.Size(); size != 0 {
+		t.Errorf("rejected writes took %d bytes", size)
+	}
+
+	if err := db.Put("fits", strings.Repeat("v", 100-25-len("fits"))); err != nil {
+		t.Errorf("Put() of a value filling a whole segment: %v", err)
+	}
+}
+
+func TestDb_ChunkedValues(t *testing.T) {
+	tmp := t.TempDir()
+	const limit = 200
+	db, err := OpenWithLimit(tmp, limit, WithChunkedValues())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var big strings.Builder
+	for i := 0; big.Len() < 3*limit; i++ {
+		fmt.Fprintf(&big, "%d,", i)
+	}
+	if err := db.Put("before", "v1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("big", big.String()); err != nil {
+		t.Fatalf("Put() of a value three times the segment limit: %v", err)
+	}
+	if err := db.Put("after", "v2"); err != nil {
+		t.Fatal(err)
+	}
+	check := func(stage string) {
+		t.Helper()
+		if v, err := db.Get("big"); err != nil || v != big.String() {
+			t.Errorf("%s: Get(big) = %d bytes, %v, want %d bytes", stage, len(v), err, big.Len())
+		}
+		for k, want := range map[string]string{"before": "v1", "after": "v2"} {
+			if v, err := db.Get(k); err != nil || v != want {
+				t.Errorf("%s: Get(%s) = %q, %v", stage, k, v, err)
+			}
+		}
+		if keys := db.Keys(); len(keys) != 3 {
+			t.Errorf("%s: Keys() = %q", stage, keys)
+		}
+	}
+	check("after Put")
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenWithLimit(tmp, limit, WithChunkedValues())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check("after reopening")
+
+	// Roll over so that the segments of the value are all sealed.
+	_, before, err := db.GetWithMetadata("big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for range 2 {
+		if err := db.Put("after", "v2"+strings.Repeat(" ", limit/2)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("after", "v2"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	check("after compaction")
+
+	_, merged, err := db.GetWithMetadata("big")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if merged.SegmentID == before.SegmentID && merged.Offset == before.Offset {
+		t.Errorf("compaction did not move the value from segment %d", before.SegmentID)
+	}
+	if merged.Size <= big.Len() {
+		t.Errorf("merged record takes %d bytes, want one record holding all %d", merged.Size, big.Len())
+	}
+}
+
+func TestDb_MaxSegmentRecords(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp, WithMaxSegmentRecords(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var segments []int
+	for i := 0; i < 12; i++ {
+		loc, err := db.PutLocated(fmt.Sprintf("key-%d", i), "value")
+		if err != nil {
+			t.Fatal(err)
+		}
+		segments = append(segments, loc.SegmentID)
+	}
+	want := []int{1, 1, 1, 1, 1, 2, 2, 2, 2, 2, 3, 3}
+	if !reflect.DeepEqual(segments, want) {
+		t.Errorf("records went to segments %v, want %v", segments, want)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// The count of the current segment survives a restart.
+	db, err = Open(tmp, WithMaxSegmentRecords(5))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for i := 12; i < 16; i++ {
+		loc, err := db.PutLocated(fmt.Sprintf("key-%d", i), "value")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := 3 + (i-10)/5; loc.SegmentID != want {
+			t.Errorf("key-%d written to segment %d, want %d", i, loc.SegmentID, want)
+		}
+	}
+}
+
+func TestDb_EmptyKeyAndValue(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Put("", "value"); err != ErrEmptyKey {
+		t.Errorf("Put() with an empty key: %v, want ErrEmptyKey", err)
+	}
+	if err := db.PutBatch([]KV{{Key: "k", Value: "v"}, {Key: "", Value: "v"}}); err != ErrEmptyKey {
+		t.Errorf("PutBatch() with an empty key: %v, want ErrEmptyKey", err)
+	}
+	if err := db.Delete(""); err != ErrEmptyKey {
+		t.Errorf("Delete() with an empty key: %v, want ErrEmptyKey", err)
+	}
+	if _, err := db.Get("k"); err != ErrNotFound {
+		t.Errorf("batch with an empty key was applied: %v", err)
+	}
+
+	if err := db.Put("empty", ""); err != nil {
+		t.Fatal(err)
+	}
+	check := func(db *Db) {
+		t.Helper()
+		if got, err := db.Get("empty"); err != nil || got != "" {
+			t.Errorf("Get() of an empty value = %q, %v", got, err)
+		}
+		if ok, size, err := db.Exists("empty"); !ok || size != 0 || err != nil {
+			t.Errorf("Exists() of an empty value = %v, %d, %v", ok, size, err)
+		}
+	}
+	check(db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(db)
+}
+
+func TestDb_WriteBuffer(t *testing.T) {
+	if _, err := Open(t.TempDir(), WithWriteBuffer(-1)); err == nil {
+		t.Error("expected an error for a negative buffer size")
+	}
+
+	db, err := Open(t.TempDir(), WithWriteBuffer(1))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var prev Location
+	for i := 0; i < 50; i++ {
+		loc, err := db.PutLocated("key", fmt.Sprintf("value-%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if i > 0 && loc.Offset <= prev.Offset {
+			t.Fatalf("write %d landed at %d, before the previous write at %d", i, loc.Offset, prev.Offset)
+		}
+		prev = loc
+	}
+	if got, err := db.Get("key"); err != nil || got != "value-49" {
+		t.Errorf("Get() = %q, %v; want the last value", got, err)
+	}
+
+	// Writers blocked on the full buffer are still all applied.
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			if err := db.Put(fmt.Sprintf("k-%d", i), "v"); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+	if n := len(db.Keys()); n != 21 {
+		t.Errorf("Keys() returned %d keys, want 21", n)
+	}
+}
+
+func TestDb_SynchronousWrites(t *testing.T) {
+	run := func(t *testing.T, opts ...Option) string {
+		tmp := t.TempDir()
+		db, err := OpenWithLimit(tmp, 150, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 20; i++ {
+			if err := db.Put(fmt.Sprintf("key-%d", i%7), fmt.Sprintf("value-%d", i)); err != nil {
+				t.Fatal(err)
+			}
+		}
+		if err := db.PutBatch([]KV{{Key: "a", Value: "1"}, {Key: "b", Value: "2"}}); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Delete("key-3"); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Flush(); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		if err := db.Put("k", "v"); !errors.Is(err, ErrClosed) {
+			t.Errorf("Put after Close: %v", err)
+		}
+		return tmp
+	}
+	// Write times are part of the records, so both runs use the same clock.
+	start := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	clock := func(o *options) {
+		o.clock = func() time.Time { return start }
+	}
+	asyncDir := run(t, clock)
+	syncDir := run(t, clock, SynchronousWrites(true))
+
+	// Both modes must leave the same files behind.
+	files, err := os.ReadDir(asyncDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range files {
+		want, _ := os.ReadFile(filepath.Join(asyncDir, f.Name()))
+		got, err := os.ReadFile(filepath.Join(syncDir, f.Name()))
+		if err != nil || !bytes.Equal(got, want) {
+			t.Errorf("%s differs between the modes: %v", f.Name(), err)
+		}
+	}
+
+	db, err := OpenWithLimit(syncDir, 150, SynchronousWrites(true))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if value, err := db.Get("key-5"); err != nil || value != "value-19" {
+		t.Errorf("Get(key-5) = %q, %v", value, err)
+	}
+	var wg sync.WaitGroup
+	for g := 0; g < 4; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < 50; i++ {
+				if err := db.Put(fmt.Sprintf("g%d-%d", g, i), "v"); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	if n := len(db.Keys()); n != 8+200 {
+		t.Errorf("len(Keys()) = %d", n)
+	}
+
+	if _, err := Open(t.TempDir(), SynchronousWrites(true), WithSyncPolicy(SyncInterval(time.Second))); err == nil {
+		t.Error("Open with SyncInterval in synchronous mode succeeded")
+	}
+}
+
+func TestDb_Increment(t *testing.T) {
+	for name, opts := range map[string][]Option{
+		"writer":      nil,
+		"synchronous": {SynchronousWrites(true)},
+		"writers":     {WithWriters(3)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			db, err := OpenWithLimit(t.TempDir(), 300, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			const goroutines, rounds = 8, 100
+			var wg sync.WaitGroup
+			for g := 0; g < goroutines; g++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < rounds; i++ {
+						if _, err := db.Increment("counter", 3); err != nil {
+							t.Error(err)
+							return
+						}
+						// Puts of other keys go through the same writers.
+						if err := db.Put(fmt.Sprintf("other-%d", g), "x"); err != nil {
+							t.Error(err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+			if got, err := db.Get("counter"); err != nil || got != fmt.Sprint(goroutines*rounds*3) {
+				t.Errorf("Get(counter) = %q, %v", got, err)
+			}
+			if n, err := db.Increment("counter", -2400); err != nil || n != 0 {
+				t.Errorf("Increment(counter, -2400) = %d, %v", n, err)
+			}
+
+			if err := db.Put("text", "abc"); err != nil {
+				t.Fatal(err)
+			}
+			if _, err := db.Increment("text", 1); !errors.Is(err, ErrNotInteger) {
+				t.Errorf("Increment(text) error = %v, want ErrNotInteger", err)
+			}
+			if got, _ := db.Get("text"); got != "abc" {
+				t.Errorf("failed Increment changed the value to %q", got)
+			}
+		})
+	}
+}
+
+func TestDb_Append(t *testing.T) {
+	for name, opts := range map[string][]Option{
+		"writer":      nil,
+		"synchronous": {SynchronousWrites(true)},
+		"writers":     {WithWriters(3)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			db, err := OpenWithLimit(t.TempDir(), 4096, opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+
+			const goroutines, rounds = 8, 50
+			var wg sync.WaitGroup
+			for g := 0; g < goroutines; g++ {
+				wg.Add(1)
+				go func() {
+					defer wg.Done()
+					for i := 0; i < rounds; i++ {
+						if _, err := db.Append("log", fmt.Sprintf("<%d:%02d>", g, i)); err != nil {
+							t.Error(err)
+							return
+						}
+					}
+				}()
+			}
+			wg.Wait()
+
+			got, err := db.Get("log")
+			if err != nil {
+				t.Fatal(err)
+			}
+			if want := goroutines * rounds * len("<0:00>"); len(got) != want {
+				t.Errorf("log holds %d bytes, want %d", len(got), want)
+			}
+			for g := 0; g < goroutines; g++ {
+				for i := 0; i < rounds; i++ {
+					if piece := fmt.Sprintf("<%d:%02d>", g, i); !strings.Contains(got, piece) {
+						t.Errorf("log lacks %s", piece)
+					}
+				}
+			}
+
+			if n, err := db.Append("new", "abc"); err != nil || n != 3 {
+				t.Errorf("Append() to a missing key = %d, %v", n, err)
+			}
+			if n, err := db.Append("new", "de"); err != nil || n != 5 {
+				t.Errorf("Append() = %d, %v", n, err)
+			}
+			if got, _ := db.Get("new"); got != "abcde" {
+				t.Errorf("Get(new) = %q", got)
+			}
+			if _, err := db.Append("", "x"); !errors.Is(err, ErrEmptyKey) {
+				t.Errorf("Append() to an empty key: %v", err)
+			}
+		})
+	}
+}
+
+func TestDb_PutIfAbsent(t *testing.T) {
+	db, err := Open(t.TempDir(), WithWriters(2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	const goroutines = 20
+	var (
+		wg      sync.WaitGroup
+		mu      sync.Mutex
+		winners []int
+	)
+	start := make(chan struct{})
+	for g := 0; g < goroutines; g++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			<-start
+			ok, err := db.PutIfAbsent("init", fmt.Sprint(g))
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			if ok {
+				mu.Lock()
+				winners = append(winners, g)
+				mu.Unlock()
+			}
+		}()
+	}
+	close(start)
+	wg.Wait()
+	if len(winners) != 1 {
+		t.Fatalf("PutIfAbsent succeeded for %v, want exactly one", winners)
+	}
+	if got, err := db.Get("init"); err != nil || got != fmt.Sprint(winners[0]) {
+		t.Errorf("Get(init) = %q, %v; want the value of %d", got, err, winners[0])
+	}
+
+	if err := db.Delete("init"); err != nil {
+		t.Fatal(err)
+	}
+	if ok, err := db.PutIfAbsent("init", "again"); err != nil || !ok {
+		t.Errorf("PutIfAbsent after Delete = %v, %v", ok, err)
+	}
+}
+
+func TestDb_Logger(t *testing.T) {
+	var out bytes.Buffer
+	logger := slog.New(slog.NewTextHandler(&out, &slog.HandlerOptions{Level: slog.LevelDebug}))
+	db, err := OpenWithLimit(t.TempDir(), 100, WithLogger(logger))
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 10; i++ {
+		if err := db.Put("key", fmt.Sprintf("value-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	logs := out.String()
+	for _, want := range []string{
+		`level=DEBUG msg="datastore: segment rolled over" sealed=1 `,
+		`level=DEBUG msg="datastore: compaction finished" segments=`,
+	} {
+		if !strings.Contains(logs, want) {
+			t.Errorf("log output lacks %q:\n%s", want, logs)
+		}
+	}
+}
+
+func TestDb_Close(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("k", "v"); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Errorf("Second Close failed: %v", err)
+	}
+
+	if err := db.Put("k", "v2"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from Put, got %v", err)
+	}
+	if _, err := db.Get("k"); !errors.Is(err, ErrClosed) {
+		t.Errorf("Expected ErrClosed from Get, got %v", err)
+	}
+}
+
+func TestDb_CloseDrainsQueuedWrites(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var queued []writeRequest
+	for i := 0; i < 50; i++ {
+		req := writeRequest{
+			entries: []entry{{key: fmt.Sprintf("key-%d", i), value: []byte("v")}},
+			done:    make(chan writeResult, 1),
+		}
+		db.partitions[0].writeCh <- req
+		queued = append(queued, req)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	for _, req := range queued {
+		select {
+		case res := <-req.done:
+			if res.err != nil {
+				t.Errorf("Queued write failed: %v", res.err)
+			}
+		default:
+			t.Fatal("Queued write was not processed before Close returned")
+		}
+	}
+
+	db, err = Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if n := len(db.Keys()); n != 50 {
+		t.Errorf("Expected 50 keys after reopen, got %d", n)
+	}
+}
+
+func TestDb_CloseDuringPut(t *testing.T) {
+	// Without a writer goroutine a Put blocks until the store is closed.
+	for name, buffer := range map[string]int{"stuck send": 0, "stuck reply": 1} {
+		t.Run(name, func(t *testing.T) {
+			stopped := make(chan struct{})
+			close(stopped)
+			db := &Db{
+				partitions: []*partition{{writeCh: make(chan writeRequest, buffer), stopped: stopped}},
+				closeCh:    make(chan struct{}),
+			}
+			errs := make(chan error, 1)
+			go func() {
+				errs <- db.Put("k", "v")
+			}()
+			time.Sleep(20 * time.Millisecond)
+			close(db.closeCh)
+			select {
+			case err := <-errs:
+				if !errors.Is(err, ErrClosed) {
+					t.Errorf("Put() = %v, want ErrClosed", err)
+				}
+			case <-time.After(time.Second):
+				t.Fatal("Put() still blocked after Close")
+			}
+		})
+	}
+
+	t.Run("racing puts", func(t *testing.T) {
+		db, err := Open(t.TempDir(), WithWriteBuffer(0))
+		if err != nil {
+			t.Fatal(err)
+		}
+		var wg sync.WaitGroup
+		for g := 0; g < 20; g++ {
+			wg.Add(1)
+			go func() {
+				defer wg.Done()
+				for i := 0; ; i++ {
+					err := db.Put(fmt.Sprintf("g%d-%d", g, i), "v")
+					if errors.Is(err, ErrClosed) {
+						return
+					}
+					if err != nil {
+						t.Error(err)
+						return
+					}
+				}
+			}()
+		}
+		time.Sleep(20 * time.Millisecond)
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		done := make(chan struct{})
+		go func() {
+			wg.Wait()
+			close(done)
+		}()
+		select {
+		case <-done:
+		case <-time.After(5 * time.Second):
+			t.Fatal("Puts still blocked after Close")
+		}
+	})
+}
+
+func TestDb_PutContext(t *testing.T) {
+	t.Run("stuck send", func(t *testing.T) {
+		db := &Db{partitions: []*partition{{writeCh: make(chan writeRequest)}}}
+		ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		if err := db.PutContext(ctx, "k", "v"); !errors.Is(err, context.DeadlineExceeded) {
+			t.Errorf("Expected deadline error, got %v", err)
+		}
+	})
+
+	t.Run("stuck writer", func(t *testing.T) {
+		db := &Db{partitions: []*partition{{writeCh: make(chan writeRequest, 1)}}}
+		ctx, cancel := context.WithCancel(context.Background())
+		go func() {
+			time.Sleep(50 * time.Millisecond)
+			cancel()
+		}()
+		if err := db.PutContext(ctx, "k", "v"); !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected cancellation error, got %v", err)
+		}
+	})
+
+	t.Run("cancelled get", func(t *testing.T) {
+		db := &Db{}
+		ctx, cancel := context.WithCancel(context.Background())
+		cancel()
+		if _, err := db.GetContext(ctx, "k"); !errors.Is(err, context.Canceled) {
+			t.Errorf("Expected cancellation error, got %v", err)
+		}
+	})
+}
+
+func TestDb_Scan(t *testing.T) {
+	db, err := OpenWithLimit(t.TempDir(), 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	for i := 3; i > 0; i-- {
+		for _, prefix := range []string{"user:1:", "user:12:", "user:2:"} {
+			if err := db.Put(fmt.Sprintf("%sfield%d", prefix, i), prefix); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+
+	res, err := db.Scan("user:1:")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(res) != 3 {
+		t.Errorf("Expected 3 matches, got %v", res)
+	}
+
+	res, err = db.ScanSorted("user:1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var keys []string
+	for _, kv := range res {
+		keys = append(keys, kv.Key)
+		if !strings.HasPrefix(kv.Key, kv.Value) {
+			t.Errorf("Unexpected value %q for %q", kv.Value, kv.Key)
+		}
+	}
+	expected := []string{
+		"user:12:field1", "user:12:field2", "user:12:field3",
+		"user:1:field1", "user:1:field2", "user:1:field3",
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Unexpected sorted keys %v", keys)
+	}
+
+	if res, err := db.Scan("missing:"); err != nil || len(res) != 0 {
+		t.Errorf("Expected empty scan, got %v, %v", res, err)
+	}
+}
+
+func BenchmarkDb_Put(b *testing.B) {
+	const batchSize = 100
+	pairs := make([]KV, batchSize)
+	for i := range pairs {
+		pairs[i] = KV{Key: fmt.Sprintf("key-%d", i), Value: fmt.Sprintf("value-%d", i)}
+	}
+
+	b.Run("individual", func(b *testing.B) {
+		db, err := Open(b.TempDir())
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer db.Close()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			for _, p := range pairs {
+				if err := db.Put(p.Key, p.Value); err != nil {
+					b.Fatal(err)
+				}
+			}
+		}
+	})
+
+	b.Run("batch", func(b *testing.B) {
+		db, err := Open(b.TempDir())
+		if err != nil {
+			b.Fatal(err)
+		}
+		defer db.Close()
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := db.PutBatch(pairs); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkDb_Get(b *testing.B) {
+	tmp := b.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	const count = 1000
+	for i := 0; i < count; i++ {
+		if err := db.Put(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.Run("reopen", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			key := fmt.Sprintf("key-%d", i%count)
+			ref, _ := db.index.get(key)
+
+			f, err := os.Open(fmt.Sprintf("%s/segment-%d", tmp, ref.segmentId))
+			if err != nil {
+				b.Fatal(err)
+			}
+			if _, err := f.Seek(ref.offset, 0); err != nil {
+				b.Fatal(err)
+			}
+			var record entry
+			if _, err := record.DecodeFromReader(bufio.NewReader(f)); err != nil {
+				b.Fatal(err)
+			}
+			_ = f.Close()
+		}
+	})
+
+	b.Run("cached", func(b *testing.B) {
+		for i := 0; i < b.N; i++ {
+			if _, err := db.Get(fmt.Sprintf("key-%d", i%count)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkDb_GetVerify(b *testing.B) {
+	value := strings.Repeat("v", 1<<20)
+	for _, verify := range []bool{true, false} {
+		b.Run(fmt.Sprintf("verify=%t", verify), func(b *testing.B) {
+			db, err := Open(b.TempDir(), WithVerifyOnRead(verify))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			if err := db.Put("big", value); err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(int64(len(value)))
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := db.GetBytes("big"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// BenchmarkDb_GetLarge is meant to be run with -benchmem: a read should
+// allocate little beyond the record buffer.
+func BenchmarkDb_GetLarge(b *testing.B) {
+	for name, algo := range map[string]Checksum{"crc32c": ChecksumCRC32C, "sha1": ChecksumSHA1} {
+		b.Run(name, func(b *testing.B) {
+			db, err := Open(b.TempDir(), WithChecksum(algo))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			value := strings.Repeat("v", 512<<10)
+			if err := db.Put("big", value); err != nil {
+				b.Fatal(err)
+			}
+			b.SetBytes(int64(len(value)))
+			b.ReportAllocs()
+			b.ResetTimer()
+			for i := 0; i < b.N; i++ {
+				if _, err := db.GetBytes("big"); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+func BenchmarkDb_GetParallel(b *testing.B) {
+	db, err := OpenWithLimit(b.TempDir(), 4096)
+	if err != nil {
+		b.Fatal(err)
+	}
+	b.Cleanup(func() {
+		_ = db.Close()
+	})
+
+	const count = 1000
+	for i := 0; i < count; i++ {
+		if err := db.Put(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i)); err != nil {
+			b.Fatal(err)
+		}
+	}
+
+	b.ResetTimer()
+	b.RunParallel(func(pb *testing.PB) {
+		i := 0
+		for pb.Next() {
+			key := fmt.Sprintf("key-%d", i%count)
+			if v, err := db.Get(key); err != nil || v != fmt.Sprintf("value-%d", i%count) {
+				b.Errorf("Get(%s) = %q, %v", key, v, err)
+				return
+			}
+			i++
+		}
+	})
+}
+
+// BenchmarkDb_Mixed runs readers in parallel with a stream of writes to
+// compare a single index lock against a sharded index.
+func BenchmarkDb_Mixed(b *testing.B) {
+	for _, shards := range []int{1, 4, 16} {
+		b.Run(fmt.Sprintf("shards=%d", shards), func(b *testing.B) {
+			db, err := Open(b.TempDir(), WithIndexShards(shards))
+			if err != nil {
+				b.Fatal(err)
+			}
+			b.Cleanup(func() {
+				_ = db.Close()
+			})
+
+			const count = 1000
+			for i := 0; i < count; i++ {
+				if err := db.Put(fmt.Sprintf("key-%d", i), "value"); err != nil {
+					b.Fatal(err)
+				}
+			}
+
+			stop := make(chan struct{})
+			done := make(chan struct{})
+			go func() {
+				defer close(done)
+				for i := 0; ; i++ {
+					select {
+					case <-stop:
+						return
+					default:
+					}
+					_ = db.Put(fmt.Sprintf("key-%d", i%count), "value")
+				}
+			}()
+
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				i := 0
+				for pb.Next() {
+					if _, err := db.Get(fmt.Sprintf("key-%d", i%count)); err != nil {
+						b.Error(err)
+						return
+					}
+					i++
+				}
+			})
+			b.StopTimer()
+			close(stop)
+			<-done
+		})
+	}
+}
+
+// benchmarkStores runs bench against stores holding values of several sizes,
+// with a segment limit that makes writes roll over every few records and
+// with the default one, where they rarely do.
+func benchmarkStores(b *testing.B, bench func(b *testing.B, db *Db, value string)) {
+	for _, size := range []int{16, 256, 4096} {
+		for _, rollover := range []struct {
+			name  string
+			limit int64
+		}{{"frequent", 16 * 1024}, {"rare", defaultMaxSegmentSize}} {
+			b.Run(fmt.Sprintf("value=%d/rollover=%s", size, rollover.name), func(b *testing.B) {
+				db, err := OpenWithLimit(b.TempDir(), rollover.limit)
+				if err != nil {
+					b.Fatal(err)
+				}
+				b.Cleanup(func() {
+					_ = db.Close()
+				})
+				b.ReportAllocs()
+				bench(b, db, strings.Repeat("v", size))
+			})
+		}
+	}
+}
+
+const benchKeys = 1000
+
+func BenchmarkPut(b *testing.B) {
+	benchmarkStores(b, func(b *testing.B, db *Db, value string) {
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if err := db.Put(fmt.Sprintf("key-%d", i%benchKeys), value); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkGet(b *testing.B) {
+	benchmarkStores(b, func(b *testing.B, db *Db, value string) {
+		for i := 0; i < benchKeys; i++ {
+			if err := db.Put(fmt.Sprintf("key-%d", i), value); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			if _, err := db.Get(fmt.Sprintf("key-%d", i%benchKeys)); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+// BenchmarkPutGetMixed does one Put for every three Gets.
+func BenchmarkPutGetMixed(b *testing.B) {
+	benchmarkStores(b, func(b *testing.B, db *Db, value string) {
+		for i := 0; i < benchKeys; i++ {
+			if err := db.Put(fmt.Sprintf("key-%d", i), value); err != nil {
+				b.Fatal(err)
+			}
+		}
+		b.ResetTimer()
+		for i := 0; i < b.N; i++ {
+			key := fmt.Sprintf("key-%d", i%benchKeys)
+			if i%4 == 0 {
+				if err := db.Put(key, value); err != nil {
+					b.Fatal(err)
+				}
+			} else if _, err := db.Get(key); err != nil {
+				b.Fatal(err)
+			}
+		}
+	})
+}
+
+func BenchmarkDb_Recovery(b *testing.B) {
+	tmp := b.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		b.Fatal(err)
+	}
+	pairs := make([]KV, 100)
+	for i := 0; i < 200; i++ {
+		for j := range pairs {
+			pairs[j] = KV{Key: fmt.Sprintf("key-%d-%d", i, j), Value: "small value"}
+		}
+		if err := db.PutBatch(pairs); err != nil {
+			b.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		b.Fatal(err)
+	}
+
+	b.ReportAllocs()
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		db, err := Open(tmp)
+		if err != nil {
+			b.Fatal(err)
+		}
+		_ = db.Close()
+	}
+}
+
+func TestDb_ValueCache(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := OpenWithLimit(tmp, 100, WithValueCache(1<<20))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	for _, k := range []string{"a", "b", "c", "d"} {
+		if err := db.Put(k, "value-"+k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	ref, _ := db.index.get("a")
+	if other, _ := db.index.get("b"); other.segmentId != ref.segmentId {
+		t.Fatalf("a and b are in different segments: %v, %v", ref, other)
+	}
+	if got, err := db.Get("a"); err != nil || got != "value-a" {
+		t.Fatalf("Get(a) = %q, %v", got, err)
+	}
+	value, err := db.GetBytes("c")
+	if err != nil {
+		t.Fatal(err)
+	}
+	value[0] = 'X'
+	if got, _ := db.Get("c"); got != "value-c" {
+		t.Errorf("Modifying a returned value changed the cache: %q", got)
+	}
+
+	// With the segment gone, only the cached value is still readable.
+	db.mu.Lock()
+	if f, ok := db.segments[ref.segmentId]; ok {
+		_ = f.Close()
+		delete(db.segments, ref.segmentId)
+	}
+	db.mu.Unlock()
+	if err := os.Remove(filepath.Join(tmp, segmentFilename(ref.segmentId))); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.Get("a"); err != nil || got != "value-a" {
+		t.Errorf("Cached Get(a) = %q, %v", got, err)
+	}
+	if _, err := db.Get("b"); !errors.Is(err, ErrSegmentMissing) {
+		t.Errorf("Uncached Get(b) error = %v, want ErrSegmentMissing", err)
+	}
+	st, _ := db.Stats()
+	if st.CacheHits != 2 || st.CacheMisses != 3 || st.CacheBytes <= 0 {
+		t.Errorf("Unexpected cache stats %+v", st)
+	}
+
+	if err := db.Put("a", "new"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.Get("a"); err != nil || got != "new" {
+		t.Errorf("Get(a) after Put = %q, %v", got, err)
+	}
+	if err := db.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := db.Get("a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get(a) after Delete error = %v, want ErrNotFound", err)
+	}
+}
+
+func TestDb_Warmup(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := OpenWithLimit(tmp, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"user-1", "other", "user-2", "user-3"} {
+		if err := db.Put(k, "value-"+k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, err := Open(tmp, WithWarmup("user-", 2)); err == nil {
+		t.Error("Expected WithWarmup without a value cache to fail")
+	}
+	db, err = Open(tmp, WithValueCache(1<<20), WithWarmup("user-", 2), WithWarmupTimeout(-time.Second))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if st, _ := db.Stats(); st.CacheBytes != 0 {
+		t.Errorf("Warm-up past its timeout cached %d bytes", st.CacheBytes)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenWithLimit(tmp, 100, WithValueCache(1<<20), WithWarmup("user-", 2))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	// Warmed keys stay readable without their segment files.
+	db.mu.Lock()
+	for id, f := range db.segments {
+		_ = f.Close()
+		delete(db.segments, id)
+	}
+	db.mu.Unlock()
+	segments, err := listSegments(db.fsys)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, s := range segments {
+		if err := os.Remove(db.diskPath(s.name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, k := range []string{"user-2", "user-3"} {
+		if got, err := db.Get(k); err != nil || got != "value-"+k {
+			t.Errorf("Get(%s) = %q, %v", k, got, err)
+		}
+	}
+	for _, k := range []string{"user-1", "other"} {
+		if _, err := db.Get(k); err == nil {
+			t.Errorf("Get(%s) of a key left out of the warm-up succeeded", k)
+		}
+	}
+}
+
+func TestDb_HashedKeys(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := OpenWithLimit(tmp, 100, WithHashedKeys())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// Every key shares one digest, as if they all collided.
+	db.index.digest = func(string) string { return "digest" }
+
+	for _, k := range []string{"a", "b", "c", "a"} {
+		if err := db.Put(k, "value-"+k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("c"); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b"} {
+		if got, err := db.Get(k); err != nil || got != "value-"+k {
+			t.Errorf("Get(%s) = %q, %v", k, got, err)
+		}
+	}
+	for _, k := range []string{"c", "missing"} {
+		if _, err := db.Get(k); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get(%s) of an absent key sharing a digest: %v", k, err)
+		}
+		if ok, _, _ := db.Exists(k); ok {
+			t.Errorf("Exists(%s) of an absent key sharing a digest", k)
+		}
+	}
+	if err := db.Delete("missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Delete() of an absent key sharing a digest: %v", err)
+	}
+	keys := db.Keys()
+	sort.Strings(keys)
+	if !reflect.DeepEqual(keys, []string{"a", "b"}) {
+		t.Errorf("Keys() = %v", keys)
+	}
+
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("a"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.Get("b"); err != nil || got != "value-b" {
+		t.Errorf("Get(b) after deleting a = %q, %v", got, err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenWithLimit(tmp, 100, WithHashedKeys())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if _, err := db.Get("a"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Get(a) after reopening: %v", err)
+	}
+	if got, err := db.Get("b"); err != nil || got != "value-b" {
+		t.Errorf("Get(b) after reopening = %q, %v", got, err)
+	}
+}
+
+func TestDb_Modified(t *testing.T) {
+	tmp := t.TempDir()
+	now := time.Date(2024, 1, 1, 0, 0, 0, 0, time.UTC)
+	db, err := OpenWithLimit(tmp, 100, func(o *options) {
+		o.clock = func() time.Time { return now }
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	modified := func(key string) time.Time {
+		t.Helper()
+		_, meta, err := db.GetWithMetadata(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return meta.Modified
+	}
+	if err := db.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	first := modified("a")
+	if !first.Equal(now) {
+		t.Errorf("Modified = %v, want %v", first, now)
+	}
+	// A clock standing still or going back does not reorder the writes.
+	now = now.Add(-time.Hour)
+	if err := db.Put("a", "2"); err != nil {
+		t.Fatal(err)
+	}
+	second := modified("a")
+	if !second.After(first) {
+		t.Errorf("Modified after a re-put = %v, want after %v", second, first)
+	}
+
+	for i := 0; i < 5; i++ {
+		if err := db.Put(fmt.Sprintf("key-%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = OpenWithLimit(tmp, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if got := modified("a"); !got.Equal(second) {
+		t.Errorf("Modified after compacting and reopening = %v, want %v", got, second)
+	}
+}
+
+func TestDb_SegmentIdsNeverReused(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := OpenWithLimit(tmp, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; i < 12; i++ {
+		if err := db.Put(fmt.Sprintf("key-%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	maxId := func() int {
+		t.Helper()
+		segments, err := listSegments(os.DirFS(tmp))
+		if err != nil || len(segments) == 0 {
+			t.Fatalf("listSegments() = %v, %v", segments, err)
+		}
+		return segments[len(segments)-1].id
+	}
+	// Leave a gap in the middle of the ids.
+	last := maxId()
+	if last < 4 {
+		t.Fatalf("only %d segments were written", last)
+	}
+	if err := os.Remove(filepath.Join(tmp, segmentFilename(2))); err != nil {
+		t.Fatal(err)
+	}
+	_ = os.Remove(filepath.Join(tmp, segmentFilename(2)+hintFileSuffix))
+
+	db, err = OpenWithLimit(tmp, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	// A file taking the next id, as left by something else, is skipped.
+	if err := os.WriteFile(filepath.Join(tmp, segmentFilename(last+1)), nil, 0o600); err != nil {
+		t.Fatal(err)
+	}
+	for i := 0; db.partitions[0].segmentId == last; i++ {
+		if err := db.Put(fmt.Sprintf("more-%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if id := db.partitions[0].segmentId; id != last+2 {
+		t.Errorf("segment after %d with %d taken = %d", last, last+1, id)
+	}
+
+	last = maxId()
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Clear(); err != nil {
+		t.Fatal(err)
+	}
+	if id := db.partitions[0].segmentId; id <= last {
+		t.Errorf("segment after Clear = %d, want above %d", id, last)
+	}
+	if err := db.Put("k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := db.Get("k"); err != nil || got != "v" {
+		t.Errorf("Get() after Clear = %q, %v", got, err)
+	}
+}
+
+func TestDb_Lock(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Put("k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if second, err := Open(tmp); !errors.Is(err, ErrLocked) {
+		if err == nil {
+			_ = second.Close()
+		}
+		t.Fatalf("second Open() of a locked directory: %v, want ErrLocked", err)
+	}
+
+	ro, err := OpenReadOnly(tmp)
+	if err != nil {
+		t.Fatalf("OpenReadOnly() of a locked directory: %v", err)
+	}
+	if got, err := ro.Get("k"); err != nil || got != "v" {
+		t.Errorf("Get() of the read-only instance = %q, %v", got, err)
+	}
+	_ = ro.Close()
+
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+	db, err = Open(tmp)
+	if err != nil {
+		t.Fatalf("Open() after Close: %v", err)
+	}
+	_ = db.Close()
+}
@@ -0,0 +1,98 @@
+package datastore
+
+import (
+	"bufio"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+)
+
+// DumpSegment writes one line per record of the segment file at path to w,
+// with its offset, key, value length and whether its checksum matches. A
+// corrupted record is reported and skipped using its size field, so the
+// records after it are dumped too; a size field that cannot be right ends
+// the dump. Values are not decrypted, so encrypted segments can be dumped
+// without their key. DumpSegment only fails if path cannot be read or w
+// cannot be written.
+func DumpSegment(path string, w io.Writer) error {
+	f, err := os.Open(path)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	info, err := f.Stat()
+	if err != nil {
+		return err
+	}
+
+	in := bufio.NewReader(f)
+	offset := int64(0)
+	records, corrupted := 0, 0
+	for {
+		var sizeBuf [4]byte
+		n, err := io.ReadFull(in, sizeBuf[:])
+		if errors.Is(err, io.EOF) {
+			break
+		}
+		size := int64(binary.LittleEndian.Uint32(sizeBuf[:]) &^ taggedRecord)
+		if err != nil || size < int64(len(sizeBuf)) || offset+size > info.Size() {
+			corrupted++
+			if _, err := fmt.Fprintf(w, "offset=%d size=%d truncated or invalid size, %d bytes left unread\n", offset, size, info.Size()-offset); err != nil {
+				return err
+			}
+			break
+		}
+		buf := make([]byte, size)
+		copy(buf, sizeBuf[:n])
+		if _, err := io.ReadFull(in, buf[n:]); err != nil {
+			return err
+		}
+
+		records++
+		line, ok := dumpRecord(offset, buf)
+		if !ok {
+			corrupted++
+		}
+		if _, err := fmt.Fprintln(w, line); err != nil {
+			return err
+		}
+		offset += size
+	}
+	_, err = fmt.Fprintf(w, "records=%d corrupted=%d bytes=%d\n", records, corrupted, offset)
+	return err
+}
+
+// dumpRecord describes the record at offset and reports whether it is
+// intact.
+func dumpRecord(offset int64, record []byte) (string, bool) {
+	var e entry
+	err := e.decodeStored(record)
+	if err != nil && e.key == "" && e.value == nil {
+		return fmt.Sprintf("offset=%d size=%d checksum=BAD unreadable header", offset, len(record)), false
+	}
+	value := fmt.Sprintf("value_len=%d", len(e.value))
+	if e.deleted {
+		value = "tombstone"
+	}
+	checksum := "ok"
+	if err != nil {
+		checksum = "BAD"
+	}
+	line := fmt.Sprintf("offset=%d size=%d key=%q %s checksum=%s", offset, len(record), e.key, value, checksum)
+	if e.sum != nil {
+		line += " sum=" + hex.EncodeToString(e.sum)
+	}
+	if e.compressed {
+		line += " compressed"
+	}
+	if e.encrypted {
+		line += " encrypted"
+	}
+	if e.chunk != nil {
+		line += fmt.Sprintf(" chunk next=%d:%d", e.chunk.nextSegment, e.chunk.nextOffset)
+	}
+	return line, err == nil
+}
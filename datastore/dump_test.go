@@ -0,0 +1,68 @@
+package datastore
+
+import (
+	"bytes"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDumpSegment(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := Open(tmp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"a", "b", "c"} {
+		if err := db.Put(k, "value-"+k); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Delete("c"); err != nil {
+		t.Fatal(err)
+	}
+	_, meta, err := db.GetWithMetadata("b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Damage the value of b, leaving its header intact.
+	path := filepath.Join(tmp, segmentFilename(meta.SegmentID))
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[meta.Offset+13+1] ^= 0xff
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	var out bytes.Buffer
+	if err := DumpSegment(path, &out); err != nil {
+		t.Fatal(err)
+	}
+	lines := strings.Split(strings.TrimSuffix(out.String(), "\n"), "\n")
+	if len(lines) != 5 {
+		t.Fatalf("DumpSegment() wrote %d lines:\n%s", len(lines), out.String())
+	}
+	for i, want := range []string{
+		`offset=0 size=33 key="a" value_len=7 checksum=ok`,
+		fmt.Sprintf(`offset=%d size=33 key="b" value_len=7 checksum=BAD`, meta.Offset),
+		`key="c" value_len=7 checksum=ok`,
+		`key="c" tombstone checksum=ok`,
+		fmt.Sprintf("records=4 corrupted=1 bytes=%d", len(data)),
+	} {
+		if !strings.Contains(lines[i], want) {
+			t.Errorf("line %d = %q, want it to contain %q", i, lines[i], want)
+		}
+	}
+
+	if err := DumpSegment(filepath.Join(tmp, "missing"), &out); !os.IsNotExist(err) {
+		t.Errorf("DumpSegment() of a missing file: %v", err)
+	}
+}
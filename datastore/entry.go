@@ -2,57 +2,378 @@ package datastore
 
 import (
 	"bufio"
+	"bytes"
+	"compress/flate"
+	"crypto/cipher"
+	"crypto/rand"
 	"crypto/sha1"
 	"encoding/binary"
 	"errors"
 	"fmt"
+	"hash/crc32"
 	"io"
+	"math"
 )
 
 var ErrCorrupted = errors.New("data corrupted")
 
+// Checksum selects the algorithm used to detect corrupted values.
+type Checksum byte
+
+const (
+	ChecksumSHA1 Checksum = iota + 1
+	ChecksumCRC32C
+
+	defaultChecksum = ChecksumCRC32C
+)
+
+var castagnoli = crc32.MakeTable(crc32.Castagnoli)
+
+func (c Checksum) size() int {
+	switch c {
+	case ChecksumSHA1:
+		return sha1.Size
+	case ChecksumCRC32C:
+		return crc32.Size
+	}
+	return 0
+}
+
+func (c Checksum) sum(data []byte) []byte {
+	switch c {
+	case ChecksumSHA1:
+		hash := sha1.Sum(data)
+		return hash[:]
+	case ChecksumCRC32C:
+		return binary.LittleEndian.AppendUint32(nil, crc32.Checksum(data, castagnoli))
+	}
+	return nil
+}
+
+// matches reports whether want is the checksum of data. Unlike comparing
+// with sum, it computes the checksum without allocating.
+func (c Checksum) matches(data, want []byte) bool {
+	switch c {
+	case ChecksumSHA1:
+		hash := sha1.Sum(data)
+		return equalHash(want, hash[:])
+	case ChecksumCRC32C:
+		return len(want) == 4 && binary.LittleEndian.Uint32(want) == crc32.Checksum(data, castagnoli)
+	}
+	return false
+}
+
 type entry struct {
-	key, value string
+	key      string
+	value    []byte
+	checksum Checksum
+	deleted  bool
+	// compressed marks value as flate-compressed. Encode writes the value as
+	// is; Decode inflates it after verifying the checksum.
+	compressed bool
+	// encrypted marks value as sealed with aead. Like compression it is
+	// applied by the writer; Decode opens the value using aead, which the
+	// caller must set beforehand.
+	encrypted bool
+	aead      cipher.AEAD
+	// skipVerify makes Decode skip the checksum comparison, see
+	// WithVerifyOnRead. The caller sets it before decoding.
+	skipVerify bool
+	// sum is the checksum stored in the record, set by Decode.
+	sum []byte
+	// modified is the write time of the record in Unix nanoseconds, or 0 for
+	// records written without one.
+	modified int64
+	// chunk is set for the records of a value split by WithChunkedValues.
+	// Decode then leaves the value as stored, for the caller to append the
+	// other chunks and call unseal.
+	chunk *chunkLink
+}
+
+// chunkLink is stored with every chunk of a chunked value. The chunks are
+// written last to first, each pointing at the one written before it, and
+// only the first chunk, written last, has the key. So the index points at
+// the first chunk, and a value cut short by a crash is never visible.
+type chunkLink struct {
+	// nextSegment and nextOffset locate the following chunk; nextSegment is
+	// 0 for the last one.
+	nextSegment int
+	nextOffset  int64
+	// valueSize is the length of the whole value, and start the segment of
+	// the chunk written first. Both are only set in the first chunk.
+	valueSize int
+	start     int
 }
 
+// Untagged records, written before the checksum became configurable:
 // 0           4     8     kl+8    kl+12     kl+12+vl    <-- offset
 // (full size) (kl)  (key) (vl)    (value)   (hash[20])
 // 4           4     ....  4       .....     20          <-- length
+//
+// Tagged records have the highest bit of the size field set:
+// 0           4       5     9      kl+9  kl+13     kl+13+vl    <-- offset
+// (full size) (algo)  (kl)  (key)  (vl)  (value)   (checksum)
+// 4           1       4     ....   4     .....     algo size   <-- length
+//
+// With flagModified the value is followed by the write time of the record
+// as 8 bytes of Unix nanoseconds, before the checksum. With flagChunk the
+// chunk link comes next, as (next segment[4]) (next offset[8])
+// (value size[8]) (start[4]).
+//
+// A tagged record with vl set to tombstoneLength and no value marks the key
+// as deleted.
+//
+// The low bits of the algo byte select the checksum; the higher bits are
+// flags describing how the record is stored. With flagWholeRecord, set on
+// every record written now, the checksum covers all bytes before it;
+// without it only the stored value is covered.
+
+const (
+	taggedRecord    = 1 << 31
+	tombstoneLength = math.MaxUint32
+
+	checksumMask   = 0x07
+	flagCompressed = 0x08
+	flagEncrypted  = 0x10
+
+	flagWholeRecord = 0x20
+	flagModified    = 0x40
+	flagChunk       = 0x80
+
+	modifiedSize  = 8
+	chunkLinkSize = 24
+)
 
 func (e *entry) Encode() []byte {
+	algo := e.checksum
+	if algo == 0 {
+		algo = defaultChecksum
+	}
 	kl, vl := len(e.key), len(e.value)
-	hash := sha1.Sum([]byte(e.value)) // [20]byte
+	vlField := uint32(vl)
+	if e.deleted {
+		vl, vlField = 0, tombstoneLength
+	}
+
+	tl := 0
+	if e.modified != 0 {
+		tl = modifiedSize
+	}
+	if e.chunk != nil {
+		tl += chunkLinkSize
+	}
 
-	size := kl + vl + 12 + len(hash)
+	size := kl + vl + 13 + tl + algo.size()
 	res := make([]byte, size)
 
-	binary.LittleEndian.PutUint32(res, uint32(size))
-	binary.LittleEndian.PutUint32(res[4:], uint32(kl))
-	copy(res[8:], e.key)
-	binary.LittleEndian.PutUint32(res[kl+8:], uint32(vl))
-	copy(res[kl+12:], e.value)
-	copy(res[kl+12+vl:], hash[:])
+	binary.LittleEndian.PutUint32(res, uint32(size)|taggedRecord)
+	res[4] = byte(algo) | flagWholeRecord
+	if e.compressed {
+		res[4] |= flagCompressed
+	}
+	if e.encrypted {
+		res[4] |= flagEncrypted
+	}
+	binary.LittleEndian.PutUint32(res[5:], uint32(kl))
+	copy(res[9:], e.key)
+	binary.LittleEndian.PutUint32(res[kl+9:], vlField)
+	copy(res[kl+13:], e.value[:vl])
+	trailer := res[kl+13+vl:]
+	if e.modified != 0 {
+		res[4] |= flagModified
+		binary.LittleEndian.PutUint64(trailer, uint64(e.modified))
+		trailer = trailer[modifiedSize:]
+	}
+	if c := e.chunk; c != nil {
+		res[4] |= flagChunk
+		binary.LittleEndian.PutUint32(trailer, uint32(c.nextSegment))
+		binary.LittleEndian.PutUint64(trailer[4:], uint64(c.nextOffset))
+		binary.LittleEndian.PutUint64(trailer[12:], uint64(c.valueSize))
+		binary.LittleEndian.PutUint32(trailer[20:], uint32(c.start))
+	}
+	copy(res[kl+13+vl+tl:], algo.sum(res[:kl+13+vl+tl]))
 
 	return res
 }
 
 func (e *entry) Decode(input []byte) error {
-	kl := int(binary.LittleEndian.Uint32(input[4:]))
-	e.key = string(input[8 : 8+kl])
+	if err := e.decodeStored(input); err != nil {
+		return err
+	}
+	if e.chunk != nil {
+		return nil
+	}
+	return e.unseal()
+}
+
+// unseal decrypts and inflates the stored value.
+func (e *entry) unseal() error {
+	if e.encrypted {
+		value, err := openValue(e.aead, e.key, e.value)
+		if err != nil {
+			return ErrCorrupted
+		}
+		e.value, e.encrypted = value, false
+	}
+	if e.compressed {
+		value, err := inflate(e.value)
+		if err != nil {
+			return ErrCorrupted
+		}
+		e.value, e.compressed = value, false
+	}
+	return nil
+}
+
+// decodeStored decodes input like Decode but leaves the value as stored,
+// possibly compressed or encrypted. When only the checksum does not match,
+// it still sets the fields before returning ErrCorrupted.
+func (e *entry) decodeStored(input []byte) error {
+	if len(input) < 4 {
+		return ErrCorrupted
+	}
+	if binary.LittleEndian.Uint32(input)&taggedRecord == 0 {
+		return e.decodeUntagged(input)
+	}
+
+	// Lengths are checked against the input before slicing, so a damaged
+	// header is reported as corruption rather than a panic.
+	if len(input) < 13 {
+		return ErrCorrupted
+	}
+	flags := input[4]
+	algo := Checksum(flags & checksumMask)
+	if algo.size() == 0 {
+		return ErrCorrupted
+	}
+	kl := uint64(binary.LittleEndian.Uint32(input[5:]))
+	if kl > uint64(len(input)-13) {
+		return ErrCorrupted
+	}
+	valueStart := 13 + int(kl)
+	vlField := binary.LittleEndian.Uint32(input[valueStart-4:])
+	vl := uint64(vlField)
+	if vlField == tombstoneLength {
+		vl = 0
+	}
+	if vl > uint64(len(input)-valueStart) {
+		return ErrCorrupted
+	}
+	valueEnd := valueStart + int(vl)
+	end := valueEnd
+	if flags&flagModified != 0 {
+		end += modifiedSize
+	}
+	linkStart := end
+	if flags&flagChunk != 0 {
+		end += chunkLinkSize
+	}
+	if end > len(input) {
+		return ErrCorrupted
+	}
 
-	vl := int(binary.LittleEndian.Uint32(input[8+kl:]))
-	valueStart := 12 + kl
-	e.value = string(input[valueStart : valueStart+vl])
+	e.checksum = algo
+	e.sum = input[end:]
+	e.modified = 0
+	if flags&flagModified != 0 {
+		e.modified = int64(binary.LittleEndian.Uint64(input[valueEnd:]))
+	}
+	e.chunk = nil
+	if flags&flagChunk != 0 {
+		link := input[linkStart:end]
+		e.chunk = &chunkLink{
+			nextSegment: int(binary.LittleEndian.Uint32(link)),
+			nextOffset:  int64(binary.LittleEndian.Uint64(link[4:])),
+			valueSize:   int(binary.LittleEndian.Uint64(link[12:])),
+			start:       int(binary.LittleEndian.Uint32(link[20:])),
+		}
+	}
+	e.compressed = flags&flagCompressed != 0
+	e.encrypted = flags&flagEncrypted != 0
+	e.key = string(input[9 : valueStart-4])
+	e.deleted = vlField == tombstoneLength
+	e.value = input[valueStart:valueEnd]
 
-	expectedHash := input[valueStart+vl:]
-	actualHash := sha1.Sum([]byte(e.value))
+	covered := input[valueStart:valueEnd]
+	if flags&flagWholeRecord != 0 {
+		covered = input[:end]
+	}
+	if !e.skipVerify && !algo.matches(covered, input[end:]) {
+		return ErrCorrupted
+	}
+	return nil
+}
 
-	if !equalHash(expectedHash, actualHash[:]) {
+func (e *entry) decodeUntagged(input []byte) error {
+	if len(input) < 12 {
 		return ErrCorrupted
 	}
+	kl := uint64(binary.LittleEndian.Uint32(input[4:]))
+	if kl > uint64(len(input)-12) {
+		return ErrCorrupted
+	}
+	valueStart := 12 + int(kl)
+	vl := uint64(binary.LittleEndian.Uint32(input[valueStart-4:]))
+	if vl > uint64(len(input)-valueStart) {
+		return ErrCorrupted
+	}
+	e.key = string(input[8 : valueStart-4])
+	e.value = input[valueStart : valueStart+int(vl)]
+	e.checksum = ChecksumSHA1
+
+	expectedHash := input[valueStart+int(vl):]
+	if e.skipVerify {
+		e.sum = expectedHash
+		return nil
+	}
+	if !ChecksumSHA1.matches(e.value, expectedHash) {
+		return ErrCorrupted
+	}
+	e.sum = expectedHash
 	return nil
 }
 
+func deflate(value []byte) ([]byte, error) {
+	var buf bytes.Buffer
+	w, err := flate.NewWriter(&buf, flate.DefaultCompression)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := w.Write(value); err != nil {
+		return nil, err
+	}
+	if err := w.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+func inflate(data []byte) ([]byte, error) {
+	return io.ReadAll(flate.NewReader(bytes.NewReader(data)))
+}
+
+// sealValue encrypts value as (nonce)(ciphertext). The key is used as
+// additional data, so a value copied to a record of another key fails to
+// open.
+func sealValue(aead cipher.AEAD, key string, value []byte) ([]byte, error) {
+	nonce := make([]byte, aead.NonceSize(), aead.NonceSize()+len(value)+aead.Overhead())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return aead.Seal(nonce, nonce, value, []byte(key)), nil
+}
+
+func openValue(aead cipher.AEAD, key string, data []byte) ([]byte, error) {
+	if aead == nil {
+		return nil, errors.New("no encryption key")
+	}
+	if len(data) < aead.NonceSize() {
+		return nil, errors.New("encrypted value too short")
+	}
+	nonce, ciphertext := data[:aead.NonceSize()], data[aead.NonceSize():]
+	return aead.Open(nil, nonce, ciphertext, []byte(key))
+}
+
 func equalHash(a, b []byte) bool {
 	if len(a) != len(b) {
 		return false
@@ -66,21 +387,87 @@ func equalHash(a, b []byte) bool {
 }
 
 func (e *entry) DecodeFromReader(in *bufio.Reader) (int, error) {
+	n, _, err := e.decodeFromReaderBuf(in, nil)
+	return n, err
+}
+
+// decodeFromReaderBuf is like DecodeFromReader but reads the record into
+// buf when it is large enough, and returns the buffer to pass to the next
+// call. The value and checksum of e may point into the buffer, so they are
+// only valid until it is reused.
+func (e *entry) decodeFromReaderBuf(in *bufio.Reader, buf []byte) (int, []byte, error) {
 	sizeBuf, err := in.Peek(4)
 	if err != nil {
 		if errors.Is(err, io.EOF) {
+			if len(sizeBuf) > 0 {
+				return 0, buf, fmt.Errorf("DecodeFromReader, cannot read size: %w", io.ErrUnexpectedEOF)
+			}
+			return 0, buf, err
+		}
+		return 0, buf, fmt.Errorf("DecodeFromReader, cannot read size: %w", err)
+	}
+	size := int(binary.LittleEndian.Uint32(sizeBuf) &^ taggedRecord)
+	var record []byte
+	if size <= cap(buf) {
+		record = buf[:size]
+		var n int
+		n, err = io.ReadFull(in, record)
+		record = record[:n]
+	} else {
+		record, err = readRecord(in, size)
+		buf = record
+	}
+	n := len(record)
+	if err != nil {
+		return n, buf, fmt.Errorf("DecodeFromReader, cannot read record: %w", err)
+	}
+	if err := e.Decode(record); err != nil {
+		return n, buf, err
+	}
+	return n, buf, nil
+}
+
+// DecodeAt decodes the record at offset of r with one ReadAt for the size
+// field and one for the record, so no buffered reader is needed.
+func (e *entry) DecodeAt(r io.ReaderAt, offset int64) (int, error) {
+	var sizeBuf [4]byte
+	n, err := r.ReadAt(sizeBuf[:], offset)
+	if n < len(sizeBuf) {
+		if errors.Is(err, io.EOF) {
+			if n > 0 {
+				return 0, fmt.Errorf("DecodeAt, cannot read size: %w", io.ErrUnexpectedEOF)
+			}
 			return 0, err
 		}
-		return 0, fmt.Errorf("DecodeFromReader, cannot read size: %w", err)
+		return 0, fmt.Errorf("DecodeAt, cannot read size: %w", err)
 	}
-	size := int(binary.LittleEndian.Uint32(sizeBuf))
-	buf := make([]byte, size)
-	n, err := in.Read(buf)
+	size := int(binary.LittleEndian.Uint32(sizeBuf[:]) &^ taggedRecord)
+	buf, err := readRecord(io.NewSectionReader(r, offset, int64(size)), size)
+	n = len(buf)
 	if err != nil {
-		return n, fmt.Errorf("DecodeFromReader, cannot read record: %w", err)
+		return n, fmt.Errorf("DecodeAt, cannot read record: %w", err)
 	}
 	if err := e.Decode(buf); err != nil {
 		return n, err
 	}
 	return n, nil
 }
+
+// maxPreallocatedRecord bounds the buffer allocated up front from a size
+// field, which may be damaged; larger records grow their buffer as data
+// arrives.
+const maxPreallocatedRecord = 1 << 20
+
+func readRecord(in io.Reader, size int) ([]byte, error) {
+	if size <= maxPreallocatedRecord {
+		buf := make([]byte, size)
+		n, err := io.ReadFull(in, buf)
+		return buf[:n], err
+	}
+	var buf bytes.Buffer
+	n, err := io.CopyN(&buf, in, int64(size))
+	if errors.Is(err, io.EOF) && n < int64(size) {
+		err = io.ErrUnexpectedEOF
+	}
+	return buf.Bytes(), err
+}
@@ -3,11 +3,18 @@ package datastore
 import (
 	"bufio"
 	"bytes"
+	"crypto/sha1"
+	"encoding/binary"
+	"errors"
+	"io"
+	"math"
+	"math/rand"
+	"reflect"
 	"testing"
 )
 
 func TestEntry_Encode(t *testing.T) {
-	e := entry{"key", "value"}
+	e := entry{key: "key", value: []byte("value")}
 	encoded := e.Encode()
 
 	var decoded entry
@@ -18,14 +25,14 @@ func TestEntry_Encode(t *testing.T) {
 	if decoded.key != "key" {
 		t.Error("incorrect key")
 	}
-	if decoded.value != "value" {
+	if string(decoded.value) != "value" {
 		t.Error("incorrect value")
 	}
 }
 
 func TestReadValue(t *testing.T) {
 	var (
-		a = entry{"key", "test-value"}
+		a = entry{key: "key", value: []byte("test-value")}
 		b entry
 	)
 
@@ -36,7 +43,9 @@ func TestReadValue(t *testing.T) {
 		t.Fatal("decode failed:", err)
 	}
 	t.Log("encode/decode", a, b)
-	if a != b {
+	a.checksum = defaultChecksum
+	a.sum = originalBytes[len(originalBytes)-defaultChecksum.size():]
+	if !reflect.DeepEqual(a, b) {
 		t.Error("Encode/Decode mismatch")
 	}
 
@@ -46,7 +55,7 @@ func TestReadValue(t *testing.T) {
 		t.Fatal(err)
 	}
 	t.Log("encode/decodeFromReader", a, b)
-	if a != b {
+	if !reflect.DeepEqual(a, b) {
 		t.Error("Encode/DecodeFromReader mismatch")
 	}
 	if n != len(originalBytes) {
@@ -55,7 +64,7 @@ func TestReadValue(t *testing.T) {
 }
 
 func TestEntry_HashMismatch(t *testing.T) {
-	e := entry{"abc", "correct"}
+	e := entry{key: "abc", value: []byte("correct")}
 	encoded := e.Encode()
 
 	encoded[len(encoded)-1] ^= 0xFF
@@ -67,3 +76,311 @@ func TestEntry_HashMismatch(t *testing.T) {
 	}
 	t.Logf("Got expected error: %v", err)
 }
+
+func TestEntry_BinaryValues(t *testing.T) {
+	for _, value := range [][]byte{
+		{},
+		{0, 1, 0, 0xFF, 0},
+		bytes.Repeat([]byte{0xAB, 0}, 4<<20),
+	} {
+		e := entry{key: "bin", value: value}
+		encoded := e.Encode()
+
+		var decoded entry
+		n, err := decoded.DecodeFromReader(bufio.NewReader(bytes.NewReader(encoded)))
+		if err != nil {
+			t.Fatalf("decode of %d byte value failed: %s", len(value), err)
+		}
+		if n != len(encoded) {
+			t.Errorf("DecodeFromReader() read %d bytes, expected %d", n, len(encoded))
+		}
+		if !bytes.Equal(decoded.value, value) {
+			t.Errorf("value of %d bytes did not round-trip", len(value))
+		}
+	}
+}
+
+func TestEntry_ChecksumAlgorithms(t *testing.T) {
+	for _, algo := range []Checksum{ChecksumSHA1, ChecksumCRC32C} {
+		e := entry{key: "key", value: []byte("value"), checksum: algo}
+		encoded := e.Encode()
+
+		var decoded entry
+		if err := decoded.Decode(encoded); err != nil {
+			t.Fatalf("decode with algorithm %d failed: %s", algo, err)
+		}
+		if decoded.checksum != algo || string(decoded.value) != "value" {
+			t.Errorf("unexpected decoded entry %v", decoded)
+		}
+
+		sum := encoded[len(encoded)-algo.size():]
+		if n := testing.AllocsPerRun(10, func() { algo.matches(encoded[:len(encoded)-len(sum)], sum) }); n != 0 {
+			t.Errorf("checking a checksum with algorithm %d allocates %v times", algo, n)
+		}
+
+		encoded[len(encoded)-1] ^= 0xFF
+		if err := decoded.Decode(encoded); err != ErrCorrupted {
+			t.Errorf("expected corruption to be detected with algorithm %d, got %v", algo, err)
+		}
+	}
+}
+
+func TestEntry_DecodeUntagged(t *testing.T) {
+	key, value := "key", "legacy"
+	hash := sha1.Sum([]byte(value))
+	size := len(key) + len(value) + 12 + len(hash)
+	legacy := make([]byte, size)
+	binary.LittleEndian.PutUint32(legacy, uint32(size))
+	binary.LittleEndian.PutUint32(legacy[4:], uint32(len(key)))
+	copy(legacy[8:], key)
+	binary.LittleEndian.PutUint32(legacy[8+len(key):], uint32(len(value)))
+	copy(legacy[12+len(key):], value)
+	copy(legacy[12+len(key)+len(value):], hash[:])
+
+	var decoded entry
+	n, err := decoded.DecodeFromReader(bufio.NewReader(bytes.NewReader(legacy)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != size || decoded.key != key || string(decoded.value) != value || decoded.checksum != ChecksumSHA1 {
+		t.Errorf("unexpected legacy entry %v (%d bytes)", decoded, n)
+	}
+}
+
+func BenchmarkEntry_Encode(b *testing.B) {
+	value := bytes.Repeat([]byte("x"), 1<<20)
+	for _, bc := range []struct {
+		name string
+		algo Checksum
+	}{
+		{"sha1", ChecksumSHA1},
+		{"crc32c", ChecksumCRC32C},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			e := entry{key: "key", value: value, checksum: bc.algo}
+			b.SetBytes(int64(len(value)))
+			for i := 0; i < b.N; i++ {
+				e.Encode()
+			}
+		})
+	}
+}
+
+func TestEntry_Tombstone(t *testing.T) {
+	for _, e := range []entry{
+		{key: "gone", deleted: true},
+		{key: "empty", value: []byte{}},
+	} {
+		var decoded entry
+		if err := decoded.Decode(e.Encode()); err != nil {
+			t.Fatal(err)
+		}
+		if decoded.key != e.key || decoded.deleted != e.deleted || len(decoded.value) != 0 {
+			t.Errorf("unexpected decoded entry %v for %v", decoded, e)
+		}
+	}
+}
+
+func TestEntry_ChecksumCoversWholeRecord(t *testing.T) {
+	e := entry{key: "some-key", value: []byte("some-value")}
+	encoded := e.Encode()
+	kl := len(e.key)
+
+	for name, pos := range map[string]int{
+		"size":         0,
+		"algo":         4,
+		"key length":   5,
+		"key":          9 + kl/2,
+		"value length": 9 + kl,
+		"value":        13 + kl,
+	} {
+		for _, mask := range []byte{0x01, 0x80, 0xFF} {
+			damaged := bytes.Clone(encoded)
+			damaged[pos] ^= mask
+			var decoded entry
+			if err := decoded.Decode(damaged); err != ErrCorrupted {
+				t.Errorf("%s ^ %#x: Decode() error = %v, want ErrCorrupted", name, mask, err)
+			}
+		}
+	}
+}
+
+func TestEntry_DecodeValueOnlyChecksum(t *testing.T) {
+	// Tagged records written before flagWholeRecord only hash the value.
+	e := entry{key: "key", value: []byte("value"), checksum: ChecksumCRC32C}
+	encoded := e.Encode()
+	encoded[4] &^= flagWholeRecord
+	copy(encoded[len(encoded)-4:], ChecksumCRC32C.sum(e.value))
+
+	var decoded entry
+	if err := decoded.Decode(encoded); err != nil {
+		t.Fatal(err)
+	}
+	if decoded.key != e.key || string(decoded.value) != string(e.value) {
+		t.Errorf("decoded %q=%q", decoded.key, decoded.value)
+	}
+}
+
+func TestEntry_DecodeMalformed(t *testing.T) {
+	valid := (&entry{key: "key", value: []byte("value")}).Encode()
+	inputs := [][]byte{nil, {}, {1}, {0, 0, 0, 0}, {0, 0, 0, 0x80}}
+
+	// Oversized length fields in otherwise valid records.
+	for _, pos := range []int{0, 5, 12} {
+		for _, value := range []uint32{math.MaxUint32, math.MaxUint32 - 1, math.MaxInt32, uint32(len(valid))} {
+			damaged := bytes.Clone(valid)
+			binary.LittleEndian.PutUint32(damaged[pos:], value)
+			inputs = append(inputs, damaged)
+		}
+	}
+	untagged := bytes.Clone(valid)
+	untagged[3] &^= 0x80
+	inputs = append(inputs, untagged)
+
+	rnd := rand.New(rand.NewSource(1))
+	for i := 0; i < 5000; i++ {
+		input := make([]byte, rnd.Intn(64))
+		rnd.Read(input)
+		if len(input) >= 4 && rnd.Intn(2) == 0 {
+			binary.LittleEndian.PutUint32(input, uint32(len(input))|uint32(rnd.Intn(2))<<31)
+		}
+		inputs = append(inputs, input)
+	}
+
+	for _, input := range inputs {
+		var e entry
+		if err := e.Decode(input); err == nil && !bytes.Equal(input, valid) {
+			t.Errorf("Decode(%x) accepted a malformed record", input)
+		}
+		if _, err := e.DecodeFromReader(bufio.NewReader(bytes.NewReader(input))); err == nil && !bytes.Equal(input, valid) {
+			t.Errorf("DecodeFromReader(%x) accepted a malformed record", input)
+		}
+		if _, err := e.DecodeAt(bytes.NewReader(input), 0); err == nil && !bytes.Equal(input, valid) {
+			t.Errorf("DecodeAt(%x) accepted a malformed record", input)
+		}
+	}
+}
+
+func TestEntry_DecodeReusedBuffer(t *testing.T) {
+	var file []byte
+	values := [][]byte{[]byte("long value to grow the buffer"), []byte("short"), nil, []byte("medium value")}
+	for i, value := range values {
+		e := entry{key: string(rune('a' + i)), value: value}
+		file = append(file, e.Encode()...)
+	}
+
+	reader := bufio.NewReader(bytes.NewReader(file))
+	var buf []byte
+	for i, value := range values {
+		var (
+			e   entry
+			err error
+		)
+		if _, buf, err = e.decodeFromReaderBuf(reader, buf); err != nil {
+			t.Fatal(err)
+		}
+		if e.key != string(rune('a'+i)) || !bytes.Equal(e.value, value) {
+			t.Errorf("record %d = %q/%q, want %q", i, e.key, e.value, value)
+		}
+	}
+	if cap(buf) != len((&entry{key: "a", value: values[0]}).Encode()) {
+		t.Errorf("buffer grew to %d bytes, want the size of the largest record", cap(buf))
+	}
+}
+
+func TestEntry_DecodeAt(t *testing.T) {
+	var (
+		file    []byte
+		offsets []int64
+		entries []entry
+	)
+	for i := 0; i < 10; i++ {
+		e := entry{key: string(rune('a' + i)), value: bytes.Repeat([]byte{byte(i)}, i*7), checksum: defaultChecksum}
+		offsets = append(offsets, int64(len(file)))
+		entries = append(entries, e)
+		file = append(file, e.Encode()...)
+	}
+	r := bytes.NewReader(file)
+
+	// Visit the records out of order.
+	for _, i := range rand.New(rand.NewSource(1)).Perm(len(entries)) {
+		var e entry
+		n, err := e.DecodeAt(r, offsets[i])
+		if err != nil {
+			t.Fatalf("DecodeAt(%d): %v", offsets[i], err)
+		}
+		if e.key != entries[i].key || !bytes.Equal(e.value, entries[i].value) {
+			t.Errorf("DecodeAt(%d) = %q/%x, want %q/%x", offsets[i], e.key, e.value, entries[i].key, entries[i].value)
+		}
+		if want := len(entries[i].Encode()); n != want {
+			t.Errorf("DecodeAt(%d) read %d bytes, want %d", offsets[i], n, want)
+		}
+	}
+
+	var e entry
+	if _, err := e.DecodeAt(r, int64(len(file))); err != io.EOF {
+		t.Errorf("DecodeAt() at the end: %v, want io.EOF", err)
+	}
+	last := offsets[len(offsets)-1]
+	if _, err := e.DecodeAt(bytes.NewReader(file[:len(file)-1]), last); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("DecodeAt() of a truncated record: %v, want io.ErrUnexpectedEOF", err)
+	}
+	if _, err := e.DecodeAt(bytes.NewReader(file[:last+2]), last); !errors.Is(err, io.ErrUnexpectedEOF) {
+		t.Errorf("DecodeAt() of a truncated size: %v, want io.ErrUnexpectedEOF", err)
+	}
+}
+
+func FuzzEntryRoundTrip(f *testing.F) {
+	f.Add([]byte(""), []byte(""), byte(ChecksumCRC32C), false)
+	f.Add([]byte("key"), []byte(""), byte(ChecksumSHA1), false)
+	f.Add([]byte(""), []byte("value"), byte(ChecksumCRC32C), false)
+	f.Add([]byte("deleted"), []byte(""), byte(ChecksumCRC32C), true)
+	f.Add([]byte{0, 0xFF, 0}, bytes.Repeat([]byte{0xFF}, 1024), byte(ChecksumSHA1), false)
+
+	f.Fuzz(func(t *testing.T, key, value []byte, algo byte, deleted bool) {
+		checksum := ChecksumSHA1
+		if algo%2 == 0 {
+			checksum = ChecksumCRC32C
+		}
+		e := entry{key: string(key), value: value, checksum: checksum, deleted: deleted}
+		if deleted {
+			e.value = nil
+		}
+		encoded := e.Encode()
+
+		var decoded entry
+		if err := decoded.Decode(encoded); err != nil {
+			t.Fatalf("Decode() of an encoded entry: %v", err)
+		}
+		if decoded.key != e.key || !bytes.Equal(decoded.value, e.value) || decoded.deleted != deleted || decoded.checksum != checksum {
+			t.Fatalf("round trip mismatch: %+v != %+v", decoded, e)
+		}
+
+		var read entry
+		n, err := read.DecodeFromReader(bufio.NewReader(bytes.NewReader(encoded)))
+		if err != nil || n != len(encoded) {
+			t.Fatalf("DecodeFromReader() = %d, %v", n, err)
+		}
+		if read.key != e.key || !bytes.Equal(read.value, e.value) {
+			t.Fatalf("DecodeFromReader round trip mismatch: %+v != %+v", read, e)
+		}
+	})
+}
+
+func FuzzDecodeArbitrary(f *testing.F) {
+	valid := (&entry{key: "key", value: []byte("value")}).Encode()
+	f.Add(valid)
+	f.Add([]byte{})
+	f.Add([]byte{0xFF, 0xFF, 0xFF, 0xFF})
+	f.Add([]byte{0xFF, 0xFF, 0xFF, 0x7F, 0xFF, 0xFF, 0xFF, 0xFF})
+	huge := bytes.Clone(valid)
+	binary.LittleEndian.PutUint32(huge[5:], math.MaxUint32)
+	f.Add(huge)
+
+	// Only errors are acceptable; a panic fails the fuzz run.
+	f.Fuzz(func(t *testing.T, input []byte) {
+		var e entry
+		_ = e.Decode(input)
+		_, _ = e.DecodeFromReader(bufio.NewReader(bytes.NewReader(input)))
+	})
+}
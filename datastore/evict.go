@@ -0,0 +1,59 @@
+package datastore
+
+type evictedKey struct {
+	key string
+	ref segmentRef
+}
+
+// evict shrinks the records being compacted until they, together with the
+// current segment of their partition, fit in the partition's share of
+// maxBytes. Tombstones go first, as they hold no data; then the oldest live
+// records are replaced with tombstones of their keys. live is in write
+// order, as compactSegments collects it. Evicted records get a negative
+// source, and their previous refs are returned so the index can drop them.
+func (db *Db) evict(p *partition, live []hintRecord, sources []int) ([]hintRecord, []int, []evictedKey, error) {
+	if db.maxBytes <= 0 {
+		return live, sources, nil, nil
+	}
+	db.mu.RLock()
+	budget := db.maxBytes/int64(len(db.partitions)) - p.offset
+	db.mu.RUnlock()
+
+	size := int64(0)
+	for _, r := range live {
+		size += int64(r.size)
+	}
+	if size <= budget {
+		return live, sources, nil, nil
+	}
+
+	keptLive, keptSources := live[:0], sources[:0]
+	for i, r := range live {
+		if r.deleted && size > budget {
+			size -= int64(r.size)
+			continue
+		}
+		keptLive, keptSources = append(keptLive, r), append(keptSources, sources[i])
+	}
+	live, sources = keptLive, keptSources
+
+	var evicted []evictedKey
+	for i := 0; i < len(live) && size > budget; i++ {
+		r := live[i]
+		if r.deleted {
+			continue
+		}
+		tombstone, err := db.encodeEntry(entry{key: r.key, deleted: true})
+		if err != nil {
+			return nil, nil, nil, err
+		}
+		evicted = append(evicted, evictedKey{
+			key: r.key,
+			ref: segmentRef{segmentId: sources[i], offset: r.offset, valueSize: r.valueSize},
+		})
+		size += int64(len(tombstone) - r.size)
+		live[i] = hintRecord{key: r.key, size: len(tombstone), deleted: true}
+		sources[i] = -1
+	}
+	return live, sources, evicted, nil
+}
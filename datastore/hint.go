@@ -0,0 +1,106 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"hash/crc32"
+	"io/fs"
+	"os"
+)
+
+const (
+	hintFileSuffix = ".hint"
+	hintVersion    = 3
+	hintHeaderSize = 13
+)
+
+var (
+	hintMagic     = []byte("HINT")
+	errStaleHint  = errors.New("stale hint file")
+	errBrokenHint = errors.New("broken hint file")
+)
+
+type hintRecord struct {
+	key       string
+	offset    int64
+	size      int
+	valueSize int
+	deleted   bool
+	// chunkStart is chunkLink.start of the first chunk of a chunked value.
+	// It is only set when recovering the current segment and is not stored
+	// in hint files.
+	chunkStart int
+}
+
+// Hint file layout:
+// (magic[4]) (version[1]) (segment size[8])
+// (kl[4]) (key) (offset[8]) (size[4]) (vl[4]) (deleted[1])   <-- per record
+// (crc32[4])                                                 <-- of all above
+
+func writeHintFile(path string, segmentSize int64, records []hintRecord, modes fileModes) error {
+	buf := make([]byte, 0, hintHeaderSize+len(records)*29+4)
+	buf = append(buf, hintMagic...)
+	buf = append(buf, hintVersion)
+	buf = binary.LittleEndian.AppendUint64(buf, uint64(segmentSize))
+	for _, r := range records {
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(r.key)))
+		buf = append(buf, r.key...)
+		buf = binary.LittleEndian.AppendUint64(buf, uint64(r.offset))
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(r.size))
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(r.valueSize))
+		if r.deleted {
+			buf = append(buf, 1)
+		} else {
+			buf = append(buf, 0)
+		}
+	}
+	buf = binary.LittleEndian.AppendUint32(buf, crc32.ChecksumIEEE(buf))
+
+	tmp := path + ".tmp"
+	if err := modes.writeFile(tmp, buf); err != nil {
+		return err
+	}
+	return os.Rename(tmp, path)
+}
+
+// readHintFile returns errStaleHint when the hint was written for a different
+// version of the segment (or of the format) and errBrokenHint when its
+// contents cannot be trusted. Either way the caller should replay the segment.
+func readHintFile(fsys fs.FS, name string, segmentSize int64) ([]hintRecord, int, error) {
+	data, err := fs.ReadFile(fsys, name)
+	if err != nil {
+		return nil, 0, err
+	}
+	if len(data) < hintHeaderSize+4 || !bytes.Equal(data[:4], hintMagic) {
+		return nil, len(data), errBrokenHint
+	}
+	body, sum := data[:len(data)-4], binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, len(data), errBrokenHint
+	}
+	if body[4] != hintVersion || int64(binary.LittleEndian.Uint64(body[5:])) != segmentSize {
+		return nil, len(data), errStaleHint
+	}
+
+	var records []hintRecord
+	for pos := hintHeaderSize; pos < len(body); {
+		if pos+4 > len(body) {
+			return nil, len(data), errBrokenHint
+		}
+		kl := int(binary.LittleEndian.Uint32(body[pos:]))
+		pos += 4
+		if kl > len(body)-pos-17 {
+			return nil, len(data), errBrokenHint
+		}
+		r := hintRecord{key: string(body[pos : pos+kl])}
+		pos += kl
+		r.offset = int64(binary.LittleEndian.Uint64(body[pos:]))
+		r.size = int(binary.LittleEndian.Uint32(body[pos+8:]))
+		r.valueSize = int(binary.LittleEndian.Uint32(body[pos+12:]))
+		r.deleted = body[pos+16] != 0
+		pos += 17
+		records = append(records, r)
+	}
+	return records, len(data), nil
+}
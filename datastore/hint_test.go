@@ -0,0 +1,102 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDb_HintFiles(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := OpenWithLimit(tmp, 4096)
+	if err != nil {
+		t.Fatal(err)
+	}
+	value := strings.Repeat("v", 1000)
+	for i := 0; i < 50; i++ {
+		if err := db.Put(fmt.Sprintf("key-%d", i), value); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := db.Put("key-0", "updated"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	reopen := func() int64 {
+		db, err := OpenWithLimit(tmp, 4096)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 1; i < 50; i++ {
+			if got, err := db.Get(fmt.Sprintf("key-%d", i)); err != nil || got != value {
+				t.Errorf("Get(key-%d) failed: %v", i, err)
+			}
+		}
+		if got, _ := db.Get("key-0"); got != "updated" {
+			t.Errorf("Expected updated value, got %q", got)
+		}
+		bytesRead := db.recoveryBytes
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+		return bytesRead
+	}
+
+	withHints := reopen()
+
+	hints, err := filepath.Glob(filepath.Join(tmp, "*"+hintFileSuffix))
+	if err != nil || len(hints) == 0 {
+		t.Fatalf("Expected hint files to be written, found %d (%v)", len(hints), err)
+	}
+	for _, h := range hints {
+		if err := os.Remove(h); err != nil {
+			t.Fatal(err)
+		}
+	}
+	withoutHints := reopen()
+
+	t.Logf("recovery read %d bytes with hints, %d bytes without", withHints, withoutHints)
+	if withHints*4 > withoutHints {
+		t.Errorf("Hints did not reduce recovery reads: %d vs %d", withHints, withoutHints)
+	}
+
+	if regenerated := reopen(); regenerated != withHints {
+		t.Errorf("Expected hints to be regenerated after replay, read %d bytes", regenerated)
+	}
+}
+
+func TestReadHintFile_Stale(t *testing.T) {
+	dir := t.TempDir()
+	path := filepath.Join(dir, "segment-1.hint")
+	records := []hintRecord{
+		{key: "k1", offset: 0, size: 40, valueSize: 20},
+		{key: "k2", offset: 40, size: 41, valueSize: 21, deleted: true},
+	}
+	if err := writeHintFile(path, 81, records, defaultFileModes); err != nil {
+		t.Fatal(err)
+	}
+
+	got, _, err := readHintFile(os.DirFS(dir), "segment-1.hint", 81)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 || got[1] != records[1] {
+		t.Errorf("Unexpected hint records %v", got)
+	}
+
+	if _, _, err := readHintFile(os.DirFS(dir), "segment-1.hint", 100); err != errStaleHint {
+		t.Errorf("Expected stale hint for a grown segment, got %v", err)
+	}
+
+	data, _ := os.ReadFile(path)
+	data[hintHeaderSize] ^= 0xFF
+	_ = os.WriteFile(path, data, 0o600)
+	if _, _, err := readHintFile(os.DirFS(dir), "segment-1.hint", 81); err != errBrokenHint {
+		t.Errorf("Expected broken hint, got %v", err)
+	}
+}
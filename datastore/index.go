@@ -0,0 +1,334 @@
+package datastore
+
+import (
+	"crypto/sha256"
+	"sort"
+	"sync"
+)
+
+// keyDigestSize is the length of the key digests stored with hashed keys.
+const keyDigestSize = 16
+
+// hashIndex maps keys to their latest record. It is split into shards, each
+// guarded by its own lock, so that readers and the writer touching different
+// keys do not contend on a single mutex.
+//
+// With hashed keys, refs is keyed by a digest of the key rather than the
+// key itself, and the key is read back from the record through keyAt
+// whenever it is needed. A key whose digest is taken by a different key
+// goes to collided under its full key, which lookups check first.
+type hashIndex struct {
+	shards []indexShard
+	digest func(key string) string
+	keyAt  func(ref segmentRef) (string, error)
+}
+
+type indexShard struct {
+	mu       sync.RWMutex
+	refs     map[string]segmentRef
+	collided map[string]segmentRef
+}
+
+// indexUpdate is a single change applied by hashIndex.apply. A nil ref
+// removes the key.
+type indexUpdate struct {
+	key string
+	ref *segmentRef
+}
+
+func newHashIndex(shards int) *hashIndex {
+	if shards < 1 {
+		shards = 1
+	}
+	idx := &hashIndex{shards: make([]indexShard, shards)}
+	for i := range idx.shards {
+		idx.shards[i].refs = make(map[string]segmentRef)
+		idx.shards[i].collided = make(map[string]segmentRef)
+	}
+	return idx
+}
+
+// hashKeys makes idx store digests of its keys, reading keys back with
+// keyAt.
+func (idx *hashIndex) hashKeys(keyAt func(ref segmentRef) (string, error)) {
+	idx.digest = keyDigest
+	idx.keyAt = keyAt
+}
+
+func keyDigest(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return string(sum[:keyDigestSize])
+}
+
+func (idx *hashIndex) hashed() bool {
+	return idx.keyAt != nil
+}
+
+func (idx *hashIndex) slot(key string) string {
+	if idx.hashed() {
+		return idx.digest(key)
+	}
+	return key
+}
+
+func (idx *hashIndex) shardOf(key string) int {
+	if len(idx.shards) == 1 {
+		return 0
+	}
+	return int(keyHash(key) % uint32(len(idx.shards)))
+}
+
+// lookup returns the ref stored for key without checking, with hashed keys,
+// that it belongs to key. It is enough to compare with a known ref.
+func (idx *hashIndex) lookup(key string) (segmentRef, bool) {
+	s := &idx.shards[idx.shardOf(key)]
+	s.mu.RLock()
+	defer s.mu.RUnlock()
+	if ref, ok := s.collided[key]; ok {
+		return ref, true
+	}
+	ref, ok := s.refs[idx.slot(key)]
+	return ref, ok
+}
+
+func (idx *hashIndex) get(key string) (segmentRef, bool) {
+	ref, ok := idx.lookup(key)
+	if !ok || !idx.hashed() {
+		return ref, ok
+	}
+	for {
+		k, err := idx.keyAt(ref)
+		// A compaction may have moved the record since the lookup.
+		cur, ok := idx.lookup(key)
+		if !ok {
+			return segmentRef{}, false
+		}
+		if cur != ref {
+			ref = cur
+			continue
+		}
+		// A failed read is left to the caller, which reads the record anyway.
+		if err == nil && k != key {
+			return segmentRef{}, false
+		}
+		return ref, true
+	}
+}
+
+func (idx *hashIndex) set(key string, ref segmentRef) {
+	idx.apply([]indexUpdate{{key: key, ref: &ref}})
+}
+
+func (idx *hashIndex) remove(key string) {
+	idx.apply([]indexUpdate{{key: key}})
+}
+
+// replace points key at ref only if it still points at old, so that a
+// newer write is not overridden.
+func (idx *hashIndex) replace(key string, old, ref segmentRef) bool {
+	s := &idx.shards[idx.shardOf(key)]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	// Refs are unique, so matching old is enough to know the entry is key.
+	if cur, ok := s.collided[key]; ok {
+		if cur != old {
+			return false
+		}
+		s.collided[key] = ref
+		return true
+	}
+	slot := idx.slot(key)
+	if cur, ok := s.refs[slot]; !ok || cur != old {
+		return false
+	}
+	s.refs[slot] = ref
+	return true
+}
+
+// removeIf removes key only if it still points at old.
+func (idx *hashIndex) removeIf(key string, old segmentRef) bool {
+	s := &idx.shards[idx.shardOf(key)]
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if cur, ok := s.collided[key]; ok {
+		if cur != old {
+			return false
+		}
+		delete(s.collided, key)
+		return true
+	}
+	slot := idx.slot(key)
+	if cur, ok := s.refs[slot]; !ok || cur != old {
+		return false
+	}
+	delete(s.refs, slot)
+	return true
+}
+
+// owner is what apply found in the slot of a key before locking: the ref
+// there and whether its record is of that key.
+type owner struct {
+	ref    segmentRef
+	exists bool
+	same   bool
+}
+
+// owners reads the keys of the records in the slots of updates. It runs
+// before apply takes its locks, as reading a record may wait for a
+// compaction that needs them.
+func (idx *hashIndex) owners(updates []indexUpdate) []owner {
+	res := make([]owner, len(updates))
+	for i, u := range updates {
+		s := &idx.shards[idx.shardOf(u.key)]
+		s.mu.RLock()
+		ref, ok := s.refs[idx.digest(u.key)]
+		s.mu.RUnlock()
+		if ok {
+			k, err := idx.keyAt(ref)
+			res[i] = owner{ref: ref, exists: true, same: err == nil && k == u.key}
+		}
+	}
+	return res
+}
+
+// apply makes all updates visible at once: every shard they touch is locked
+// (in shard order, to avoid deadlocks) before any of them is changed.
+func (idx *hashIndex) apply(updates []indexUpdate) {
+	var owners []owner
+	if idx.hashed() {
+		owners = idx.owners(updates)
+	}
+	shardIds := make([]int, len(updates))
+	var locked []int
+	for i, u := range updates {
+		shardIds[i] = idx.shardOf(u.key)
+		locked = append(locked, shardIds[i])
+	}
+	sort.Ints(locked)
+	for i, id := range locked {
+		if i == 0 || locked[i-1] != id {
+			idx.shards[id].mu.Lock()
+		}
+	}
+	for i, u := range updates {
+		s := &idx.shards[shardIds[i]]
+		if !idx.hashed() {
+			if u.ref == nil {
+				delete(s.refs, u.key)
+			} else {
+				s.refs[u.key] = *u.ref
+			}
+			continue
+		}
+		idx.applyHashed(s, u, owners[i])
+	}
+	for i, id := range locked {
+		if i == 0 || locked[i-1] != id {
+			idx.shards[id].mu.Unlock()
+		}
+	}
+}
+
+// applyHashed applies u to the locked shard s. A key is only given the
+// digest slot when it is known to be empty or to hold the same key;
+// anything else, including a slot that changed since owners looked, sends
+// it to collided, which is correct for any key.
+func (idx *hashIndex) applyHashed(s *indexShard, u indexUpdate, o owner) {
+	slot := idx.digest(u.key)
+	cur, exists := s.refs[slot]
+	unchanged := exists == o.exists && cur == o.ref
+	_, collided := s.collided[u.key]
+	if u.ref == nil {
+		delete(s.collided, u.key)
+		if exists && unchanged && o.same {
+			delete(s.refs, slot)
+		}
+		return
+	}
+	switch {
+	case exists && unchanged && o.same:
+		s.refs[slot] = *u.ref
+		delete(s.collided, u.key)
+	case !exists && unchanged && !collided:
+		s.refs[slot] = *u.ref
+	default:
+		s.collided[u.key] = *u.ref
+	}
+}
+
+// clear removes every key, holding all shard locks so that no reader sees
+// a partly cleared index.
+func (idx *hashIndex) clear() {
+	for i := range idx.shards {
+		idx.shards[i].mu.Lock()
+	}
+	for i := range idx.shards {
+		idx.shards[i].refs = make(map[string]segmentRef)
+		idx.shards[i].collided = make(map[string]segmentRef)
+		idx.shards[i].mu.Unlock()
+	}
+}
+
+func (idx *hashIndex) len() int {
+	n := 0
+	for i := range idx.shards {
+		s := &idx.shards[i]
+		s.mu.RLock()
+		n += len(s.refs) + len(s.collided)
+		s.mu.RUnlock()
+	}
+	return n
+}
+
+// keys returns the keys accepted by match (all keys when match is nil). Each
+// shard is read under its own lock, so the result is consistent per shard
+// rather than across the whole index. With hashed keys, every key is read
+// from its record, and keys that cannot be read are left out.
+func (idx *hashIndex) keys(match func(key string) bool) []string {
+	type digestRef struct {
+		shard  int
+		digest string
+		ref    segmentRef
+	}
+	keys := []string{}
+	var refs []digestRef
+	for i := range idx.shards {
+		s := &idx.shards[i]
+		s.mu.RLock()
+		for key := range s.collided {
+			if match == nil || match(key) {
+				keys = append(keys, key)
+			}
+		}
+		for key, ref := range s.refs {
+			if idx.hashed() {
+				refs = append(refs, digestRef{shard: i, digest: key, ref: ref})
+			} else if match == nil || match(key) {
+				keys = append(keys, key)
+			}
+		}
+		s.mu.RUnlock()
+	}
+	for _, r := range refs {
+		for {
+			key, err := idx.keyAt(r.ref)
+			if err == nil {
+				if match == nil || match(key) {
+					keys = append(keys, key)
+				}
+				break
+			}
+			// The record may have been moved by a compaction since the
+			// shard was copied.
+			s := &idx.shards[r.shard]
+			s.mu.RLock()
+			ref, ok := s.refs[r.digest]
+			s.mu.RUnlock()
+			if !ok || ref == r.ref {
+				break
+			}
+			r.ref = ref
+		}
+	}
+	return keys
+}
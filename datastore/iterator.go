@@ -0,0 +1,107 @@
+package datastore
+
+import "sort"
+
+// IteratorOptions bound the keys visited by an Iterator. Start is inclusive
+// and End is exclusive; an empty string leaves that side unbounded.
+type IteratorOptions struct {
+	Start   string
+	End     string
+	Reverse bool
+}
+
+// Iterator walks the stored keys in sorted order:
+//
+//	it := db.NewIterator(IteratorOptions{})
+//	defer it.Close()
+//	for it.Next() {
+//		value, err := it.Value()
+//		...
+//	}
+//
+// The set of keys is a snapshot taken by NewIterator, because the index
+// keeps no order of its own. Values are read when Value is called, so they
+// reflect writes made after the snapshot.
+type Iterator struct {
+	db      *Db
+	keys    []string
+	reverse bool
+	pos     int
+	key     string
+	valid   bool
+}
+
+// NewIterator builds a sorted snapshot of the keys within opts' bounds. The
+// cost is O(n log n) in the number of matching keys.
+func (db *Db) NewIterator(opts IteratorOptions) *Iterator {
+	keys := db.index.keys(func(key string) bool {
+		return key >= opts.Start && (opts.End == "" || key < opts.End)
+	})
+	sort.Strings(keys)
+	it := &Iterator{db: db, keys: keys, reverse: opts.Reverse}
+	it.rewind()
+	return it
+}
+
+func (it *Iterator) rewind() {
+	if it.reverse {
+		it.pos = len(it.keys) - 1
+	} else {
+		it.pos = 0
+	}
+	it.valid = false
+}
+
+// Seek positions the iterator so that the following Next moves to the first
+// key at or after key, or at or before it when iterating in reverse. Seek
+// may be used as a resumable cursor: seeking to the last key returned and
+// skipping it yields the rest of the iteration.
+func (it *Iterator) Seek(key string) {
+	i := sort.SearchStrings(it.keys, key)
+	if it.reverse && (i == len(it.keys) || it.keys[i] != key) {
+		i--
+	}
+	it.pos = i
+	it.valid = false
+}
+
+// Next advances to the next key and reports whether there is one.
+func (it *Iterator) Next() bool {
+	if it.pos < 0 || it.pos >= len(it.keys) {
+		it.valid = false
+		return false
+	}
+	it.key = it.keys[it.pos]
+	it.valid = true
+	if it.reverse {
+		it.pos--
+	} else {
+		it.pos++
+	}
+	return true
+}
+
+// Key returns the current key. It is only meaningful after Next returned
+// true.
+func (it *Iterator) Key() string {
+	if !it.valid {
+		return ""
+	}
+	return it.key
+}
+
+// Value reads the value of the current key. It returns ErrNotFound when the
+// key was deleted after the iterator was created.
+func (it *Iterator) Value() (string, error) {
+	if !it.valid {
+		return "", ErrNotFound
+	}
+	return it.db.Get(it.key)
+}
+
+// Close releases the key snapshot. Next returns false afterwards.
+func (it *Iterator) Close() {
+	it.keys = nil
+	it.pos = 0
+	it.valid = false
+}
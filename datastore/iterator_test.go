@@ -0,0 +1,109 @@
+package datastore
+
+import (
+	"reflect"
+	"testing"
+)
+
+func iterKeys(it *Iterator) []string {
+	var keys []string
+	for it.Next() {
+		keys = append(keys, it.Key())
+	}
+	return keys
+}
+
+func TestIterator(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	for _, key := range []string{"d", "b", "a", "e", "c"} {
+		if err := db.Put(key, "value-"+key); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	tests := []struct {
+		name string
+		opts IteratorOptions
+		want []string
+	}{
+		{"all", IteratorOptions{}, []string{"a", "b", "c", "d", "e"}},
+		{"bounds", IteratorOptions{Start: "b", End: "d"}, []string{"b", "c"}},
+		{"open end", IteratorOptions{Start: "c"}, []string{"c", "d", "e"}},
+		{"reverse", IteratorOptions{Reverse: true}, []string{"e", "d", "c", "b", "a"}},
+		{"reverse bounds", IteratorOptions{Start: "b", End: "e", Reverse: true}, []string{"d", "c", "b"}},
+		{"empty range", IteratorOptions{Start: "x"}, nil},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			it := db.NewIterator(tc.opts)
+			defer it.Close()
+			if got := iterKeys(it); !reflect.DeepEqual(got, tc.want) {
+				t.Errorf("got %v, want %v", got, tc.want)
+			}
+		})
+	}
+
+	it := db.NewIterator(IteratorOptions{})
+	if !it.Next() {
+		t.Fatal("Next() = false on a non-empty iterator")
+	}
+	if v, err := it.Value(); err != nil || v != "value-a" {
+		t.Errorf("Value() = %q, %v", v, err)
+	}
+	it.Close()
+	if it.Next() {
+		t.Error("Next() = true after Close")
+	}
+}
+
+func TestIterator_Seek(t *testing.T) {
+	db, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		_ = db.Close()
+	})
+	for _, key := range []string{"a", "c", "e"} {
+		if err := db.Put(key, "v"); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	it := db.NewIterator(IteratorOptions{})
+	it.Seek("b")
+	if got := iterKeys(it); !reflect.DeepEqual(got, []string{"c", "e"}) {
+		t.Errorf("forward seek to missing key: got %v", got)
+	}
+	it.Seek("c")
+	if got := iterKeys(it); !reflect.DeepEqual(got, []string{"c", "e"}) {
+		t.Errorf("forward seek to present key: got %v", got)
+	}
+
+	rev := db.NewIterator(IteratorOptions{Reverse: true})
+	rev.Seek("d")
+	if got := iterKeys(rev); !reflect.DeepEqual(got, []string{"c", "a"}) {
+		t.Errorf("reverse seek to missing key: got %v", got)
+	}
+	rev.Seek("z")
+	if got := iterKeys(rev); !reflect.DeepEqual(got, []string{"e", "c", "a"}) {
+		t.Errorf("reverse seek past the end: got %v", got)
+	}
+
+	if err := db.Delete("e"); err != nil {
+		t.Fatal(err)
+	}
+	it.Seek("e")
+	if !it.Next() || it.Key() != "e" {
+		t.Fatal("snapshot should still contain deleted key")
+	}
+	if _, err := it.Value(); err != ErrNotFound {
+		t.Errorf("Value() of deleted key: %v, want ErrNotFound", err)
+	}
+}
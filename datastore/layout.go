@@ -0,0 +1,156 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// segmentsDirName holds the shard directories of the sharded layout:
+// segments/<id % 256 in hex>/segment-<id>.
+const segmentsDirName = "segments"
+
+// Files are read through db.fsys by slash-separated names relative to the
+// store root and written through the matching paths under db.dir.
+
+type segmentFileInfo struct {
+	id      int
+	name    string
+	size    int64
+	modTime time.Time
+}
+
+// segmentReader is an open segment file.
+type segmentReader interface {
+	io.ReaderAt
+	io.Closer
+}
+
+func segmentShard(id int) string {
+	return fmt.Sprintf("%02x", id%256)
+}
+
+// segmentName returns the file of segment id. New segments go where the
+// configured layout puts them, but a segment that already exists in the
+// other layout is found there, so a store can switch layouts between runs.
+func (db *Db) segmentName(id int) string {
+	flat := segmentFilename(id)
+	sharded := path.Join(segmentsDirName, segmentShard(id), segmentFilename(id))
+	preferred, other := flat, sharded
+	if db.shardedLayout {
+		preferred, other = sharded, flat
+	}
+	if _, err := fs.Stat(db.fsys, preferred); errors.Is(err, fs.ErrNotExist) {
+		if _, err := fs.Stat(db.fsys, other); err == nil {
+			return other
+		}
+	}
+	return preferred
+}
+
+// diskPath returns the path of the file name under the store directory.
+func (db *Db) diskPath(name string) string {
+	return filepath.Join(db.dir, filepath.FromSlash(name))
+}
+
+func (db *Db) segmentPath(id int) string {
+	return db.diskPath(db.segmentName(id))
+}
+
+func (db *Db) hintPath(id int) string {
+	return db.segmentPath(id) + hintFileSuffix
+}
+
+func (db *Db) openSegment(id int) (segmentReader, error) {
+	f, err := db.fsys.Open(db.segmentName(id))
+	if err != nil {
+		return nil, err
+	}
+	r, ok := f.(segmentReader)
+	if !ok {
+		_ = f.Close()
+		return nil, fmt.Errorf("segment %d does not support ReadAt", id)
+	}
+	return r, nil
+}
+
+// segmentDirs returns the store root followed by every shard directory.
+func segmentDirs(fsys fs.FS) ([]string, error) {
+	dirs := []string{"."}
+	shards, err := fs.ReadDir(fsys, segmentsDirName)
+	if errors.Is(err, fs.ErrNotExist) {
+		return dirs, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	for _, shard := range shards {
+		if shard.IsDir() {
+			dirs = append(dirs, path.Join(segmentsDirName, shard.Name()))
+		}
+	}
+	return dirs, nil
+}
+
+// listSegments finds the segment files of both layouts, sorted by id.
+func listSegments(fsys fs.FS) ([]segmentFileInfo, error) {
+	dirs, err := segmentDirs(fsys)
+	if err != nil {
+		return nil, err
+	}
+	var segments []segmentFileInfo
+	for _, dir := range dirs {
+		files, err := fs.ReadDir(fsys, dir)
+		if err != nil {
+			return nil, err
+		}
+		for _, file := range files {
+			id, ok := parseSegmentFilename(file.Name())
+			if !ok {
+				continue
+			}
+			info, err := file.Info()
+			if err != nil {
+				return nil, err
+			}
+			segments = append(segments, segmentFileInfo{
+				id:      id,
+				name:    path.Join(dir, file.Name()),
+				size:    info.Size(),
+				modTime: info.ModTime(),
+			})
+		}
+	}
+	sort.Slice(segments, func(i, j int) bool {
+		return segments[i].id < segments[j].id
+	})
+	return segments, nil
+}
+
+func (db *Db) removeCompactLeftovers() error {
+	dirs, err := segmentDirs(db.fsys)
+	if err != nil {
+		return err
+	}
+	for _, dir := range dirs {
+		files, err := fs.ReadDir(db.fsys, dir)
+		if err != nil {
+			return err
+		}
+		for _, file := range files {
+			if strings.HasSuffix(file.Name(), compactFileSuffix) {
+				if err := os.Remove(db.diskPath(path.Join(dir, file.Name()))); err != nil {
+					return err
+				}
+			}
+		}
+	}
+	return nil
+}
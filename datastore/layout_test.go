@@ -0,0 +1,77 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+func TestDb_ShardedLayout(t *testing.T) {
+	tmp := t.TempDir()
+
+	// Start with a flat store, as written before the sharded layout existed.
+	db, err := OpenWithLimit(tmp, 100)
+	if err != nil {
+		t.Fatal(err)
+	}
+	put := func(db *Db, from, to int) {
+		t.Helper()
+		for i := from; i < to; i++ {
+			if err := db.Put(fmt.Sprintf("key-%d", i), strings.Repeat("v", 20)); err != nil {
+				t.Fatal(err)
+			}
+		}
+	}
+	put(db, 0, 5)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	db, err = OpenWithLimit(tmp, 100, WithShardedLayout())
+	if err != nil {
+		t.Fatal(err)
+	}
+	put(db, 5, 300)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	shards, err := os.ReadDir(filepath.Join(tmp, segmentsDirName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(shards) < 2 {
+		t.Errorf("expected segments spread over several shards, got %d", len(shards))
+	}
+	flat, err := filepath.Glob(filepath.Join(tmp, outFileNamePrefix+"*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(flat) == 0 {
+		t.Error("flat segments of the old layout should stay in place")
+	}
+
+	for _, opts := range [][]Option{{WithShardedLayout()}, nil} {
+		db, err := OpenWithLimit(tmp, 100, opts...)
+		if err != nil {
+			t.Fatal(err)
+		}
+		for i := 0; i < 300; i++ {
+			if _, err := db.Get(fmt.Sprintf("key-%d", i)); err != nil {
+				t.Errorf("Get(key-%d): %v", i, err)
+			}
+		}
+		st, err := db.Stats()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if st.Keys != 300 || st.Segments != st.CurrentSegmentID {
+			t.Errorf("Stats() = %+v", st)
+		}
+		if err := db.Close(); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
@@ -0,0 +1,37 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+)
+
+// lockFileName is the file in a store directory held locked by the
+// process that has the store open for writing.
+const lockFileName = "LOCK"
+
+// ErrLocked is returned by Open when another process has the directory
+// open for writing.
+var ErrLocked = errors.New("database directory is locked by another process")
+
+// lockDir takes the lock of dir and records the pid of the process in the
+// lock file. The lock is held until the returned file is closed, also if
+// the process dies without closing it.
+func lockDir(dir string, modes fileModes) (*os.File, error) {
+	if err := modes.mkdirAll(dir); err != nil {
+		return nil, err
+	}
+	f, err := modes.openFile(filepath.Join(dir, lockFileName), os.O_CREATE|os.O_RDWR)
+	if err != nil {
+		return nil, err
+	}
+	if err := lockFile(f); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	if err := f.Truncate(0); err == nil {
+		_, _ = fmt.Fprintf(f, "%d\n", os.Getpid())
+	}
+	return f, nil
+}
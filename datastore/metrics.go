@@ -0,0 +1,27 @@
+package datastore
+
+// MetricsSink receives a call for every operation of a Db. Implementations
+// must be safe for concurrent use and should return quickly, as they are
+// called on the read and write paths.
+type MetricsSink interface {
+	// IncPuts is called for every stored value, including each pair of a
+	// batch. Deletes are not counted.
+	IncPuts()
+	IncGets()
+	// IncGetMisses is called when Get finds no value for the key.
+	IncGetMisses()
+	// IncCorruptions is called when a read fails the record checksum.
+	IncCorruptions()
+	IncCompactions()
+	// ObserveValueSize records the size of every stored value in bytes.
+	ObserveValueSize(size int)
+}
+
+type noopMetrics struct{}
+
+func (noopMetrics) IncPuts()             {}
+func (noopMetrics) IncGets()             {}
+func (noopMetrics) IncGetMisses()        {}
+func (noopMetrics) IncCorruptions()      {}
+func (noopMetrics) IncCompactions()      {}
+func (noopMetrics) ObserveValueSize(int) {}
@@ -0,0 +1,87 @@
+package datastore
+
+import (
+	"errors"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sync"
+	"testing"
+)
+
+type recordingSink struct {
+	mu     sync.Mutex
+	counts map[string]int
+	sizes  []int
+}
+
+func (s *recordingSink) inc(name string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.counts == nil {
+		s.counts = make(map[string]int)
+	}
+	s.counts[name]++
+}
+
+func (s *recordingSink) IncPuts()        { s.inc("puts") }
+func (s *recordingSink) IncGets()        { s.inc("gets") }
+func (s *recordingSink) IncGetMisses()   { s.inc("misses") }
+func (s *recordingSink) IncCorruptions() { s.inc("corruptions") }
+func (s *recordingSink) IncCompactions() { s.inc("compactions") }
+
+func (s *recordingSink) ObserveValueSize(size int) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.sizes = append(s.sizes, size)
+}
+
+func TestDb_Metrics(t *testing.T) {
+	tmp := t.TempDir()
+	sink := &recordingSink{}
+	db, err := OpenWithLimit(tmp, 40, WithMetrics(sink))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	if err := db.Put("a", "1"); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.PutBatch([]KV{{Key: "b", Value: "22"}, {Key: "c", Value: "333"}}); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Delete("c"); err != nil {
+		t.Fatal(err)
+	}
+	for _, key := range []string{"a", "b", "c", "missing"} {
+		_, _ = db.Get(key)
+	}
+
+	// Corrupt the value of "a" in place; it follows the 13 byte header and
+	// the key.
+	ref, _ := db.index.get("a")
+	f, err := os.OpenFile(filepath.Join(tmp, segmentFilename(ref.segmentId)), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("X"), ref.offset+13+1); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+	if _, err := db.Get("a"); !errors.Is(err, ErrCorrupted) {
+		t.Fatalf("Get() of a corrupted record: %v", err)
+	}
+
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]int{"puts": 3, "gets": 5, "misses": 2, "corruptions": 1, "compactions": 1}
+	if !reflect.DeepEqual(sink.counts, want) {
+		t.Errorf("counts = %v, want %v", sink.counts, want)
+	}
+	if !reflect.DeepEqual(sink.sizes, []int{1, 2, 3}) {
+		t.Errorf("value sizes = %v", sink.sizes)
+	}
+}
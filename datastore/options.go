@@ -0,0 +1,321 @@
+package datastore
+
+import (
+	"log/slog"
+	"os"
+	"runtime"
+	"time"
+)
+
+type Option func(*options)
+
+type options struct {
+	segmentLimit   int64
+	checksum       Checksum
+	syncPolicy     SyncPolicy
+	indexShards    int
+	compressMin    int
+	encryptKey     []byte
+	compactAt      int
+	readOnly       bool
+	shardedLayout  bool
+	segmentRecords int
+	writeBuffer    int
+	writers        int
+	syncWrites     bool
+	metrics        MetricsSink
+	logger         *slog.Logger
+	cacheBytes     int64
+	maxBytes       int64
+	warmupPrefix   string
+	warmupMax      int
+	warmupTimeout  time.Duration
+	hashedKeys     bool
+	chunkValues    bool
+	skipVerify     bool
+	scrubInterval  time.Duration
+	modes          fileModes
+	onCorruption   func(CorruptedRecord)
+	clock          func() time.Time
+}
+
+func defaultOptions() options {
+	return options{
+		segmentLimit: defaultMaxSegmentSize,
+		checksum:     defaultChecksum,
+		syncPolicy:   SyncNever,
+		indexShards:  runtime.NumCPU(),
+		metrics:      noopMetrics{},
+		logger:       slog.Default(),
+		writeBuffer:  100,
+		writers:      1,
+		modes:        defaultFileModes,
+
+		warmupTimeout: defaultWarmupTimeout,
+		clock:         time.Now,
+	}
+}
+
+// WithSegmentLimit sets the size in bytes at which the current segment is
+// sealed and a new one started. A single record must fit within the limit.
+// The default is 10 MB.
+func WithSegmentLimit(n int64) Option {
+	return func(o *options) {
+		o.segmentLimit = n
+	}
+}
+
+// WithReadOnly opens the store for reading only, see OpenReadOnly.
+func WithReadOnly() Option {
+	return func(o *options) {
+		o.readOnly = true
+	}
+}
+
+// WithChecksum selects the algorithm used for newly written records. Records
+// already on disk keep their own algorithm and remain readable.
+func WithChecksum(c Checksum) Option {
+	return func(o *options) {
+		o.checksum = c
+	}
+}
+
+// WithIndexShards splits the in-memory index into n independently locked
+// shards. More shards reduce lock contention between concurrent readers and
+// the writer; n = 1 keeps a single map. The default is runtime.NumCPU().
+func WithIndexShards(n int) Option {
+	return func(o *options) {
+		o.indexShards = n
+	}
+}
+
+// WithCompression flate-compresses values of at least threshold bytes before
+// they are written. Values that do not shrink are stored as is. Records are
+// readable whatever the option, so it can be changed between runs.
+func WithCompression(threshold int) Option {
+	return func(o *options) {
+		o.compressMin = threshold
+	}
+}
+
+// WithEncryptionKey encrypts values on disk with AES-256-GCM. key must be 32
+// bytes long. Keys are stored in plain text. Reading values written with a
+// different key (or without one) fails with ErrCorrupted.
+func WithEncryptionKey(key []byte) Option {
+	return func(o *options) {
+		o.encryptKey = key
+	}
+}
+
+// CompactAfterSegments runs Compact in the background whenever more than n
+// read-only segments have accumulated. n <= 0, the default, leaves compaction
+// to explicit Compact calls.
+func CompactAfterSegments(n int) Option {
+	return func(o *options) {
+		o.compactAt = n
+	}
+}
+
+// WithFileModes sets the permissions of the files the store creates, 0o600
+// by default, and of its directories, 0o755 by default. The modes are
+// applied exactly, without the process umask, also to an existing store
+// directory; values are stored in the clear unless WithEncryptionKey is used.
+func WithFileModes(file, dir os.FileMode) Option {
+	return func(o *options) {
+		o.modes = fileModes{file: file.Perm(), dir: dir.Perm(), exact: true}
+	}
+}
+
+// WithScrub checks every record of every segment in the background each
+// interval, like Verify, so that damaged records are found before a read
+// hits them. The scan is throttled and waits while a compaction runs. Each
+// corrupted record is logged, counted by IncCorruptions and passed to
+// onCorruption, which may be nil, on every scan until it is compacted away.
+func WithScrub(interval time.Duration, onCorruption func(CorruptedRecord)) Option {
+	return func(o *options) {
+		o.scrubInterval = interval
+		o.onCorruption = onCorruption
+	}
+}
+
+// WithMetrics reports every operation to sink.
+func WithMetrics(sink MetricsSink) Option {
+	return func(o *options) {
+		if sink != nil {
+			o.metrics = sink
+		}
+	}
+}
+
+// WithLogger sends the log records of the database to logger instead of
+// slog.Default(). Segment rollovers and compactions are logged at the debug
+// level.
+func WithLogger(logger *slog.Logger) Option {
+	return func(o *options) {
+		if logger != nil {
+			o.logger = logger
+		}
+	}
+}
+
+// WithValueCache keeps recently read values in memory, up to about
+// maxBytes including keys, so repeated reads of hot keys skip the segment
+// files. Writes of a key invalidate its cached value. The cache is disabled
+// by default.
+func WithValueCache(maxBytes int64) Option {
+	return func(o *options) {
+		o.cacheBytes = maxBytes
+	}
+}
+
+// WithMaxBytes caps the size of the store at about n bytes, which makes it
+// lossy by design: when a compaction finds more live data than fits, the
+// tombstones of deleted keys are dropped, then the keys written longest
+// ago are deleted, leaving a tombstone each, until the rest does. Each
+// partition gets an equal share of n, and the current segments count
+// against it. Eviction only happens in compactions, so the store can grow
+// past n between them; CompactAfterSegments runs them regularly.
+func WithMaxBytes(n int64) Option {
+	return func(o *options) {
+		o.maxBytes = n
+	}
+}
+
+// WithHashedKeys makes the index hold a 16 byte digest of every key instead
+// of the key itself, which saves memory with long keys. Full keys stay in
+// the segment files only, so looking a key up also reads its record to rule
+// out another key with the same digest; such keys are told apart and kept
+// separately. Exists, Keys and Scan read records too with this option.
+func WithHashedKeys() Option {
+	return func(o *options) {
+		o.hashedKeys = true
+	}
+}
+
+// WithVerifyOnRead sets whether reads compare the checksum of every record
+// they decode, which is the default. Skipping the comparison saves hashing
+// the whole record on every read that misses the value cache, at the cost
+// of returning damaged values instead of ErrCorrupted: only damage that
+// breaks the record lengths, or compressed or encrypted values that fail to
+// open, is still detected. Compaction copies records without checking them
+// either way, and Verify always checks them.
+func WithVerifyOnRead(verify bool) Option {
+	return func(o *options) {
+		o.skipVerify = !verify
+	}
+}
+
+// WithChunkedValues lets values too large for a segment be stored as a
+// chain of chunks, each written as its own record filling a segment,
+// instead of being rejected with ErrValueTooLarge. Reading such a value
+// reads all its segments, and the segments of a chain are only compacted
+// once the current segment has rolled past it. Compaction then merges the
+// chunks into one record, so merged segments can hold values far above the
+// segment limit.
+func WithChunkedValues() Option {
+	return func(o *options) {
+		o.chunkValues = true
+	}
+}
+
+// WithWarmup makes Open read up to max of the most recently written keys
+// starting with prefix into the value cache, so the first reads of them
+// skip the disk. It needs WithValueCache. Open spends at most the
+// WithWarmupTimeout duration, 5 seconds by default, on it.
+func WithWarmup(prefix string, max int) Option {
+	return func(o *options) {
+		o.warmupPrefix = prefix
+		o.warmupMax = max
+	}
+}
+
+// WithWarmupTimeout bounds the time Open spends on WithWarmup.
+func WithWarmupTimeout(d time.Duration) Option {
+	return func(o *options) {
+		o.warmupTimeout = d
+	}
+}
+
+// WithShardedLayout places new segments in subdirectories of dir
+// (segments/<shard>/segment-<id>) instead of dir itself, which keeps
+// directory listings short for stores with many segments. Segments are
+// found in either layout, so existing stores can be opened with or without
+// this option.
+func WithShardedLayout() Option {
+	return func(o *options) {
+		o.shardedLayout = true
+	}
+}
+
+// WithMaxSegmentRecords rolls over to a new segment once the current one
+// holds n records, even if it is below the byte limit. The byte limit still
+// applies, and only it decides whether a record is rejected with
+// ErrValueTooLarge. n <= 0, the default, disables the record limit.
+func WithMaxSegmentRecords(n int) Option {
+	return func(o *options) {
+		o.segmentRecords = n
+	}
+}
+
+// WithWriteBuffer sets how many write requests may wait for the writer. Once
+// the buffer is full, Put and the other writes block until the writer
+// catches up (or, for PutContext, until the context is done). n = 0 makes
+// every write hand its request directly to the writer. The default is 100.
+func WithWriteBuffer(n int) Option {
+	return func(o *options) {
+		o.writeBuffer = n
+	}
+}
+
+// WithWriters splits the store into n partitions, each with its own writer
+// goroutine and segment files. A key always goes to the partition chosen by
+// its hash, so writes of keys in different partitions proceed in parallel.
+// The number is recorded in dir when it is above 1 and must stay the same
+// between runs. The default is 1.
+func WithWriters(n int) Option {
+	return func(o *options) {
+		o.writers = n
+	}
+}
+
+// SynchronousWrites makes writes append their records on the calling
+// goroutine, holding a lock of the partition, instead of handing them to a
+// writer goroutine. Writes behave the same apart from the missing queue, so
+// WithWriteBuffer has no effect. SyncInterval needs the writer goroutine and
+// cannot be combined with this mode.
+func SynchronousWrites(enabled bool) Option {
+	return func(o *options) {
+		o.syncWrites = enabled
+	}
+}
+
+// SyncPolicy defines when written records are fsynced to stable storage.
+type SyncPolicy struct {
+	everyWrite bool
+	interval   time.Duration
+}
+
+var (
+	// SyncNever leaves flushing to the operating system. Writes are as fast as
+	// the page cache allows, but a power loss may drop acknowledged Puts.
+	SyncNever = SyncPolicy{}
+	// SyncEveryWrite fsyncs before each Put returns. Acknowledged writes are
+	// durable, at the cost of one fsync per write request.
+	SyncEveryWrite = SyncPolicy{everyWrite: true}
+)
+
+// SyncInterval fsyncs pending writes at most once per d, bounding the window
+// of writes that can be lost while keeping most of the SyncNever throughput.
+func SyncInterval(d time.Duration) SyncPolicy {
+	return SyncPolicy{interval: d}
+}
+
+// WithSyncPolicy sets when records are fsynced, SyncNever by default. With
+// SyncEveryWrite a write is durable once it returns; with SyncInterval a
+// crash loses at most the writes of the last interval, and a failed fsync is
+// returned by the next write to the partition.
+func WithSyncPolicy(p SyncPolicy) Option {
+	return func(o *options) {
+		o.syncPolicy = p
+	}
+}
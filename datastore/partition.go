@@ -0,0 +1,123 @@
+package datastore
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash/fnv"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// partitionsFileName records the number of partitions of a store opened
+// WithWriters(n) with n > 1. A store without it has a single partition.
+const partitionsFileName = "PARTITIONS"
+
+// partition owns the append path of the keys hashing to it: a writer
+// goroutine, the current segment and its hints. Segment ids are dealt out
+// so that id % len(db.partitions) is the partition owning the segment, and
+// a key never moves between partitions, so replaying all segments in id
+// order still yields the latest record of every key.
+type partition struct {
+	id      int
+	writeCh chan writeRequest
+	stopped chan struct{} // closed when the writer exits
+	// mu serializes writes when there is no writer goroutine.
+	mu        sync.Mutex
+	syncErr   error
+	segment   *os.File
+	segmentId int
+	offset    int64
+	hints     []hintRecord
+	// pinned, when set, is the first segment of a chunked value that is not
+	// sealed as a whole yet. It and the later segments are not compacted.
+	pinned int
+	// created lists the segments rolled over to while committing is set,
+	// for commitEntries to remove if the commit fails.
+	committing bool
+	created    []int
+}
+
+func keyHash(key string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(key))
+	return h.Sum32()
+}
+
+func (db *Db) partitionOf(key string) *partition {
+	if len(db.partitions) == 1 {
+		return db.partitions[0]
+	}
+	return db.partitions[keyHash(key)%uint32(len(db.partitions))]
+}
+
+func (db *Db) segmentPartition(id int) *partition {
+	return db.partitions[id%len(db.partitions)]
+}
+
+// nextSegmentId returns the id of the segment following the current one of
+// p.
+func (db *Db) nextSegmentId(p *partition) int {
+	if p.segmentId > 0 {
+		return p.segmentId + len(db.partitions)
+	}
+	if p.id == 0 {
+		return len(db.partitions)
+	}
+	return p.id
+}
+
+// checkPartitions makes sure the store in dir was created with as many
+// partitions as configured, recording the number for a new store.
+func (db *Db) checkPartitions(empty bool) error {
+	path := filepath.Join(db.dir, partitionsFileName)
+	stored := 1
+	data, err := fs.ReadFile(db.fsys, partitionsFileName)
+	switch {
+	case err == nil:
+		if stored, err = strconv.Atoi(strings.TrimSpace(string(data))); err != nil || stored < 1 {
+			return fmt.Errorf("invalid %s file: %q", partitionsFileName, data)
+		}
+	case !errors.Is(err, fs.ErrNotExist):
+		return err
+	}
+
+	n := len(db.partitions)
+	if empty && !db.readOnly {
+		if n == 1 {
+			if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+				return err
+			}
+			return nil
+		}
+		return db.modes.writeFile(path, []byte(strconv.Itoa(n)+"\n"))
+	}
+	if !empty && stored != n {
+		return fmt.Errorf("store in %s has %d partitions, opened with %d writers", db.dir, stored, n)
+	}
+	return nil
+}
+
+// submitEntries hands entries to the writer of their partition and returns
+// the refs in the order of entries. Entries spanning several partitions are
+// committed with every writer paused, like a Batch, so that a failure in one
+// partition does not leave the share of the others visible.
+func (db *Db) submitEntries(ctx context.Context, entries []entry) ([]segmentRef, error) {
+	p := db.partitionOf(entries[0].key)
+	for _, e := range entries[1:] {
+		if db.partitionOf(e.key) != p {
+			if err := ctx.Err(); err != nil {
+				return nil, err
+			}
+			if db.readOnly {
+				return nil, ErrReadOnly
+			}
+			return db.commitEntries(entries)
+		}
+	}
+	return db.submit(ctx, p, writeRequest{entries: entries})
+}
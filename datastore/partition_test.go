@@ -0,0 +1,170 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"math/rand"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+func TestDb_Writers(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := OpenWithLimit(tmp, 512, WithWriters(4), CompactAfterSegments(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	const (
+		workers = 8
+		keys    = 20
+		ops     = 300
+	)
+	// Every worker owns its keys, so the final state of each key is known.
+	want := make([]map[string]string, workers)
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		want[w] = make(map[string]string)
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			rnd := rand.New(rand.NewSource(int64(w)))
+			for op := 0; op < ops; op++ {
+				key := fmt.Sprintf("w%d-key-%d", w, rnd.Intn(keys))
+				switch rnd.Intn(5) {
+				case 0:
+					err := db.Delete(key)
+					if err != nil && !errors.Is(err, ErrNotFound) {
+						t.Errorf("Delete(%s): %v", key, err)
+						return
+					}
+					delete(want[w], key)
+				case 1:
+					batch := []KV{
+						{Key: key, Value: fmt.Sprintf("batch-%d", op)},
+						{Key: fmt.Sprintf("w%d-key-%d", w, rnd.Intn(keys)), Value: fmt.Sprintf("batch-%d", op)},
+					}
+					if err := db.PutBatch(batch); err != nil {
+						t.Errorf("PutBatch: %v", err)
+						return
+					}
+					for _, kv := range batch {
+						want[w][kv.Key] = kv.Value
+					}
+				default:
+					value := fmt.Sprintf("value-%d", op)
+					if err := db.Put(key, value); err != nil {
+						t.Errorf("Put(%s): %v", key, err)
+						return
+					}
+					want[w][key] = value
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	check := func(db *Db) {
+		t.Helper()
+		count := 0
+		for w := 0; w < workers; w++ {
+			for i := 0; i < keys; i++ {
+				key := fmt.Sprintf("w%d-key-%d", w, i)
+				got, err := db.Get(key)
+				if value, ok := want[w][key]; ok {
+					count++
+					if err != nil || got != value {
+						t.Errorf("Get(%s) = %q, %v; want %q", key, got, err, value)
+					}
+				} else if !errors.Is(err, ErrNotFound) {
+					t.Errorf("Get(%s) = %q, %v; want ErrNotFound", key, got, err)
+				}
+			}
+		}
+		if n := len(db.Keys()); n != count {
+			t.Errorf("len(Keys()) = %d, want %d", n, count)
+		}
+	}
+	check(db)
+	// The background compaction may still be running.
+	for {
+		err := db.Compact()
+		if err == nil {
+			break
+		}
+		if !errors.Is(err, ErrCompacting) {
+			t.Fatal(err)
+		}
+		time.Sleep(time.Millisecond)
+	}
+	check(db)
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+
+	if db, err := OpenWithLimit(tmp, 512, WithWriters(2)); err == nil {
+		db.Close()
+		t.Error("Open with a different number of writers succeeded")
+	}
+	db, err = OpenWithLimit(tmp, 512, WithWriters(4))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	check(db)
+}
+
+func TestDb_WritersBatchRejected(t *testing.T) {
+	db, err := OpenWithLimit(t.TempDir(), 100, WithWriters(3))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var batch []KV
+	for i := 0; i < 10; i++ {
+		batch = append(batch, KV{Key: fmt.Sprintf("key-%d", i), Value: "v"})
+	}
+	batch = append(batch, KV{Key: "big", Value: strings.Repeat("v", 100)})
+	if err := db.PutBatch(batch); !errors.Is(err, ErrValueTooLarge) {
+		t.Fatalf("PutBatch() with an oversized value: %v, want ErrValueTooLarge", err)
+	}
+	for _, kv := range batch {
+		if _, err := db.Get(kv.Key); !errors.Is(err, ErrNotFound) {
+			t.Errorf("Get(%s) after a rejected batch: %v, want ErrNotFound", kv.Key, err)
+		}
+	}
+}
+
+// BenchmarkDb_Writers fsyncs every write, so writers of different
+// partitions overlap their waits on the disk even on a single core.
+func BenchmarkDb_Writers(b *testing.B) {
+	for _, writers := range []int{1, 2, 4, 8} {
+		b.Run(fmt.Sprintf("writers=%d", writers), func(b *testing.B) {
+			db, err := Open(b.TempDir(), WithWriters(writers), WithSyncPolicy(SyncEveryWrite))
+			if err != nil {
+				b.Fatal(err)
+			}
+			defer db.Close()
+			value := make([]byte, 128)
+			var next sync.Mutex
+			n := 0
+			b.SetParallelism(4)
+			b.ResetTimer()
+			b.RunParallel(func(pb *testing.PB) {
+				next.Lock()
+				worker := n
+				n++
+				next.Unlock()
+				for i := 0; pb.Next(); i++ {
+					if err := db.PutBytes(fmt.Sprintf("key-%d-%d", worker, i%1000), value); err != nil {
+						b.Error(err)
+						return
+					}
+				}
+			})
+		})
+	}
+}
@@ -0,0 +1,43 @@
+package datastore
+
+import "os"
+
+// fileModes are the permissions of the files and directories a Db creates,
+// see WithFileModes.
+type fileModes struct {
+	file os.FileMode
+	dir  os.FileMode
+	// exact applies the modes as given instead of masking them with the
+	// process umask.
+	exact bool
+}
+
+var defaultFileModes = fileModes{file: 0o600, dir: 0o755}
+
+func (m fileModes) openFile(path string, flag int) (*os.File, error) {
+	f, err := os.OpenFile(path, flag, m.file)
+	if err != nil || !m.exact || flag&os.O_CREATE == 0 {
+		return f, err
+	}
+	if err := f.Chmod(m.file); err != nil {
+		_ = f.Close()
+		return nil, err
+	}
+	return f, nil
+}
+
+func (m fileModes) writeFile(path string, data []byte) error {
+	if err := os.WriteFile(path, data, m.file); err != nil || !m.exact {
+		return err
+	}
+	return os.Chmod(path, m.file)
+}
+
+// mkdirAll creates dir and its missing parents. Only dir itself gets the
+// exact mode, not the parents.
+func (m fileModes) mkdirAll(dir string) error {
+	if err := os.MkdirAll(dir, m.dir); err != nil || !m.exact {
+		return err
+	}
+	return os.Chmod(dir, m.dir)
+}
@@ -0,0 +1,109 @@
+package datastore
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"os"
+	"runtime"
+)
+
+// ErrOutOfRange is returned by GetRange when the range does not lie within
+// the value.
+var ErrOutOfRange = errors.New("range is outside the value")
+
+// GetRange returns length bytes of the value of key starting at off. For
+// values stored as is, only those bytes are read from the segment, which
+// leaves the record checksum unchecked; compressed, encrypted and chunked
+// values are read whole and checked as by Get.
+func (db *Db) GetRange(key string, off, length int64) ([]byte, error) {
+	if db.closed.Load() {
+		return nil, ErrClosed
+	}
+	db.metrics.IncGets()
+	value, err := db.getRange(key, off, length)
+	if errors.Is(err, ErrNotFound) {
+		db.metrics.IncGetMisses()
+	}
+	if errors.Is(err, ErrCorrupted) {
+		db.metrics.IncCorruptions()
+	}
+	return value, err
+}
+
+func (db *Db) getRange(key string, off, length int64) ([]byte, error) {
+	for {
+		gen := db.swapGen.Load()
+		ref, ok := db.index.lookup(key)
+		if !ok {
+			return nil, ErrNotFound
+		}
+		if size := int64(ref.valueSize); off < 0 || length < 0 || off > size || length > size-off {
+			return nil, fmt.Errorf("%w: %d bytes at %d of %d", ErrOutOfRange, length, off, ref.valueSize)
+		}
+		if record, _, ok := db.values.get(key, ref); ok {
+			return bytes.Clone(record.value[off : off+length]), nil
+		}
+		value, err := db.readRange(key, ref, off, length)
+		if gen%2 == 1 || db.swapGen.Load() != gen {
+			runtime.Gosched()
+			continue
+		}
+		return value, err
+	}
+}
+
+// readRange reads the bytes of the value ref points to, falling back to
+// readRecord for values not stored as is.
+func (db *Db) readRange(key string, ref segmentRef, off, length int64) ([]byte, error) {
+	f, err := db.segmentFile(ref.segmentId)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, ErrSegmentMissing
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	corrupted := fmt.Errorf("%w: record of %q in segment %d at offset %d", ErrCorrupted, key, ref.segmentId, ref.offset)
+	var header [9]byte
+	if _, err := f.ReadAt(header[:], ref.offset); err != nil {
+		return nil, corrupted
+	}
+	sizeField := binary.LittleEndian.Uint32(header[:])
+	if sizeField&taggedRecord == 0 || header[4]&(flagCompressed|flagEncrypted|flagChunk) != 0 {
+		record, _, err := db.readRecord(key, ref)
+		if err != nil {
+			return nil, err
+		}
+		if size := int64(len(record.value)); off > size || length > size-off {
+			return nil, corrupted
+		}
+		return record.value[off : off+length], nil
+	}
+
+	size := int64(sizeField &^ taggedRecord)
+	kl := int64(binary.LittleEndian.Uint32(header[5:]))
+	if 13+kl > size {
+		return nil, corrupted
+	}
+	keyBuf := make([]byte, kl+4)
+	if _, err := f.ReadAt(keyBuf, ref.offset+9); err != nil {
+		return nil, corrupted
+	}
+	if string(keyBuf[:kl]) != key {
+		if db.index.hashed() {
+			return nil, ErrNotFound
+		}
+		return nil, corrupted
+	}
+	if vl := binary.LittleEndian.Uint32(keyBuf[kl:]); vl == tombstoneLength || int64(vl) != int64(ref.valueSize) || 13+kl+int64(vl) > size {
+		return nil, corrupted
+	}
+
+	value := make([]byte, length)
+	if _, err := f.ReadAt(value, ref.offset+13+kl+off); err != nil {
+		return nil, corrupted
+	}
+	return value, nil
+}
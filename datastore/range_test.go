@@ -0,0 +1,59 @@
+package datastore
+
+import (
+	"errors"
+	"fmt"
+	"math"
+	"strings"
+	"testing"
+)
+
+func TestDb_GetRange(t *testing.T) {
+	var b strings.Builder
+	for i := 0; b.Len() < 4096; i++ {
+		fmt.Fprintf(&b, "%d,", i)
+	}
+	value := b.String()
+
+	for name, opts := range map[string][]Option{
+		"plain":      nil,
+		"cached":     {WithValueCache(1 << 20)},
+		"compressed": {WithCompression(16)},
+	} {
+		t.Run(name, func(t *testing.T) {
+			db, err := Open(t.TempDir(), opts...)
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer db.Close()
+			if err := db.Put("key", value); err != nil {
+				t.Fatal(err)
+			}
+			if name == "cached" {
+				if _, err := db.Get("key"); err != nil {
+					t.Fatal(err)
+				}
+			}
+
+			for _, r := range [][2]int64{{0, 10}, {100, 1000}, {int64(len(value)) - 7, 7}, {0, int64(len(value))}, {5, 0}, {int64(len(value)), 0}} {
+				got, err := db.GetRange("key", r[0], r[1])
+				if err != nil {
+					t.Errorf("GetRange(%d, %d): %v", r[0], r[1], err)
+					continue
+				}
+				if want := value[r[0] : r[0]+r[1]]; string(got) != want {
+					t.Errorf("GetRange(%d, %d) = %q, want %q", r[0], r[1], got, want)
+				}
+			}
+
+			for _, r := range [][2]int64{{-1, 5}, {0, -1}, {int64(len(value)) - 1, 2}, {int64(len(value)) + 1, 0}, {math.MaxInt64, 1}, {1, math.MaxInt64}, {math.MaxInt64, math.MaxInt64}} {
+				if _, err := db.GetRange("key", r[0], r[1]); !errors.Is(err, ErrOutOfRange) {
+					t.Errorf("GetRange(%d, %d): %v, want ErrOutOfRange", r[0], r[1], err)
+				}
+			}
+			if _, err := db.GetRange("missing", 0, 1); !errors.Is(err, ErrNotFound) {
+				t.Errorf("GetRange() of a missing key: %v, want ErrNotFound", err)
+			}
+		})
+	}
+}
@@ -0,0 +1,85 @@
+package datastore
+
+import (
+	"errors"
+	"io"
+	"time"
+)
+
+// scrubBytesPerSecond bounds how fast the scrubber reads segments, so that
+// it does not compete with client reads for the disk.
+const scrubBytesPerSecond = 8 << 20
+
+var errScrubStopped = errors.New("scrubber stopped")
+
+// scrubber runs a throttled Verify every interval and reports the corrupted
+// records it finds, until Close.
+func (db *Db) scrubber(interval time.Duration, onCorruption func(CorruptedRecord)) {
+	defer db.wg.Done()
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-db.closeCh:
+			return
+		case <-ticker.C:
+		}
+		start := time.Now()
+		report, err := db.verify(db.throttle)
+		if errors.Is(err, errScrubStopped) {
+			return
+		}
+		if err != nil {
+			db.logger.Warn("datastore: scrub failed", "err", err)
+			continue
+		}
+		for _, c := range report.Corrupted {
+			db.metrics.IncCorruptions()
+			db.logger.Error("datastore: scrub found a corrupted record", "segment", c.SegmentID, "offset", c.Offset)
+			if onCorruption != nil {
+				onCorruption(c)
+			}
+		}
+		db.logger.Debug("datastore: scrub finished", "segments", report.Segments, "bytes", report.BytesScanned, "corrupted", report.BadRecords, "duration", time.Since(start))
+	}
+}
+
+// throttle wraps a segment read by the scrubber.
+func (db *Db) throttle(r io.Reader) io.Reader {
+	return &throttledReader{db: db, r: r, start: time.Now()}
+}
+
+// throttledReader reads at most scrubBytesPerSecond and waits while a
+// compaction runs. Reads fail with errScrubStopped once the Db is closed.
+type throttledReader struct {
+	db    *Db
+	r     io.Reader
+	start time.Time
+	n     int64
+}
+
+func (t *throttledReader) Read(p []byte) (int, error) {
+	select {
+	case <-t.db.closeCh:
+		return 0, errScrubStopped
+	default:
+	}
+	// Compaction holds compactMu while it runs; waiting for it without
+	// holding the lock keeps Compact from failing with ErrCompacting.
+	t.db.compactMu.Lock()
+	t.db.compactMu.Unlock()
+
+	n, err := t.r.Read(p)
+	t.n += int64(n)
+	due := t.start.Add(time.Duration(t.n * int64(time.Second) / scrubBytesPerSecond))
+	if wait := time.Until(due); wait > 0 {
+		timer := time.NewTimer(wait)
+		defer timer.Stop()
+		select {
+		case <-t.db.closeCh:
+			return n, errScrubStopped
+		case <-timer.C:
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,59 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"testing"
+	"time"
+)
+
+func TestDb_Scrub(t *testing.T) {
+	tmp := t.TempDir()
+	found := make(chan CorruptedRecord, 10)
+	db, err := OpenWithLimit(tmp, 200, WithScrub(10*time.Millisecond, func(c CorruptedRecord) {
+		select {
+		case found <- c:
+		default:
+		}
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	for i := 0; i < 20; i++ {
+		if err := db.Put(fmt.Sprintf("key-%d", i), "value"); err != nil {
+			t.Fatal(err)
+		}
+	}
+	_, meta, err := db.GetWithMetadata("key-3")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := fmt.Sprintf("%s/segment-%d", tmp, meta.SegmentID)
+	data, err := os.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	data[meta.Offset+int64(meta.Size)-int64(len(meta.Checksum))-1] ^= 0xFF
+	if err := os.WriteFile(path, data, 0o600); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case c := <-found:
+		if c.SegmentID != meta.SegmentID || c.Offset != meta.Offset {
+			t.Errorf("scrub reported %+v, want segment %d at offset %d", c, meta.SegmentID, meta.Offset)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("scrub did not report the corrupted record")
+	}
+
+	// Compaction runs alongside the scrubber.
+	if err := db.Compact(); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.Close(); err != nil {
+		t.Fatal(err)
+	}
+}
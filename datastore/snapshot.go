@@ -0,0 +1,125 @@
+package datastore
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+	"io"
+	"math"
+)
+
+const (
+	snapshotVersion = 1
+	snapshotEnd     = math.MaxUint32
+)
+
+var snapshotMagic = []byte("SNAP")
+
+// Snapshot layout:
+// (magic[4]) (version[1])
+// (kl[4]) (key) (vl[4]) (value)           <-- per pair, sorted by key
+// (end marker[4]) (pairs[8]) (crc32[4])   <-- crc32 of all above
+
+// Snapshot writes the latest value of every stored key to w. Keys written
+// while Snapshot runs may or may not be included.
+func (db *Db) Snapshot(w io.Writer) error {
+	it := db.NewIterator(IteratorOptions{})
+	defer it.Close()
+
+	bw := bufio.NewWriter(w)
+	crc := crc32.NewIEEE()
+	out := io.MultiWriter(bw, crc)
+	var buf []byte
+
+	buf = append(buf, snapshotMagic...)
+	buf = append(buf, snapshotVersion)
+	if _, err := out.Write(buf); err != nil {
+		return err
+	}
+	pairs := uint64(0)
+	for it.Next() {
+		value, err := db.GetBytes(it.Key())
+		if errors.Is(err, ErrNotFound) {
+			continue
+		}
+		if err != nil {
+			return fmt.Errorf("snapshot %s: %w", it.Key(), err)
+		}
+		buf = binary.LittleEndian.AppendUint32(buf[:0], uint32(len(it.Key())))
+		buf = append(buf, it.Key()...)
+		buf = binary.LittleEndian.AppendUint32(buf, uint32(len(value)))
+		buf = append(buf, value...)
+		if _, err := out.Write(buf); err != nil {
+			return err
+		}
+		pairs++
+	}
+	buf = binary.LittleEndian.AppendUint32(buf[:0], snapshotEnd)
+	buf = binary.LittleEndian.AppendUint64(buf, pairs)
+	if _, err := out.Write(buf); err != nil {
+		return err
+	}
+	if _, err := bw.Write(binary.LittleEndian.AppendUint32(nil, crc.Sum32())); err != nil {
+		return err
+	}
+	return bw.Flush()
+}
+
+// Restore stores every pair of a snapshot written by Snapshot, overwriting
+// existing values of the same keys. The snapshot is held in memory until
+// its checksum is verified, so a damaged snapshot fails with ErrCorrupted
+// without changing the database.
+func (db *Db) Restore(r io.Reader) error {
+	data, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	if len(data) < len(snapshotMagic)+1+16 || !bytes.Equal(data[:len(snapshotMagic)], snapshotMagic) {
+		return fmt.Errorf("not a snapshot: %w", ErrCorrupted)
+	}
+	body, sum := data[:len(data)-4], data[len(data)-4:]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(sum) {
+		return fmt.Errorf("snapshot checksum mismatch: %w", ErrCorrupted)
+	}
+	if v := body[len(snapshotMagic)]; v != snapshotVersion {
+		return fmt.Errorf("unsupported snapshot version %d", v)
+	}
+
+	var entries []entry
+	pos := len(snapshotMagic) + 1
+	for {
+		if pos+4 > len(body) {
+			return fmt.Errorf("truncated snapshot: %w", ErrCorrupted)
+		}
+		kl := binary.LittleEndian.Uint32(body[pos:])
+		pos += 4
+		if kl == snapshotEnd {
+			break
+		}
+		if int(kl) > len(body)-pos-4 {
+			return fmt.Errorf("truncated snapshot: %w", ErrCorrupted)
+		}
+		key := string(body[pos : pos+int(kl)])
+		pos += int(kl)
+		vl := int(binary.LittleEndian.Uint32(body[pos:]))
+		pos += 4
+		if vl > len(body)-pos {
+			return fmt.Errorf("truncated snapshot: %w", ErrCorrupted)
+		}
+		entries = append(entries, entry{key: key, value: body[pos : pos+vl]})
+		pos += vl
+	}
+	if pos+8 != len(body) || binary.LittleEndian.Uint64(body[pos:]) != uint64(len(entries)) {
+		return fmt.Errorf("snapshot pair count mismatch: %w", ErrCorrupted)
+	}
+
+	if len(entries) == 0 {
+		return nil
+	}
+	_, err = db.write(context.Background(), entries)
+	return err
+}
@@ -0,0 +1,72 @@
+package datastore
+
+import (
+	"bytes"
+	"errors"
+	"fmt"
+	"testing"
+)
+
+func TestDb_SnapshotRestore(t *testing.T) {
+	src, err := OpenWithLimit(t.TempDir(), 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer src.Close()
+	for i := 0; i < 20; i++ {
+		if err := src.Put(fmt.Sprintf("key-%d", i), fmt.Sprintf("old-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for i := 0; i < 20; i += 2 {
+		if err := src.Put(fmt.Sprintf("key-%d", i), fmt.Sprintf("new-%d", i)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := src.PutBytes("binary", []byte{0, 1, 2, 255}); err != nil {
+		t.Fatal(err)
+	}
+	if err := src.Delete("key-1"); err != nil {
+		t.Fatal(err)
+	}
+
+	var snap bytes.Buffer
+	if err := src.Snapshot(&snap); err != nil {
+		t.Fatal(err)
+	}
+
+	dst, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer dst.Close()
+	if err := dst.Restore(bytes.NewReader(snap.Bytes())); err != nil {
+		t.Fatal(err)
+	}
+	if got, want := len(dst.Keys()), len(src.Keys()); got != want {
+		t.Errorf("restored %d keys, want %d", got, want)
+	}
+	for _, key := range src.Keys() {
+		want, _ := src.GetBytes(key)
+		if got, err := dst.GetBytes(key); err != nil || !bytes.Equal(got, want) {
+			t.Errorf("GetBytes(%s) = %v, %v; want %v", key, got, err, want)
+		}
+	}
+	if _, err := dst.Get("key-1"); err != ErrNotFound {
+		t.Errorf("deleted key restored: %v", err)
+	}
+
+	damaged := bytes.Clone(snap.Bytes())
+	damaged[len(damaged)/2] ^= 0xff
+	empty, err := Open(t.TempDir())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer empty.Close()
+	if err := empty.Restore(bytes.NewReader(damaged)); !errors.Is(err, ErrCorrupted) {
+		t.Errorf("Restore of a damaged snapshot: %v, want ErrCorrupted", err)
+	}
+	if n := len(empty.Keys()); n != 0 {
+		t.Errorf("damaged snapshot restored %d keys", n)
+	}
+}
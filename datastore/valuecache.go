@@ -0,0 +1,131 @@
+package datastore
+
+import (
+	"container/list"
+	"sync"
+	"sync/atomic"
+)
+
+// valueCacheOverhead approximates the memory a cached value takes besides
+// its key and value bytes.
+const valueCacheOverhead = 96
+
+// valueCache keeps recently read records in memory, evicting the least
+// recently used ones beyond maxBytes. Every item remembers the ref it was
+// read from and only serves lookups for that ref, so a read racing with a
+// write or a compaction can never make the cache return an outdated value.
+// A nil *valueCache caches nothing.
+type valueCache struct {
+	mu       sync.Mutex
+	maxBytes int64
+	bytes    int64
+	ll       *list.List
+	items    map[string]*list.Element
+	hits     int64
+	misses   int64
+}
+
+type valueCacheItem struct {
+	key   string
+	ref   segmentRef
+	value string
+	meta  RecordMeta
+}
+
+func newValueCache(maxBytes int64) *valueCache {
+	if maxBytes <= 0 {
+		return nil
+	}
+	return &valueCache{
+		maxBytes: maxBytes,
+		ll:       list.New(),
+		items:    make(map[string]*list.Element),
+	}
+}
+
+func (it *valueCacheItem) size() int64 {
+	return int64(len(it.key) + len(it.value) + valueCacheOverhead)
+}
+
+// get returns the record of key stored at ref.
+func (c *valueCache) get(key string, ref segmentRef) (entry, RecordMeta, bool) {
+	if c == nil {
+		return entry{}, RecordMeta{}, false
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok || el.Value.(*valueCacheItem).ref != ref {
+		c.misses++
+		return entry{}, RecordMeta{}, false
+	}
+	c.hits++
+	c.ll.MoveToFront(el)
+	it := el.Value.(*valueCacheItem)
+	// Callers own the returned value, so it is copied out.
+	return entry{key: key, value: []byte(it.value), checksum: it.meta.ChecksumAlgo, sum: it.meta.Checksum}, it.meta, true
+}
+
+// add caches a record read while swapGen was gen. Clear empties the cache
+// with swapGen changed; checking gen under mu keeps a read begun before
+// Clear from caching a record of a removed segment afterwards.
+func (c *valueCache) add(ref segmentRef, record entry, meta RecordMeta, swapGen *atomic.Uint64, gen uint64) {
+	if c == nil {
+		return
+	}
+	it := &valueCacheItem{key: record.key, ref: ref, value: string(record.value), meta: meta}
+	if it.size() > c.maxBytes {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if swapGen.Load() != gen {
+		return
+	}
+	if el, ok := c.items[it.key]; ok {
+		c.removeElement(el)
+	}
+	c.items[it.key] = c.ll.PushFront(it)
+	c.bytes += it.size()
+	for c.bytes > c.maxBytes {
+		c.removeElement(c.ll.Back())
+	}
+}
+
+func (c *valueCache) remove(key string) {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.removeElement(el)
+	}
+}
+
+func (c *valueCache) removeElement(el *list.Element) {
+	it := c.ll.Remove(el).(*valueCacheItem)
+	delete(c.items, it.key)
+	c.bytes -= it.size()
+}
+
+func (c *valueCache) clear() {
+	if c == nil {
+		return
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.ll.Init()
+	clear(c.items)
+	c.bytes = 0
+}
+
+// stats returns the hits, misses and bytes of the cache.
+func (c *valueCache) stats() (int64, int64, int64) {
+	if c == nil {
+		return 0, 0, 0
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.hits, c.misses, c.bytes
+}
@@ -0,0 +1,37 @@
+package datastore
+
+import (
+	"sync/atomic"
+	"testing"
+)
+
+func TestValueCache_Evicts(t *testing.T) {
+	var gen atomic.Uint64
+	c := newValueCache(3 * (valueCacheOverhead + 2))
+	for i, k := range []string{"a", "b", "c"} {
+		c.add(segmentRef{offset: int64(i)}, entry{key: k, value: []byte("v")}, RecordMeta{}, &gen, 0)
+	}
+	// Reading a makes b the least recently used.
+	if _, _, ok := c.get("a", segmentRef{offset: 0}); !ok {
+		t.Fatal("a is not cached")
+	}
+	c.add(segmentRef{offset: 3}, entry{key: "d", value: []byte("v")}, RecordMeta{}, &gen, 0)
+	for k, want := range map[string]bool{"a": true, "b": false, "c": true} {
+		ref := segmentRef{offset: map[string]int64{"a": 0, "b": 1, "c": 2}[k]}
+		if _, _, ok := c.get(k, ref); ok != want {
+			t.Errorf("get(%s) cached = %v, want %v", k, ok, want)
+		}
+	}
+	if _, _, ok := c.get("a", segmentRef{offset: 7}); ok {
+		t.Error("get with a different ref hit the cache")
+	}
+
+	gen.Add(1)
+	c.add(segmentRef{}, entry{key: "e", value: []byte("v")}, RecordMeta{}, &gen, 0)
+	if _, _, ok := c.get("e", segmentRef{}); ok {
+		t.Error("A record read before a swap was cached")
+	}
+	if _, _, bytes := c.stats(); bytes > c.maxBytes {
+		t.Errorf("Cache holds %d bytes, limit %d", bytes, c.maxBytes)
+	}
+}
@@ -0,0 +1,102 @@
+package datastore
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+)
+
+// VerifyReport is the result of Verify.
+type VerifyReport struct {
+	Segments     int
+	GoodRecords  int
+	BadRecords   int
+	BytesScanned int64
+	// Corrupted lists the records counted in BadRecords.
+	Corrupted []CorruptedRecord
+}
+
+// CorruptedRecord locates a record that failed to decode.
+type CorruptedRecord struct {
+	SegmentID int
+	Offset    int64
+}
+
+// Verify decodes every record of every segment and reports the ones that
+// are corrupted instead of stopping at the first. A record whose size field
+// is damaged hides the records after it, so the rest of its segment is
+// skipped. Segments removed by a concurrent compaction are left out.
+func (db *Db) Verify() (VerifyReport, error) {
+	if db.closed.Load() {
+		return VerifyReport{}, ErrClosed
+	}
+	return db.verify(nil)
+}
+
+// verify implements Verify. wrap, if set, wraps the reader of every segment.
+func (db *Db) verify(wrap func(io.Reader) io.Reader) (VerifyReport, error) {
+	segments, err := listSegments(db.fsys)
+	if err != nil {
+		return VerifyReport{}, err
+	}
+
+	var report VerifyReport
+	for _, s := range segments {
+		// The current segment is only checked up to the last completed
+		// write.
+		limit := s.size
+		db.mu.RLock()
+		if p := db.segmentPartition(s.id); p.segmentId == s.id {
+			limit = p.offset
+		}
+		db.mu.RUnlock()
+
+		err := db.verifySegment(s, limit, wrap, &report)
+		if errors.Is(err, fs.ErrNotExist) {
+			continue
+		}
+		if err != nil {
+			return VerifyReport{}, fmt.Errorf("verify segment %d: %w", s.id, err)
+		}
+	}
+	return report, nil
+}
+
+func (db *Db) verifySegment(s segmentFileInfo, limit int64, wrap func(io.Reader) io.Reader, report *VerifyReport) error {
+	f, err := db.fsys.Open(s.name)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	report.Segments++
+
+	in := io.LimitReader(f, limit)
+	if wrap != nil {
+		in = wrap(in)
+	}
+	reader := bufio.NewReader(in)
+	offset := int64(0)
+	for {
+		record := entry{aead: db.aead}
+		n, err := record.DecodeFromReader(reader)
+		report.BytesScanned += int64(n)
+		if errors.Is(err, io.EOF) {
+			return nil
+		}
+		if err != nil && !errors.Is(err, ErrCorrupted) && !errors.Is(err, io.ErrUnexpectedEOF) {
+			return err
+		}
+		if err != nil {
+			report.BadRecords++
+			report.Corrupted = append(report.Corrupted, CorruptedRecord{SegmentID: s.id, Offset: offset})
+			if n == 0 || errors.Is(err, io.ErrUnexpectedEOF) {
+				return nil
+			}
+		} else {
+			report.GoodRecords++
+		}
+		offset += int64(n)
+	}
+}
@@ -0,0 +1,59 @@
+package datastore
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestDb_Verify(t *testing.T) {
+	tmp := t.TempDir()
+	db, err := OpenWithLimit(tmp, 200)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	var locs []Location
+	for i := 0; i < 12; i++ {
+		loc, err := db.PutLocated(fmt.Sprintf("key-%d", i), fmt.Sprintf("value-%d", i))
+		if err != nil {
+			t.Fatal(err)
+		}
+		locs = append(locs, loc)
+	}
+	report, err := db.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	st, _ := db.Stats()
+	if report.GoodRecords != 12 || report.BadRecords != 0 || report.BytesScanned != st.DiskBytes || report.Segments != st.Segments {
+		t.Errorf("Verify() of an intact store = %+v, stats %+v", report, st)
+	}
+
+	// Corrupt the value of key-1, which shares its segment with key-0 and
+	// key-2.
+	bad := locs[1]
+	if locs[0].SegmentID != bad.SegmentID || locs[2].SegmentID != bad.SegmentID {
+		t.Fatalf("key-0..2 are not in one segment: %+v", locs[:3])
+	}
+	f, err := os.OpenFile(filepath.Join(tmp, segmentFilename(bad.SegmentID)), os.O_RDWR, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := f.WriteAt([]byte("X"), bad.Offset+13+int64(len("key-1"))); err != nil {
+		t.Fatal(err)
+	}
+	_ = f.Close()
+
+	report, err = db.Verify()
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []CorruptedRecord{{SegmentID: bad.SegmentID, Offset: bad.Offset}}
+	if report.GoodRecords != 11 || report.BadRecords != 1 || !reflect.DeepEqual(report.Corrupted, want) {
+		t.Errorf("Verify() = %+v, want one bad record at %+v", report, bad)
+	}
+}
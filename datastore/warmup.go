@@ -0,0 +1,54 @@
+package datastore
+
+import (
+	"sort"
+	"strings"
+	"time"
+)
+
+const defaultWarmupTimeout = 5 * time.Second
+
+// warmup reads up to max of the most recently written keys starting with
+// prefix into the value cache, newest first, giving up after timeout. Keys
+// of a later segment or offset were written later within a partition, which
+// is as close to write order as the index knows.
+func (db *Db) warmup(prefix string, max int, timeout time.Duration) {
+	deadline := time.Now().Add(timeout)
+	type candidate struct {
+		key string
+		ref segmentRef
+	}
+	keys := db.index.keys(func(key string) bool {
+		return strings.HasPrefix(key, prefix)
+	})
+	candidates := make([]candidate, 0, len(keys))
+	for _, key := range keys {
+		if ref, ok := db.index.get(key); ok {
+			candidates = append(candidates, candidate{key: key, ref: ref})
+		}
+	}
+	sort.Slice(candidates, func(i, j int) bool {
+		a, b := candidates[i].ref, candidates[j].ref
+		if a.segmentId != b.segmentId {
+			return a.segmentId > b.segmentId
+		}
+		return a.offset > b.offset
+	})
+
+	loaded := 0
+	for _, c := range candidates {
+		if loaded == max {
+			break
+		}
+		if time.Now().After(deadline) {
+			db.logger.Warn("datastore: warm-up timed out", "loaded", loaded, "timeout", timeout)
+			return
+		}
+		if _, _, err := db.getRecord(c.key); err != nil {
+			db.logger.Warn("datastore: warm-up read failed", "key", c.key, "err", err)
+			continue
+		}
+		loaded++
+	}
+	db.logger.Debug("datastore: warm-up finished", "loaded", loaded)
+}
@@ -0,0 +1,174 @@
+package dbclient
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func fakeDb(t *testing.T) *httptest.Server {
+	t.Helper()
+	var (
+		mu   sync.Mutex
+		data = map[string]string{}
+	)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, "/db/")
+		mu.Lock()
+		defer mu.Unlock()
+		switch r.Method {
+		case http.MethodGet, http.MethodHead:
+			value, ok := data[key]
+			if !ok {
+				http.NotFound(rw, r)
+				return
+			}
+			_ = json.NewEncoder(rw).Encode(map[string]string{"key": key, "value": value})
+		case http.MethodPost:
+			var body struct {
+				Value string `json:"value"`
+			}
+			if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+				http.Error(rw, "bad request", http.StatusBadRequest)
+				return
+			}
+			data[key] = body.Value
+			rw.WriteHeader(http.StatusCreated)
+		case http.MethodDelete:
+			if _, ok := data[key]; !ok {
+				http.NotFound(rw, r)
+				return
+			}
+			delete(data, key)
+			rw.WriteHeader(http.StatusNoContent)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	return srv
+}
+
+func TestClient(t *testing.T) {
+	c := New(fakeDb(t).URL)
+	ctx := context.Background()
+
+	if _, err := c.Get(ctx, "k"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if ok, err := c.Exists(ctx, "k"); ok || err != nil {
+		t.Errorf("Exists before Put = %t, %v", ok, err)
+	}
+	if err := c.Put(ctx, "k", "v"); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := c.Get(ctx, "k"); err != nil || got != "v" {
+		t.Errorf("Get = %q, %v", got, err)
+	}
+	if ok, err := c.Exists(ctx, "k"); !ok || err != nil {
+		t.Errorf("Exists after Put = %t, %v", ok, err)
+	}
+	if err := c.Delete(ctx, "k"); err != nil {
+		t.Fatal(err)
+	}
+	if err := c.Delete(ctx, "k"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound on second delete, got %v", err)
+	}
+}
+
+func TestClient_UnexpectedStatus(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		http.Error(rw, "boom", http.StatusInternalServerError)
+	}))
+	defer srv.Close()
+
+	_, err := New(srv.URL).Get(context.Background(), "k")
+	if err == nil || errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected a status error, got %v", err)
+	}
+}
+
+func TestClient_Retry(t *testing.T) {
+	var attempts atomic.Int32
+	db := fakeDb(t)
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		if attempts.Add(1) <= 3 {
+			http.Error(rw, "starting", http.StatusServiceUnavailable)
+			return
+		}
+		// t.Fatal must not be called outside the test goroutine.
+		proxy, err := http.NewRequest(r.Method, db.URL+r.URL.Path, r.Body)
+		if err != nil {
+			t.Error(err)
+			http.Error(rw, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp, err := http.DefaultClient.Do(proxy)
+		if err != nil {
+			t.Error(err)
+			http.Error(rw, err.Error(), http.StatusBadGateway)
+			return
+		}
+		defer resp.Body.Close()
+		rw.WriteHeader(resp.StatusCode)
+		_, _ = io.Copy(rw, resp.Body)
+	}))
+	defer srv.Close()
+
+	c := New(srv.URL, WithRetry(5, time.Millisecond))
+	if err := c.Put(context.Background(), "k", "v"); err != nil {
+		t.Fatalf("Put failed after retries: %v", err)
+	}
+	if n := attempts.Load(); n != 4 {
+		t.Errorf("Expected 4 attempts, got %d", n)
+	}
+
+	attempts.Store(10)
+	if _, err := c.Get(context.Background(), "missing"); !errors.Is(err, ErrNotFound) {
+		t.Errorf("Expected ErrNotFound, got %v", err)
+	}
+	if n := attempts.Load(); n != 11 {
+		t.Errorf("Missing key should not be retried, got %d attempts", n-10)
+	}
+
+	attempts.Store(0)
+	c = New(srv.URL, WithRetry(2, time.Millisecond))
+	if err := c.Put(context.Background(), "k", "v"); err == nil {
+		t.Error("Expected Put to give up after 2 attempts")
+	}
+	if n := attempts.Load(); n != 2 {
+		t.Errorf("Expected 2 attempts, got %d", n)
+	}
+}
+
+func TestClient_Timeout(t *testing.T) {
+	release := make(chan struct{})
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, r *http.Request) {
+		select {
+		case <-release:
+		case <-r.Context().Done():
+		}
+	}))
+	defer srv.Close()
+	defer close(release)
+
+	start := time.Now()
+	if _, err := New(srv.URL, WithTimeout(50*time.Millisecond)).Get(context.Background(), "k"); err == nil {
+		t.Error("Expected a timeout error")
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Timeout took too long: %s", elapsed)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if _, err := New(srv.URL, WithRetry(10, time.Millisecond)).Get(ctx, "k"); !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected the caller's deadline to cancel the request, got %v", err)
+	}
+}
@@ -0,0 +1,35 @@
+// Package env reads configuration defaults from environment variables.
+package env
+
+import (
+	"os"
+	"strconv"
+	"time"
+)
+
+// String returns the value of the variable name, or def if it is unset or
+// empty.
+func String(name, def string) string {
+	if v, ok := os.LookupEnv(name); ok && v != "" {
+		return v
+	}
+	return def
+}
+
+// Int returns the variable name parsed as an integer, or def if it is unset
+// or not a number.
+func Int(name string, def int) int {
+	if v, err := strconv.Atoi(os.Getenv(name)); err == nil {
+		return v
+	}
+	return def
+}
+
+// Duration returns the variable name parsed by time.ParseDuration, or def if
+// it is unset or invalid.
+func Duration(name string, def time.Duration) time.Duration {
+	if d, err := time.ParseDuration(os.Getenv(name)); err == nil {
+		return d
+	}
+	return def
+}
@@ -0,0 +1,33 @@
+package env
+
+import (
+	"testing"
+	"time"
+)
+
+func TestEnv(t *testing.T) {
+	t.Setenv("ENV_TEST_STRING", "value")
+	t.Setenv("ENV_TEST_EMPTY", "")
+	t.Setenv("ENV_TEST_INT", "42")
+	t.Setenv("ENV_TEST_DURATION", "3s")
+	t.Setenv("ENV_TEST_INVALID", "abc")
+
+	if got := String("ENV_TEST_STRING", "def"); got != "value" {
+		t.Errorf("String() = %q, want value", got)
+	}
+	if got := String("ENV_TEST_EMPTY", "def"); got != "def" {
+		t.Errorf("String() of an empty variable = %q, want def", got)
+	}
+	if got := Int("ENV_TEST_INT", 1); got != 42 {
+		t.Errorf("Int() = %d, want 42", got)
+	}
+	if got := Int("ENV_TEST_INVALID", 1); got != 1 {
+		t.Errorf("Int() of an invalid value = %d, want 1", got)
+	}
+	if got := Duration("ENV_TEST_DURATION", time.Second); got != 3*time.Second {
+		t.Errorf("Duration() = %v, want 3s", got)
+	}
+	if got := Duration("ENV_TEST_UNSET", time.Second); got != time.Second {
+		t.Errorf("Duration() of an unset variable = %v, want 1s", got)
+	}
+}
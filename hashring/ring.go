@@ -0,0 +1,77 @@
+// Package hashring maps keys to nodes with consistent hashing, so adding or
+// removing a node only moves the keys of its neighbours on the ring.
+package hashring
+
+import (
+	"hash/fnv"
+	"sort"
+	"strconv"
+)
+
+// DefaultReplicas is the number of points a node gets on the ring when New
+// is given a non-positive count.
+const DefaultReplicas = 100
+
+// Ring is an immutable consistent-hash ring, safe for concurrent use.
+type Ring struct {
+	points []uint32
+	nodes  map[uint32]string
+}
+
+// New places replicas points of every node on the ring. The mapping depends
+// only on the set of nodes, not on their order.
+func New(nodes []string, replicas int) *Ring {
+	if replicas <= 0 {
+		replicas = DefaultReplicas
+	}
+	r := &Ring{nodes: make(map[uint32]string, len(nodes)*replicas)}
+	for _, node := range nodes {
+		for i := 0; i < replicas; i++ {
+			h := hash(node + "#" + strconv.Itoa(i))
+			// On a collision the smaller node name wins, whatever the order
+			// of nodes.
+			if other, ok := r.nodes[h]; ok {
+				if other < node {
+					continue
+				}
+			} else {
+				r.points = append(r.points, h)
+			}
+			r.nodes[h] = node
+		}
+	}
+	sort.Slice(r.points, func(i, j int) bool {
+		return r.points[i] < r.points[j]
+	})
+	return r
+}
+
+// Get returns the node owning key, or "" for an empty ring.
+func (r *Ring) Get(key string) string {
+	if len(r.points) == 0 {
+		return ""
+	}
+	h := hash(key)
+	i := sort.Search(len(r.points), func(i int) bool {
+		return r.points[i] >= h
+	})
+	if i == len(r.points) {
+		i = 0
+	}
+	return r.nodes[r.points[i]]
+}
+
+// hash is FNV-1a followed by the murmur3 finalizer. FNV alone maps keys
+// differing only in their last byte to nearby points, which would put
+// key-1, key-2, ... on the same node.
+func hash(s string) uint32 {
+	h := fnv.New32a()
+	h.Write([]byte(s))
+	x := h.Sum32()
+	x ^= x >> 16
+	x *= 0x85ebca6b
+	x ^= x >> 13
+	x *= 0xc2b2ae35
+	x ^= x >> 16
+	return x
+}
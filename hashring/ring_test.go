@@ -0,0 +1,52 @@
+package hashring
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestRing_Stable(t *testing.T) {
+	r1 := New([]string{"db-1", "db-2", "db-3"}, 0)
+	r2 := New([]string{"db-3", "db-1", "db-2"}, 0)
+	counts := map[string]int{}
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		node := r1.Get(key)
+		if node != r1.Get(key) || node != r2.Get(key) {
+			t.Fatalf("Key %s is not mapped to one node", key)
+		}
+		counts[node]++
+	}
+	for node, n := range counts {
+		if n < 200 {
+			t.Errorf("Node %s got only %d of 1000 keys", node, n)
+		}
+	}
+	if len(counts) != 3 {
+		t.Errorf("Unexpected nodes %v", counts)
+	}
+}
+
+func TestRing_AddNode(t *testing.T) {
+	before := New([]string{"db-1", "db-2", "db-3"}, 0)
+	after := New([]string{"db-1", "db-2", "db-3", "db-4"}, 0)
+	moved := 0
+	for i := 0; i < 1000; i++ {
+		key := fmt.Sprintf("key-%d", i)
+		if node := after.Get(key); node != before.Get(key) {
+			if node != "db-4" {
+				t.Fatalf("Key %s moved from %s to %s", key, before.Get(key), node)
+			}
+			moved++
+		}
+	}
+	if moved == 0 || moved > 400 {
+		t.Errorf("Adding a node moved %d of 1000 keys", moved)
+	}
+}
+
+func TestRing_Empty(t *testing.T) {
+	if node := New(nil, 0).Get("key"); node != "" {
+		t.Errorf("Empty ring returned %q", node)
+	}
+}
@@ -0,0 +1,72 @@
+package httptools
+
+import (
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// CORSConfig describes the cross-origin requests accepted by CORS. An
+// origin of "*" allows every origin. Empty Methods and Headers default to
+// the methods of the db API and Content-Type.
+type CORSConfig struct {
+	Origins []string
+	Methods []string
+	Headers []string
+}
+
+var (
+	defaultCORSMethods = []string{http.MethodGet, http.MethodHead, http.MethodPost, http.MethodDelete}
+	defaultCORSHeaders = []string{"Content-Type"}
+)
+
+// SplitList splits a comma separated flag value, dropping empty items.
+func SplitList(s string) []string {
+	var res []string
+	for _, item := range strings.Split(s, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			res = append(res, item)
+		}
+	}
+	return res
+}
+
+// CORS adds Access-Control-Allow-* headers to responses for the allowed
+// origins and answers their preflight requests itself. Requests from other
+// origins reach next unchanged, so the browser rejects them. CORS with no
+// origins returns next.
+func CORS(next http.Handler, conf CORSConfig) http.Handler {
+	if len(conf.Origins) == 0 {
+		return next
+	}
+	methods, headers := conf.Methods, conf.Headers
+	if len(methods) == 0 {
+		methods = defaultCORSMethods
+	}
+	if len(headers) == 0 {
+		headers = defaultCORSHeaders
+	}
+	anyOrigin := slices.Contains(conf.Origins, "*")
+
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		origin := r.Header.Get("Origin")
+		w.Header().Add("Vary", "Origin")
+		if origin == "" || !anyOrigin && !slices.Contains(conf.Origins, origin) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		if anyOrigin {
+			w.Header().Set("Access-Control-Allow-Origin", "*")
+		} else {
+			w.Header().Set("Access-Control-Allow-Origin", origin)
+		}
+
+		if r.Method == http.MethodOptions && r.Header.Get("Access-Control-Request-Method") != "" {
+			w.Header().Set("Access-Control-Allow-Methods", strings.Join(methods, ", "))
+			w.Header().Set("Access-Control-Allow-Headers", strings.Join(headers, ", "))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,78 @@
+package httptools
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func TestCORS(t *testing.T) {
+	next := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+	})
+	handler := CORS(next, CORSConfig{
+		Origins: []string{"https://admin.example"},
+		Headers: []string{"Content-Type", "X-Request-Id"},
+	})
+
+	serve := func(method, origin string, preflight bool) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(method, "/db/key", nil)
+		if origin != "" {
+			req.Header.Set("Origin", origin)
+		}
+		if preflight {
+			req.Header.Set("Access-Control-Request-Method", http.MethodPost)
+		}
+		rec := httptest.NewRecorder()
+		handler.ServeHTTP(rec, req)
+		return rec
+	}
+
+	t.Run("preflight", func(t *testing.T) {
+		rec := serve(http.MethodOptions, "https://admin.example", true)
+		want := map[string]string{
+			"Access-Control-Allow-Origin":  "https://admin.example",
+			"Access-Control-Allow-Methods": "GET, HEAD, POST, DELETE",
+			"Access-Control-Allow-Headers": "Content-Type, X-Request-Id",
+		}
+		if rec.Code != http.StatusNoContent {
+			t.Errorf("preflight returned %d", rec.Code)
+		}
+		for name, value := range want {
+			if got := rec.Header().Get(name); got != value {
+				t.Errorf("%s = %q, want %q", name, got, value)
+			}
+		}
+	})
+
+	t.Run("simple request", func(t *testing.T) {
+		rec := serve(http.MethodGet, "https://admin.example", false)
+		if rec.Code != http.StatusTeapot || rec.Header().Get("Access-Control-Allow-Origin") != "https://admin.example" {
+			t.Errorf("GET = %d, headers %v", rec.Code, rec.Header())
+		}
+	})
+
+	t.Run("other origin", func(t *testing.T) {
+		rec := serve(http.MethodOptions, "https://evil.example", true)
+		if rec.Code != http.StatusTeapot || rec.Header().Get("Access-Control-Allow-Origin") != "" {
+			t.Errorf("preflight from another origin = %d, headers %v", rec.Code, rec.Header())
+		}
+	})
+
+	t.Run("disabled", func(t *testing.T) {
+		req := httptest.NewRequest(http.MethodOptions, "/", nil)
+		req.Header.Set("Origin", "https://admin.example")
+		rec := httptest.NewRecorder()
+		CORS(next, CORSConfig{}).ServeHTTP(rec, req)
+		if rec.Code != http.StatusTeapot || len(rec.Header()) != 0 {
+			t.Errorf("disabled CORS = %d, headers %v", rec.Code, rec.Header())
+		}
+	})
+}
+
+func TestSplitList(t *testing.T) {
+	got := SplitList(" a, ,b,")
+	if len(got) != 2 || got[0] != "a" || got[1] != "b" {
+		t.Errorf("SplitList() = %q", got)
+	}
+}
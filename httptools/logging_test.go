@@ -0,0 +1,101 @@
+package httptools
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestStatusRecorder(t *testing.T) {
+	for _, tc := range []struct {
+		name    string
+		handler http.HandlerFunc
+		status  int
+		bytes   int
+	}{
+		{"implicit ok", func(w http.ResponseWriter, r *http.Request) {
+			_, _ = w.Write([]byte("hello"))
+		}, http.StatusOK, 5},
+		{"explicit status", func(w http.ResponseWriter, r *http.Request) {
+			http.Error(w, "nope", http.StatusNotFound)
+		}, http.StatusNotFound, len("nope\n")},
+		{"first status wins", func(w http.ResponseWriter, r *http.Request) {
+			w.WriteHeader(http.StatusCreated)
+			w.WriteHeader(http.StatusInternalServerError)
+		}, http.StatusCreated, 0},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			rec := &StatusRecorder{ResponseWriter: httptest.NewRecorder()}
+			tc.handler(rec, httptest.NewRequest(http.MethodGet, "/", nil))
+			if rec.Status != tc.status || rec.Bytes != tc.bytes {
+				t.Errorf("recorded %d, %d bytes; want %d, %d bytes", rec.Status, rec.Bytes, tc.status, tc.bytes)
+			}
+		})
+	}
+}
+
+func TestLogRequests(t *testing.T) {
+	handler := http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusTeapot)
+		_, _ = w.Write([]byte("short and stout"))
+	})
+
+	var out bytes.Buffer
+	logger, err := NewLogger(&out, "info", LogFormatText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rec := httptest.NewRecorder()
+	LogRequests(handler, logger).ServeHTTP(rec, httptest.NewRequest(http.MethodPost, "/pot", nil))
+	line := out.String()
+	id := rec.Header().Get(RequestIDHeader)
+	if id == "" || !strings.Contains(line, "request_id="+id+" method=POST path=/pot status=418 ") || !strings.HasSuffix(line, " bytes=15\n") {
+		t.Errorf("unexpected text log line %q", line)
+	}
+
+	out.Reset()
+	logger, err = NewLogger(&out, "info", LogFormatJSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	req := httptest.NewRequest(http.MethodGet, "/pot", nil)
+	req.Header.Set(RequestIDHeader, "abc")
+	LogRequests(handler, logger).ServeHTTP(httptest.NewRecorder(), req)
+	var entry struct {
+		Level     string `json:"level"`
+		RequestID string `json:"request_id"`
+		Method    string `json:"method"`
+		Path      string `json:"path"`
+		Status    int    `json:"status"`
+		Bytes     int    `json:"bytes"`
+	}
+	if err := json.Unmarshal(out.Bytes(), &entry); err != nil {
+		t.Fatalf("JSON log line %q: %v", out.String(), err)
+	}
+	if entry.Level != "INFO" || entry.RequestID != "abc" || entry.Method != http.MethodGet || entry.Path != "/pot" || entry.Status != http.StatusTeapot || entry.Bytes != 15 {
+		t.Errorf("unexpected JSON log entry %+v", entry)
+	}
+}
+
+func TestNewLogger(t *testing.T) {
+	var out bytes.Buffer
+	logger, err := NewLogger(&out, "warn", LogFormatText)
+	if err != nil {
+		t.Fatal(err)
+	}
+	logger.Info("hidden")
+	logger.Warn("shown", "key", "value")
+	if line := out.String(); strings.Contains(line, "hidden") || !strings.Contains(line, "level=WARN msg=shown key=value") {
+		t.Errorf("unexpected log output %q", line)
+	}
+
+	if _, err := NewLogger(&out, "loud", LogFormatText); err == nil {
+		t.Error("NewLogger accepted an unknown level")
+	}
+	if _, err := NewLogger(&out, "info", "xml"); err == nil {
+		t.Error("NewLogger accepted an unknown format")
+	}
+}
@@ -0,0 +1,123 @@
+package httptools
+
+import (
+	"fmt"
+	"io"
+	"maps"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// latencyWindow is the number of most recent requests the latency
+// percentiles of HTTPMetrics are computed over.
+const latencyWindow = 1024
+
+var (
+	latencyQuantiles = []float64{0.5, 0.9, 0.99}
+
+	// countedMethods are the methods counted under their own name; others
+	// are counted as OTHER, so clients cannot grow the counters at will.
+	countedMethods = []string{
+		http.MethodGet, http.MethodHead, http.MethodPost, http.MethodPut,
+		http.MethodPatch, http.MethodDelete, http.MethodOptions,
+	}
+)
+
+type requestClass struct {
+	method string
+	class  string
+}
+
+// HTTPMetrics counts the requests passed through Wrap by method and status
+// class, and keeps the latencies of the last latencyWindow of them. It
+// serves them in the Prometheus text exposition format. It is safe for
+// concurrent use.
+type HTTPMetrics struct {
+	mu        sync.Mutex
+	counts    map[requestClass]int64
+	latencies []time.Duration
+	next      int
+	total     int64
+	sum       time.Duration
+}
+
+func NewHTTPMetrics() *HTTPMetrics {
+	return &HTTPMetrics{counts: make(map[requestClass]int64)}
+}
+
+// Wrap records every request handled by next.
+func (m *HTTPMetrics) Wrap(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		start := time.Now()
+		rec := &StatusRecorder{ResponseWriter: w}
+		next.ServeHTTP(rec, r)
+		if rec.Status == 0 {
+			rec.Status = http.StatusOK
+		}
+		m.observe(r.Method, rec.Status, time.Since(start))
+	})
+}
+
+func (m *HTTPMetrics) observe(method string, status int, d time.Duration) {
+	if !slices.Contains(countedMethods, method) {
+		method = "OTHER"
+	}
+	class := requestClass{method: method, class: fmt.Sprintf("%dxx", status/100)}
+
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.counts[class]++
+	if len(m.latencies) < latencyWindow {
+		m.latencies = append(m.latencies, d)
+	} else {
+		m.latencies[m.next] = d
+		m.next = (m.next + 1) % latencyWindow
+	}
+	m.total++
+	m.sum += d
+}
+
+// WriteText writes the metrics to w.
+func (m *HTTPMetrics) WriteText(w io.Writer) {
+	m.mu.Lock()
+	counts := maps.Clone(m.counts)
+	latencies := slices.Clone(m.latencies)
+	total, sum := m.total, m.sum
+	m.mu.Unlock()
+
+	classes := slices.Collect(maps.Keys(counts))
+	sort.Slice(classes, func(i, j int) bool {
+		if classes[i].method != classes[j].method {
+			return classes[i].method < classes[j].method
+		}
+		return classes[i].class < classes[j].class
+	})
+	fmt.Fprintln(w, "# TYPE http_requests_total counter")
+	for _, c := range classes {
+		fmt.Fprintf(w, "http_requests_total{method=%q,code=%q} %d\n", c.method, c.class, counts[c])
+	}
+
+	slices.Sort(latencies)
+	fmt.Fprintln(w, "# TYPE http_request_duration_seconds summary")
+	for _, q := range latencyQuantiles {
+		var d time.Duration
+		if len(latencies) > 0 {
+			d = latencies[int(q*float64(len(latencies)-1))]
+		}
+		fmt.Fprintf(w, "http_request_duration_seconds{quantile=\"%g\"} %g\n", q, d.Seconds())
+	}
+	fmt.Fprintf(w, "http_request_duration_seconds_sum %g\n", sum.Seconds())
+	fmt.Fprintf(w, "http_request_duration_seconds_count %d\n", total)
+}
+
+func (m *HTTPMetrics) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	m.WriteText(w)
+}
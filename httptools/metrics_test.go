@@ -0,0 +1,55 @@
+package httptools
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestHTTPMetrics(t *testing.T) {
+	m := NewHTTPMetrics()
+	handler := m.Wrap(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/missing":
+			http.NotFound(w, r)
+		case "/fail":
+			w.WriteHeader(http.StatusInternalServerError)
+		case "/created":
+			w.WriteHeader(http.StatusCreated)
+		default:
+			_, _ = w.Write([]byte("ok"))
+		}
+	}))
+
+	for _, req := range []struct{ method, path string }{
+		{http.MethodGet, "/"},
+		{http.MethodGet, "/"},
+		{http.MethodGet, "/missing"},
+		{http.MethodPost, "/created"},
+		{http.MethodPost, "/fail"},
+		{"BREW", "/"},
+	} {
+		handler.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest(req.method, req.path, nil))
+	}
+
+	rec := httptest.NewRecorder()
+	m.ServeHTTP(rec, httptest.NewRequest(http.MethodGet, "/metrics", nil))
+	body := rec.Body.String()
+	for _, line := range []string{
+		`http_requests_total{method="GET",code="2xx"} 2`,
+		`http_requests_total{method="GET",code="4xx"} 1`,
+		`http_requests_total{method="OTHER",code="2xx"} 1`,
+		`http_requests_total{method="POST",code="2xx"} 1`,
+		`http_requests_total{method="POST",code="5xx"} 1`,
+		`http_request_duration_seconds{quantile="0.99"} `,
+		`http_request_duration_seconds_count 6`,
+	} {
+		if !strings.Contains(body, line) {
+			t.Errorf("metrics miss %q:\n%s", line, body)
+		}
+	}
+	if strings.Count(body, "http_requests_total{") != 5 {
+		t.Errorf("unexpected counters:\n%s", body)
+	}
+}
@@ -1,36 +1,118 @@
 package httptools
 
 import (
+	"context"
+	"crypto/tls"
+	"errors"
 	"fmt"
-	"log"
+	"log/slog"
+	"net"
 	"net/http"
+	"os"
 	"time"
 )
 
 type Server interface {
-	Start()
+	// Start binds the port and serves in the background. It returns the
+	// error of binding, say with the port in use; a later failure to serve
+	// finishes the process.
+	Start() error
+	// Shutdown stops the server gracefully, see http.Server.Shutdown.
+	Shutdown(ctx context.Context) error
 }
 
 type server struct {
 	httpServer *http.Server
 }
 
-func (s server) Start() {
+func (s server) Start() error {
+	ln, err := net.Listen("tcp", s.httpServer.Addr)
+	if err != nil {
+		return err
+	}
+	slog.Info("starting the HTTP server", "addr", ln.Addr().String(), "tls", s.httpServer.TLSConfig != nil)
 	go func() {
-		log.Println("Staring the HTTP server...")
-		err := s.httpServer.ListenAndServe()
-		log.Fatalf("HTTP server finished: %s. Finishing the process.", err)
+		var err error
+		if s.httpServer.TLSConfig != nil {
+			// The certificates come from the TLS config.
+			err = s.httpServer.ServeTLS(ln, "", "")
+		} else {
+			err = s.httpServer.Serve(ln)
+		}
+		if errors.Is(err, http.ErrServerClosed) {
+			return
+		}
+		slog.Error("HTTP server finished, finishing the process", "err", err)
+		os.Exit(1)
 	}()
+	return nil
+}
+
+func (s server) Shutdown(ctx context.Context) error {
+	return s.httpServer.Shutdown(ctx)
+}
+
+// ServerOption configures the server built by CreateServer.
+type ServerOption func(*http.Server)
+
+// WithReadTimeout bounds the time to read a whole request, 10 seconds by
+// default. Zero means no limit.
+func WithReadTimeout(d time.Duration) ServerOption {
+	return func(s *http.Server) {
+		s.ReadTimeout = d
+	}
+}
+
+// WithWriteTimeout bounds the time to write a response, 10 seconds by
+// default. Zero means no limit.
+func WithWriteTimeout(d time.Duration) ServerOption {
+	return func(s *http.Server) {
+		s.WriteTimeout = d
+	}
+}
+
+// WithIdleTimeout bounds the time a keep-alive connection waits for the
+// next request. By default, and with zero, the read timeout is used.
+func WithIdleTimeout(d time.Duration) ServerOption {
+	return func(s *http.Server) {
+		s.IdleTimeout = d
+	}
+}
+
+// WithTLSConfig makes the server accept HTTPS only, with the certificates
+// of conf. A nil conf keeps plain HTTP.
+func WithTLSConfig(conf *tls.Config) ServerOption {
+	return func(s *http.Server) {
+		s.TLSConfig = conf
+	}
 }
 
-func CreateServer(port int, handler http.Handler) Server {
-	return server{
-		httpServer: &http.Server{
-			Addr:           fmt.Sprintf(":%d", port),
-			Handler:        handler,
-			ReadTimeout:    10 * time.Second,
-			WriteTimeout:   10 * time.Second,
-			MaxHeaderBytes: 1 << 20,
-		},
+func CreateServer(port int, handler http.Handler, opts ...ServerOption) Server {
+	s := &http.Server{
+		Addr:           fmt.Sprintf(":%d", port),
+		Handler:        handler,
+		ReadTimeout:    10 * time.Second,
+		WriteTimeout:   10 * time.Second,
+		MaxHeaderBytes: 1 << 20,
+	}
+	for _, opt := range opts {
+		opt(s)
+	}
+	return server{httpServer: s}
+}
+
+// LoadTLSConfig returns a TLS config serving the certificate in certFile
+// with its key in keyFile, or nil if both are empty.
+func LoadTLSConfig(certFile, keyFile string) (*tls.Config, error) {
+	if certFile == "" && keyFile == "" {
+		return nil, nil
+	}
+	if certFile == "" || keyFile == "" {
+		return nil, errors.New("TLS needs both a certificate and a key file")
+	}
+	cert, err := tls.LoadX509KeyPair(certFile, keyFile)
+	if err != nil {
+		return nil, err
 	}
+	return &tls.Config{Certificates: []tls.Certificate{cert}, MinVersion: tls.VersionTLS12}, nil
 }
@@ -0,0 +1,73 @@
+package httptools
+
+import (
+	"context"
+	"crypto/tls"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"testing"
+	"time"
+)
+
+func TestCreateServer(t *testing.T) {
+	plain := CreateServer(8080, http.NotFoundHandler()).(server).httpServer
+	if plain.ReadTimeout != 10*time.Second || plain.WriteTimeout != 10*time.Second || plain.IdleTimeout != 0 || plain.TLSConfig != nil {
+		t.Errorf("default server has read %v, write %v, idle %v, TLS %v", plain.ReadTimeout, plain.WriteTimeout, plain.IdleTimeout, plain.TLSConfig)
+	}
+
+	conf := &tls.Config{MinVersion: tls.VersionTLS13}
+	s := CreateServer(8080, http.NotFoundHandler(),
+		WithReadTimeout(time.Second),
+		WithWriteTimeout(2*time.Second),
+		WithIdleTimeout(time.Minute),
+		WithTLSConfig(conf),
+	).(server).httpServer
+	if s.Addr != ":8080" || s.ReadTimeout != time.Second || s.WriteTimeout != 2*time.Second || s.IdleTimeout != time.Minute || s.TLSConfig != conf {
+		t.Errorf("configured server has addr %s, read %v, write %v, idle %v, TLS %v", s.Addr, s.ReadTimeout, s.WriteTimeout, s.IdleTimeout, s.TLSConfig)
+	}
+}
+
+func TestLoadTLSConfig(t *testing.T) {
+	if conf, err := LoadTLSConfig("", ""); conf != nil || err != nil {
+		t.Errorf("LoadTLSConfig() without files = %v, %v", conf, err)
+	}
+	if _, err := LoadTLSConfig("cert.pem", ""); err == nil {
+		t.Error("LoadTLSConfig() without a key succeeded")
+	}
+	if _, err := LoadTLSConfig("missing.pem", "missing.key"); err == nil {
+		t.Error("LoadTLSConfig() of missing files succeeded")
+	}
+}
+
+func TestServer_StartReportsBindErrors(t *testing.T) {
+	ln, err := net.Listen("tcp", ":0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	_ = ln.Close()
+
+	first := CreateServer(port, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = w.Write([]byte("first"))
+	}))
+	if err := first.Start(); err != nil {
+		t.Fatalf("Start() on a free port: %v", err)
+	}
+	defer first.Shutdown(context.Background())
+
+	if err := CreateServer(port, http.NotFoundHandler()).Start(); err == nil {
+		t.Fatal("Start() on a port in use succeeded")
+	}
+
+	resp, err := http.Get(fmt.Sprintf("http://localhost:%d/", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	_ = resp.Body.Close()
+	if string(body) != "first" {
+		t.Errorf("GET after the failed start = %q", body)
+	}
+}
@@ -1,9 +1,11 @@
 package integration
 
 import (
+	"encoding/json"
 	"fmt"
 	"net/http"
 	"os"
+	"strings"
 	"testing"
 	"time"
 
@@ -41,6 +43,60 @@ func TestBalancer(t *testing.T) {
 	assert.Equal(t, 1, len(serverSet), "Expected all responses from the same server")
 }
 
+func TestBalancer_WriteThrough(t *testing.T) {
+	if _, exists := os.LookupEnv("INTEGRATION_TEST"); !exists {
+		t.Skip("Integration test is not enabled")
+	}
+
+	url := fmt.Sprintf("%s/api/v1/some-data?key=write-through", baseAddress)
+	resp, err := client.Post(url, "application/json", strings.NewReader(`{"value":"written"}`))
+	if err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp, err = client.Get(url)
+	if err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	defer resp.Body.Close()
+	var value string
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&value))
+	assert.Equal(t, "written", value)
+}
+
+func TestBalancer_EmptyValue(t *testing.T) {
+	if _, exists := os.LookupEnv("INTEGRATION_TEST"); !exists {
+		t.Skip("Integration test is not enabled")
+	}
+
+	url := fmt.Sprintf("%s/api/v1/some-data?key=empty-value", baseAddress)
+	resp, err := client.Post(url, "application/json", strings.NewReader(`{"value":""}`))
+	if err != nil {
+		t.Fatalf("write failed: %s", err)
+	}
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusCreated, resp.StatusCode)
+
+	resp, err = client.Get(url)
+	if err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	defer resp.Body.Close()
+	assert.Equal(t, http.StatusOK, resp.StatusCode)
+	var value string
+	assert.NoError(t, json.NewDecoder(resp.Body).Decode(&value))
+	assert.Equal(t, "", value)
+
+	resp, err = client.Get(fmt.Sprintf("%s/api/v1/some-data?key=never-written", baseAddress))
+	if err != nil {
+		t.Fatalf("read failed: %s", err)
+	}
+	_ = resp.Body.Close()
+	assert.Equal(t, http.StatusNotFound, resp.StatusCode)
+}
+
 func BenchmarkBalancer(b *testing.B) {
 	if _, exists := os.LookupEnv("INTEGRATION_TEST"); !exists {
 		b.Skip("Integration benchmark is not enabled")
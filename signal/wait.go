@@ -1,15 +1,26 @@
 package signal
 
 import (
-	"log"
+	"context"
+	"log/slog"
 	"os"
 	"os/signal"
 	"syscall"
 )
 
+var terminationSignals = []os.Signal{syscall.SIGINT, syscall.SIGTERM}
+
 func WaitForTerminationSignal() {
-	intChannel := make(chan os.Signal)
-	signal.Notify(intChannel, syscall.SIGINT, syscall.SIGTERM)
+	intChannel := make(chan os.Signal, 1)
+	signal.Notify(intChannel, terminationSignals...)
 	<-intChannel
-	log.Println("Shutting down...")
+	slog.Info("shutting down")
+}
+
+// NotifyContext returns a context cancelled on the first SIGINT or SIGTERM.
+// The returned function stops the notification and cancels the context;
+// until it is called, the signals no longer terminate the process.
+func NotifyContext() (context.Context, func()) {
+	ctx, stop := signal.NotifyContext(context.Background(), terminationSignals...)
+	return ctx, stop
 }